@@ -0,0 +1,433 @@
+// Local HTTP/JSON admin API, for looking into a server and stepping in while it runs
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Settings.AdminAddr turns it on (embedders can also mount AdminHandler themselves), every answer is JSON:
+//
+//	GET    /conversations                 every conversation, with its address, features, state and last packet
+//	POST   /conversations/{id}/kick       drops a conversation, the client may connect again
+//	POST   /conversations/{id}/ban        drops a conversation and ignores its ID and IP from then on
+//	GET    /bans                          banned Conversation IDs and IPs
+//	DELETE /bans/conversations/{id}       lifts a Conversation ID's ban
+//	DELETE /bans/addresses/{ip}           lifts an IP's ban
+//	GET    /referendums                   every referendum hosted, with its tally and state
+//	GET    /referendums/{vote_id}         one of them
+//	GET    /impairments                   emulated network conditions by peer, "" is the default
+//	PUT    /impairments                   {"peer": "", "settings": "loss=0.2 latency=50ms"} changes a peer's
+//	DELETE /impairments?peer=...          drops a peer's profile (or resets the default)
+//
+// With Settings.AdminToken set, every request needs it (Authorization: Bearer <token>). Either way, requests
+// that change anything are refused when a browser sends them from another site (their Origin isn't the admin
+// API itself), and when served at Settings.AdminAddr, every request has to name it by IP, localhost or the
+// listener's own host, so a web page can't reach it through a DNS name of its own either. Without a token,
+// keep it on a loopback address.
+
+// A conversation, as the admin API shows it
+type ConversationInfo struct {
+	ID       uint32    `json:"id"`
+	Address  string    `json:"address"`
+	Features []string  `json:"features"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// A hosted referendum, as the admin API shows it
+type ReferendumInfo struct {
+	VoteID       uuid.UUID         `json:"vote_id"`
+	Question     string            `json:"question"`
+	State        string            `json:"state"`            // "ongoing" or "decided"
+	Result       *uint16           `json:"result,omitempty"` // Once decided
+	Proposer     uint32            `json:"proposer,omitempty"`
+	Participants []uint32          `json:"participants"`
+	Voted        []uint32          `json:"voted"`
+	Tallies      map[uint16]uint64 `json:"tallies"`
+	Started      time.Time         `json:"started"`
+	Deadline     time.Time         `json:"deadline"`
+	TimedOut     bool              `json:"timed_out,omitempty"` // Closed at its deadline by the timeout policy
+}
+
+// Names for the features a node lists in its hello
+var feature_names = map[uint16]string{
+	simple_eval: "simple_eval",
+	fec_xor:     "fec_xor",
+}
+
+// Conversations lists the node's conversations by ID
+func (node *Node) Conversations() []ConversationInfo {
+	node.conversations_lock.Lock()
+	defer node.conversations_lock.Unlock()
+
+	conversations := make([]ConversationInfo, 0, len(node.conversations))
+	for _, conv := range node.conversations {
+		info := ConversationInfo{
+			ID:       conv.conversation_id,
+			Address:  conv.address().String(),
+			Features: []string{},
+			Online:   conv.isOnline(),
+			LastSeen: conv.lastSeen(),
+		}
+		for _, feature := range conv.features() {
+			if name, exists := feature_names[feature]; exists {
+				info.Features = append(info.Features, name)
+			}
+		}
+		conversations = append(conversations, info)
+	}
+
+	sort.Slice(conversations, func(i, j int) bool { return conversations[i].ID < conversations[j].ID })
+	return conversations
+}
+
+// Referendums lists the referendums a server hosts, oldest first
+func (node *Node) Referendums() []ReferendumInfo {
+	manager := node.ref_manager
+	manager.h_referendums_lock.Lock()
+	defer manager.h_referendums_lock.Unlock()
+
+	referendums := make([]ReferendumInfo, 0, len(manager.h_referendums))
+	for _, h_ref := range manager.h_referendums {
+		referendums = append(referendums, h_ref.info())
+	}
+
+	sort.Slice(referendums, func(i, j int) bool { return referendums[i].Started.Before(referendums[j].Started) })
+	return referendums
+}
+
+// Referendum looks up one hosted referendum
+func (node *Node) Referendum(vote_id uuid.UUID) (ReferendumInfo, bool) {
+	manager := node.ref_manager
+	manager.h_referendums_lock.Lock()
+	defer manager.h_referendums_lock.Unlock()
+
+	h_ref, exists := manager.h_referendums[vote_id]
+	if !exists {
+		return ReferendumInfo{}, false
+	}
+	return h_ref.info(), true
+}
+
+// info copies what the admin API shows of a referendum (the caller must hold h_referendums_lock)
+func (h_referendum *host_referendum) info() ReferendumInfo {
+	h_referendum.referendum_lock.Lock()
+	defer h_referendum.referendum_lock.Unlock()
+
+	info := ReferendumInfo{
+		VoteID:       h_referendum.VoteID,
+		Question:     h_referendum.Question,
+		State:        "ongoing",
+		Participants: h_referendum.participantIDs(),
+		Voted:        []uint32{},
+		Tallies:      h_referendum.tallyCopy(),
+		Started:      h_referendum.started,
+		Deadline:     h_referendum.deadline,
+		TimedOut:     h_referendum.timed_out,
+	}
+
+	if !h_referendum.ongoing {
+		result := h_referendum.result
+		info.State = "decided"
+		info.Result = &result
+	}
+	if h_referendum.proposer != nil {
+		info.Proposer = h_referendum.proposer.conversation_id
+	}
+
+	for id := range h_referendum.who {
+		info.Voted = append(info.Voted, id)
+	}
+	sort.Slice(info.Voted, func(i, j int) bool { return info.Voted[i] < info.Voted[j] })
+
+	return info
+}
+
+// Kick drops a conversation, it stops sending and its client has to connect again
+func (node *Node) Kick(conversation_id uint32) error {
+	node.conversations_lock.Lock()
+	conv, exists := node.conversations[conversation_id]
+	node.conversations_lock.Unlock()
+
+	if !exists {
+		return fmt.Errorf("Kick: no conversation with ID %d", conversation_id)
+	}
+
+	conv.transport_log.Info("Conversation kicked", "addr", conv.address())
+	node.dropConversation(conv)
+
+	return nil
+}
+
+// dropConversation forgets a conversation and stops it, for kicks
+func (node *Node) dropConversation(conv *conversation) {
+	node.forgetConversation(conv)
+	conv.setOffline()
+
+	// It won't be voting in anything it was still expected to
+	if node.i_am_server {
+		node.ref_manager.participant_offline(conv)
+	}
+}
+
+// forgetConversation removes a conversation from the map and stops it
+func (node *Node) forgetConversation(conv *conversation) {
+	node.conversations_lock.Lock()
+	if node.conversations[conv.conversation_id] == conv {
+		delete(node.conversations, conv.conversation_id)
+	}
+	node.conversations_lock.Unlock()
+
+	conv.stop()
+}
+
+// Ban kicks a conversation and ignores its Conversation ID and IP from then on
+func (node *Node) Ban(conversation_id uint32) error {
+	node.conversations_lock.Lock()
+	conv, exists := node.conversations[conversation_id]
+	node.conversations_lock.Unlock()
+
+	if !exists {
+		return fmt.Errorf("Ban: no conversation with ID %d", conversation_id)
+	}
+
+	node.bans_lock.Lock()
+	node.banned_conversations[conversation_id] = true
+	node.banned_addrs[conv.address().IP.String()] = true
+	node.bans_lock.Unlock()
+
+	conv.transport_log.Info("Conversation banned", "addr", conv.address())
+
+	return node.Kick(conversation_id)
+}
+
+// Unban lifts a Conversation ID's ban
+func (node *Node) Unban(conversation_id uint32) bool {
+	node.bans_lock.Lock()
+	defer node.bans_lock.Unlock()
+
+	banned := node.banned_conversations[conversation_id]
+	delete(node.banned_conversations, conversation_id)
+	return banned
+}
+
+// UnbanAddr lifts an IP's ban
+func (node *Node) UnbanAddr(ip string) bool {
+	node.bans_lock.Lock()
+	defer node.bans_lock.Unlock()
+
+	banned := node.banned_addrs[ip]
+	delete(node.banned_addrs, ip)
+	return banned
+}
+
+// isBanned checks a packet's Conversation ID and source IP against the bans
+func (node *Node) isBanned(conversation_id uint32, ip net.IP) bool {
+	node.bans_lock.Lock()
+	defer node.bans_lock.Unlock()
+
+	return node.banned_conversations[conversation_id] || node.banned_addrs[ip.String()]
+}
+
+// AdminHandler routes the admin API
+func (node *Node) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /conversations", func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, http.StatusOK, node.Conversations())
+	})
+
+	mux.HandleFunc("POST /conversations/{id}/kick", func(writer http.ResponseWriter, request *http.Request) {
+		node.adminConversationAction(writer, request, node.Kick)
+	})
+
+	mux.HandleFunc("POST /conversations/{id}/ban", func(writer http.ResponseWriter, request *http.Request) {
+		node.adminConversationAction(writer, request, node.Ban)
+	})
+
+	mux.HandleFunc("GET /bans", func(writer http.ResponseWriter, request *http.Request) {
+		bans := struct {
+			Conversations []uint32 `json:"conversations"`
+			Addresses     []string `json:"addresses"`
+		}{Conversations: []uint32{}, Addresses: []string{}}
+
+		node.bans_lock.Lock()
+		for id := range node.banned_conversations {
+			bans.Conversations = append(bans.Conversations, id)
+		}
+		for ip := range node.banned_addrs {
+			bans.Addresses = append(bans.Addresses, ip)
+		}
+		node.bans_lock.Unlock()
+
+		sort.Slice(bans.Conversations, func(i, j int) bool { return bans.Conversations[i] < bans.Conversations[j] })
+		sort.Strings(bans.Addresses)
+		writeJSON(writer, http.StatusOK, bans)
+	})
+
+	mux.HandleFunc("DELETE /bans/conversations/{id}", func(writer http.ResponseWriter, request *http.Request) {
+		id, err := strconv.ParseUint(request.PathValue("id"), 10, 32)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("%q isn't a Conversation ID", request.PathValue("id")))
+			return
+		}
+		if !node.Unban(uint32(id)) {
+			writeError(writer, http.StatusNotFound, fmt.Errorf("Conversation ID %d isn't banned", id))
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("DELETE /bans/addresses/{ip}", func(writer http.ResponseWriter, request *http.Request) {
+		if !node.UnbanAddr(request.PathValue("ip")) {
+			writeError(writer, http.StatusNotFound, fmt.Errorf("%s isn't banned", request.PathValue("ip")))
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /referendums", func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, http.StatusOK, node.Referendums())
+	})
+
+	mux.HandleFunc("GET /referendums/{vote_id}", func(writer http.ResponseWriter, request *http.Request) {
+		vote_id, err := uuid.Parse(request.PathValue("vote_id"))
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("%q isn't a Vote ID", request.PathValue("vote_id")))
+			return
+		}
+
+		info, exists := node.Referendum(vote_id)
+		if !exists {
+			writeError(writer, http.StatusNotFound, fmt.Errorf("no referendum with Vote ID %s", vote_id))
+			return
+		}
+		writeJSON(writer, http.StatusOK, info)
+	})
+
+	mux.HandleFunc("GET /impairments", func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, http.StatusOK, node.impairments.snapshot())
+	})
+
+	mux.HandleFunc("PUT /impairments", func(writer http.ResponseWriter, request *http.Request) {
+		var change struct {
+			Peer     string `json:"peer"`
+			Settings string `json:"settings"`
+		}
+
+		decoder := json.NewDecoder(request.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&change); err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := node.SetImpairment(change.Peer, change.Settings); err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		node.transport_log.Info("Impairment changed", "peer", change.Peer, "settings", change.Settings)
+		writeJSON(writer, http.StatusOK, node.impairments.snapshot())
+	})
+
+	mux.HandleFunc("DELETE /impairments", func(writer http.ResponseWriter, request *http.Request) {
+		peer := request.URL.Query().Get("peer")
+		node.ResetImpairment(peer)
+
+		node.transport_log.Info("Impairment reset", "peer", peer)
+		writeJSON(writer, http.StatusOK, node.impairments.snapshot())
+	})
+
+	return node.guardAdmin(mux)
+}
+
+// guardAdmin checks the token, Host and Origin of admin requests before handing them on
+func (node *Node) guardAdmin(next http.Handler) http.Handler {
+	return node.guardHTTP(node.admin_addr, next)
+}
+
+// guardHTTP checks the admin token, and the Host and Origin of requests to the listener at addr
+func (node *Node) guardHTTP(addr string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if node.admin_token != "" && subtle.ConstantTimeCompare([]byte(request.Header.Get("Authorization")), []byte("Bearer "+node.admin_token)) != 1 {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(writer, http.StatusUnauthorized, errors.New("admin token required"))
+			return
+		}
+
+		if !hostAllowed(addr, request.Host) {
+			writeError(writer, http.StatusForbidden, fmt.Errorf("%q isn't this listener's address", request.Host))
+			return
+		}
+
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			if origin := request.Header.Get("Origin"); origin != "" {
+				parsed, err := url.Parse(origin)
+				if err != nil || parsed.Host != request.Host {
+					writeError(writer, http.StatusForbidden, fmt.Errorf("requests from %q can't change anything", origin))
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// hostAllowed checks the Host a request was sent to, IPs and localhost can't be rebound to us by someone
+// else's DNS, anything else has to be the listener's own name (embedders mounting the handlers without
+// a listener address decide for themselves)
+func hostAllowed(addr string, host string) bool {
+	if addr == "" {
+		return true
+	}
+
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+	}
+	listener, _, _ := net.SplitHostPort(addr)
+
+	return name == "localhost" || net.ParseIP(name) != nil || (name != "" && name == listener)
+}
+
+// adminConversationAction runs Kick or Ban on the conversation in the path
+func (node *Node) adminConversationAction(writer http.ResponseWriter, request *http.Request, action func(uint32) error) {
+	id, err := strconv.ParseUint(request.PathValue("id"), 10, 32)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("%q isn't a Conversation ID", request.PathValue("id")))
+		return
+	}
+
+	if err := action(uint32(id)); err != nil {
+		writeError(writer, http.StatusNotFound, err)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(writer http.ResponseWriter, status int, body any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(body)
+}
+
+func writeError(writer http.ResponseWriter, status int, err error) {
+	writeJSON(writer, status, map[string]string{"error": err.Error()})
+}
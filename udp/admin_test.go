@@ -0,0 +1,59 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The admin API wants its token, won't answer to a name someone else's DNS could point at it, and won't
+// let another site's page change anything
+func TestAdminGuard(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Log.Output = io.Discard
+	settings.AdminAddr = "127.0.0.1:9091"
+	settings.AdminToken = "secret"
+	admin := newNode(settings, true).AdminHandler()
+
+	requests := []struct {
+		name   string
+		method string
+		host   string
+		token  string
+		origin string
+		status int
+	}{
+		{"no token", http.MethodGet, "127.0.0.1:9091", "", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "127.0.0.1:9091", "guess", "", http.StatusUnauthorized},
+		{"read", http.MethodGet, "127.0.0.1:9091", "secret", "", http.StatusOK},
+		{"read through localhost", http.MethodGet, "localhost:9091", "secret", "", http.StatusOK},
+		{"rebound name", http.MethodGet, "evil.example:9091", "secret", "", http.StatusForbidden},
+		{"kick from another site", http.MethodPost, "127.0.0.1:9091", "secret", "http://evil.example", http.StatusForbidden},
+		{"kick from a sandboxed page", http.MethodPost, "127.0.0.1:9091", "secret", "null", http.StatusForbidden},
+		{"kick from itself", http.MethodPost, "127.0.0.1:9091", "secret", "http://127.0.0.1:9091", http.StatusNotFound},
+		{"kick with curl", http.MethodPost, "127.0.0.1:9091", "secret", "", http.StatusNotFound},
+	}
+
+	for _, r := range requests {
+		target := "/bans"
+		if r.method == http.MethodPost {
+			target = "/conversations/42/kick" // Nobody has ID 42, getting past the guard means a 404
+		}
+
+		request := httptest.NewRequest(r.method, target, nil)
+		request.Host = r.host
+		if r.token != "" {
+			request.Header.Set("Authorization", "Bearer "+r.token)
+		}
+		if r.origin != "" {
+			request.Header.Set("Origin", r.origin)
+		}
+
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, request)
+		if recorder.Code != r.status {
+			t.Errorf("%s: status %d, expected %d", r.name, recorder.Code, r.status)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Batched socket I/O, many datagrams per syscall instead of one
+package core
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// On Linux, each socket is read with recvmmsg and written with sendmmsg (through golang.org/x/net), elsewhere
+// (batch_other.go) a "batch" is a single datagram. This all sits under udp_transport. Reads are batched in
+// readLoop, BATCH_SIZE buffers at a time. Writes go through one batch_writer per socket: every sender queues its datagram and waits for the result,
+// and the writer sends whatever has piled up in one go, so a broadcast to many conversations (whose loopers
+// all send at about the same time) takes a handful of syscalls instead of one per conversation.
+
+const BATCH_SIZE = 64
+
+// A datagram waiting for its batch_writer, the result of sending it comes back on done
+type outgoing_datagram struct {
+	data []byte
+	addr *net.UDPAddr // nil for connected sockets
+	done chan error
+}
+
+// Sends everything queued for one socket
+type batch_writer struct {
+	conn  *batch_conn
+	queue chan outgoing_datagram
+
+	closing    chan struct{} // Closed by close, nothing more gets queued
+	stopped    chan struct{} // Closed once run has returned
+	close_once sync.Once
+}
+
+// newBatchWriter starts the writer for a socket
+func newBatchWriter(conn *batch_conn) *batch_writer {
+	writer := &batch_writer{
+		conn:    conn,
+		queue:   make(chan outgoing_datagram, BATCH_SIZE),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go writer.run()
+
+	return writer
+}
+
+// write queues a datagram and waits until it has gone out, net.ErrClosed once the writer is closed
+func (writer *batch_writer) write(data []byte, addr *net.UDPAddr) error {
+	done := make(chan error, 1)
+
+	select {
+	case writer.queue <- outgoing_datagram{data: data, addr: addr, done: done}:
+	case <-writer.closing:
+		return net.ErrClosed
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-writer.stopped:
+		// It may have gone out just before the writer stopped
+		select {
+		case err := <-done:
+			return err
+		default:
+			return net.ErrClosed
+		}
+	}
+}
+
+// close stops the writer, whatever is still queued gets net.ErrClosed, returns once run has
+func (writer *batch_writer) close() {
+	writer.close_once.Do(func() { close(writer.closing) })
+	<-writer.stopped
+}
+
+// run takes the first datagram waiting, along with whatever else is already queued (up to BATCH_SIZE), and sends them together
+func (writer *batch_writer) run() {
+	defer close(writer.stopped)
+
+	batch := make([]outgoing_datagram, 0, BATCH_SIZE)
+
+	for {
+		var first outgoing_datagram
+		select {
+		case first = <-writer.queue:
+		case <-writer.closing:
+			writer.drain()
+			return
+		}
+
+		batch = append(batch[:0], first)
+
+	drain:
+		for len(batch) < BATCH_SIZE {
+			select {
+			case datagram := <-writer.queue:
+				batch = append(batch, datagram)
+			default:
+				break drain
+			}
+		}
+
+		writer.flush(batch)
+	}
+}
+
+// drain fails everything left in the queue once the writer is closing
+func (writer *batch_writer) drain() {
+	for {
+		select {
+		case datagram := <-writer.queue:
+			datagram.done <- net.ErrClosed
+		default:
+			return
+		}
+	}
+}
+
+// flush sends a batch, a datagram that fails gets the error and the rest are sent after it
+func (writer *batch_writer) flush(batch []outgoing_datagram) {
+	for len(batch) > 0 {
+		sent, err := writer.conn.writeBatch(batch)
+
+		for i := 0; i < sent; i++ {
+			batch[i].done <- nil
+		}
+		batch = batch[sent:]
+
+		if len(batch) > 0 && (err != nil || sent == 0) {
+			if err == nil {
+				err = errors.New("flush: nothing sent")
+			}
+			batch[0].done <- err
+			batch = batch[1:]
+		}
+	}
+}
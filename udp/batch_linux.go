@@ -0,0 +1,83 @@
+//go:build linux
+
+package core
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ipv4.PacketConn and ipv6.PacketConn both batch with recvmmsg/sendmmsg, and share a Message type
+type batch_packet_conn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// A socket read and written a batch at a time
+type batch_conn struct {
+	conn       *net.UDPConn
+	connected  bool
+	packetConn batch_packet_conn
+	readMsgs   []ipv4.Message
+	writeMsgs  []ipv4.Message
+}
+
+func newBatchConn(conn *net.UDPConn) *batch_conn {
+	batch := &batch_conn{
+		conn:      conn,
+		connected: conn.RemoteAddr() != nil,
+		readMsgs:  make([]ipv4.Message, BATCH_SIZE),
+		writeMsgs: make([]ipv4.Message, BATCH_SIZE),
+	}
+
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() == nil && len(local.IP) == net.IPv6len {
+		batch.packetConn = ipv6.NewPacketConn(conn)
+	} else {
+		batch.packetConn = ipv4.NewPacketConn(conn)
+	}
+
+	return batch
+}
+
+// readBatch fills as many of buffers as there are datagrams waiting (at least one, it blocks until then)
+func (batch *batch_conn) readBatch(buffers []*[]byte, lengths []int, addrs []*net.UDPAddr) (int, error) {
+	msgs := batch.readMsgs[:len(buffers)]
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{*buffers[i]}
+		msgs[i].N = 0
+		msgs[i].Addr = nil
+	}
+
+	received, err := batch.packetConn.ReadBatch(msgs, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < received; i++ {
+		lengths[i] = msgs[i].N
+		addrs[i], _ = msgs[i].Addr.(*net.UDPAddr)
+	}
+
+	return received, nil
+}
+
+// writeBatch sends datagrams with one sendmmsg, returns how many went out
+func (batch *batch_conn) writeBatch(datagrams []outgoing_datagram) (int, error) {
+	msgs := batch.writeMsgs[:len(datagrams)]
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{datagrams[i].data}
+		msgs[i].Addr = nil
+		if !batch.connected {
+			msgs[i].Addr = datagrams[i].addr
+		}
+	}
+
+	// x/net reports -1 alongside an error (e.g. ECONNREFUSED from a server that went away)
+	sent, err := batch.packetConn.WriteBatch(msgs, 0)
+	if sent < 0 {
+		sent = 0
+	}
+	return sent, err
+}
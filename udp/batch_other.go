@@ -0,0 +1,49 @@
+//go:build !linux
+
+package core
+
+import "net"
+
+// Without recvmmsg/sendmmsg, a batch is one datagram
+type batch_conn struct {
+	conn      *net.UDPConn
+	connected bool
+}
+
+func newBatchConn(conn *net.UDPConn) *batch_conn {
+	return &batch_conn{
+		conn:      conn,
+		connected: conn.RemoteAddr() != nil,
+	}
+}
+
+// readBatch reads a single datagram into the first buffer
+func (batch *batch_conn) readBatch(buffers []*[]byte, lengths []int, addrs []*net.UDPAddr) (int, error) {
+	n, addr, err := batch.conn.ReadFromUDP(*buffers[0])
+	if err != nil {
+		return 0, err
+	}
+
+	lengths[0] = n
+	addrs[0] = addr
+
+	return 1, nil
+}
+
+// writeBatch sends datagrams one at a time, stopping at the first error
+func (batch *batch_conn) writeBatch(datagrams []outgoing_datagram) (int, error) {
+	for i, datagram := range datagrams {
+		var err error
+		if batch.connected {
+			_, err = batch.conn.Write(datagram.data)
+		} else {
+			_, err = batch.conn.WriteTo(datagram.data, datagram.addr)
+		}
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(datagrams), nil
+}
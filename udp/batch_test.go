@@ -0,0 +1,150 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with go test -run '^$' -bench Broadcast
+
+// Closing a batched transport stops its writer, writers caught in the middle get net.ErrClosed (or went out
+// just before), and nothing hangs or panics
+func TestBatchWriterClose(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := newUDPTransport(conn, true)
+	sink := conn.LocalAddr().(*net.UDPAddr)
+
+	if err := udp.writeTo([]byte("before"), sink); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 4*BATCH_SIZE)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- udp.writeTo([]byte("during"), sink)
+		}()
+	}
+
+	udp.close()
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writers still waiting after close")
+	}
+	close(errs)
+
+	for err := range errs {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Errorf("writer got %v, expected nil or net.ErrClosed", err)
+		}
+	}
+
+	select {
+	case <-udp.writer.stopped:
+	default:
+		t.Error("batch writer still running after close")
+	}
+
+	if err := udp.writeTo([]byte("after"), sink); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close got %v, expected net.ErrClosed", err)
+	}
+}
+
+const BROADCAST_SINKS = 16 // Sockets the conversations are spread over on the receiving end
+
+// BenchmarkBroadcast sends one packet to every conversation at once, the way a vote broadcast does,
+// with and without batched socket writes
+func BenchmarkBroadcast(b *testing.B) {
+	for _, numConversations := range []int{1024, 4096} {
+		for _, batched := range []bool{false, true} {
+			name := fmt.Sprintf("conversations=%d/batched=%t", numConversations, batched)
+			b.Run(name, func(b *testing.B) {
+				benchmarkBroadcast(b, numConversations, batched)
+			})
+		}
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, numConversations int, batched bool) {
+	settings := DefaultSettings()
+	settings.Transport.BatchIO = batched
+	node := newNode(settings, true)
+
+	server_conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := newUDPTransport(server_conn, node.batch_io)
+	defer server.close()
+
+	// Receivers that just throw everything away
+	sinks := make([]*net.UDPConn, BROADCAST_SINKS)
+	for i := range sinks {
+		sinks[i], err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer sinks[i].Close()
+
+		go func(sink *net.UDPConn) {
+			buffer := make([]byte, LISTEN_BUFFER_SIZE)
+			for {
+				if _, _, err := sink.ReadFromUDP(buffer); err != nil {
+					return
+				}
+			}
+		}(sinks[i])
+	}
+
+	convs := make([]*conversation, numConversations)
+	for i := range convs {
+		convs[i] = newConversation(node, uint32(i+1), server, sinks[i%len(sinks)].LocalAddr().(*net.UDPAddr))
+	}
+
+	pckt := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      1,
+			PacketNum:   0,
+			SequenceNum: 0,
+			Type:        DATAGRAM,
+			IsFinal:     1,
+		},
+		Body: make([]byte, MAX_PCKT_SIZE),
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		var wg sync.WaitGroup
+		for _, conv := range convs {
+			wg.Add(1)
+			go func(conv *conversation) {
+				defer wg.Done()
+				if err := node.sendUDP(conv.conversation_conn, conv.conversation_addr, &pckt); err != nil {
+					b.Error(err)
+				}
+			}(conv)
+		}
+		wg.Wait()
+	}
+
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*numConversations), "ns/datagram")
+}
@@ -9,7 +9,7 @@
 // // Memory management - once packet is sent, its state is stored in a map
 // // This allows for easy cleanup of the state when the packet is ACKed or NAKed
 
-package main
+package core
 
 // import (
 // 	"fmt"
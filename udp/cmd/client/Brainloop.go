@@ -2,15 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"log"
-	"net"
 	"os"
 	"strconv"
 	"strings"
+
+	"core"
 )
 
-func Startup() {
+// Startup asks for the server's address, the port is optional and IPv6 addresses may be bracketed
+func Startup() string {
 	reader := bufio.NewReader(os.Stdin)
 
 	for true {
@@ -23,21 +25,17 @@ func Startup() {
 		}
 
 		input = strings.TrimSpace(input)
-
-		// Resolve UDP Server Address to contact
-		serverAddr, err = net.ResolveUDPAddr("udp", input+":"+SERVER_PORT_CONST)
-		if err != nil {
-			log.Fatalf("Failed to resolve server address: %v", err)
-			fmt.Print(serverAddr)
-		} else {
-			break
+		if input != "" {
+			return input
 		}
 	}
+
+	return ""
 }
 
-func Brainloop() {
+func Brainloop(node *core.Node) {
 	for true {
-		ReadInput()
+		ReadInput(node)
 	}
 }
 
@@ -45,46 +43,59 @@ func printWelcome() {
 	fmt.Print("\n\n--------------------------------------Welcome--------------------------------------\n") //76
 	fmt.Print("\nWhat would you like to do?\n\nPlease input the number or the name of the command\nHere is a list of commands: \n")
 	//fmt.Print("0 - 'request vote' \n1 - 'number of clients' \n2 - 'ip of clients' \n3 - 'send with loss' \n4 - 'disconnect' \n")
-	fmt.Print("\n0 - 'help'\n1 - 'request vote'\n2 - 'send with duplicates'\n3 - 'send with loss'\n4 - 'set chance of defect'\n5 - 'send hello'\n6 - 'disconnect'\n")
+	fmt.Print("\n0 - 'help'\n1 - 'request vote'\n2 - 'send with duplicates'\n3 - 'send with loss'\n4 - 'set chance of defect'\n5 - 'send hello'\n6 - 'disconnect'\n7 - 'network impairment'\n")
 	fmt.Print("\n-----------------------------------------------------------------------------------\n") //83
 }
 
 // function for reading in the initial strings
-func ReadInput() {
+func ReadInput(node *core.Node) {
 	reader := bufio.NewReader(os.Stdin)
 	printWelcome()
 	input, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading input:", err)
+		cli_log.Error("Error reading input", "err", err)
 		return
 	}
 	// The input from ReadString includes a newline character; we need to trim it
 	input = strings.TrimSpace(input)
-	requestHandler(input)
+	requestHandler(node, input)
 }
 
 // function entered if a vote request is initiated
-func request_vote_initiator() {
+func request_vote_initiator(node *core.Node) {
 	fmt.Print("-----------------------------------------------------------------------------------\n") //83
 	fmt.Print("Please input vote request, 'q' to quit writing: ")
 
 	reader := bufio.NewReader(os.Stdin)
 	input, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Println("Error reading input:", err)
+		cli_log.Error("Error reading input", "err", err)
 		return
 	}
 	input = strings.TrimSpace(input)
 	if input == "q" {
-		ReadInput()
+		ReadInput(node)
 	} else {
 		fmt.Print("-----------------------------------------------------------------------------------\n") //83
 		fmt.Print("You have chosen to start a vote request.\nProcessing...\n")
-		for _, server := range conversations {
-			server.sendVoteRequestToServer(input)
-			break
-		}
+		go wait_for_verdict(node, input)
+	}
+}
+
+// proposes a question and prints the verdict once the server has called it
+func wait_for_verdict(node *core.Node, question string) {
+	ctx, cancel := context.WithTimeout(context.Background(), verdict_timeout)
+	defer cancel()
+
+	verdict, err := node.Propose(ctx, question)
+	if err != nil {
+		cli_log.Warn("No verdict", "vote_id", verdict.VoteID, "question", question, "err", err)
+		return
 	}
+
+	fmt.Print("\n-----------------------------------------------------------------------------------\n") //83
+	fmt.Printf("Verdict for Vote ID: %s, Question: %s.\nResult: %d, ballots: %v of %d participants.\n", verdict.VoteID, question, verdict.Result, verdict.Tallies, verdict.Participants)
+	fmt.Print("-----------------------------------------------------------------------------------\n") //83
 }
 
 // function entered if a request for client number on network is initiated
@@ -109,7 +120,7 @@ func request_client_ips() {
 }
 
 // function for demonstrating defection and consensus
-func request_defect_rate() {
+func request_defect_rate(node *core.Node) {
 	fmt.Print("-----------------------------------------------------------------------------------\n") //83
 	fmt.Print("Please Choose a decimal value between 0-1\n\n")
 
@@ -118,7 +129,7 @@ func request_defect_rate() {
 		reader := bufio.NewReader(os.Stdin)
 		input, err := reader.ReadString('\n')
 		if err != nil {
-			fmt.Println("Error reading input:", err)
+			cli_log.Error("Error reading input", "err", err)
 			return
 		}
 		input = strings.TrimSpace(input)
@@ -134,14 +145,14 @@ func request_defect_rate() {
 	fmt.Print("You have chosen to defect to votes at a rate of: ", val)
 
 	//--------------------------------------------------
-	// change global of send with loss multiplier
+	// change the node's chance of defecting
 	//--------------------------------------------------
 
-	defect_constant = val
+	node.SetDefectChance(val)
 }
 
 // function for demonstrating SR maybe the send with loss function
-func request_change_loss() {
+func request_change_loss(node *core.Node) {
 	fmt.Print("-----------------------------------------------------------------------------------\n") //83
 	fmt.Print("Please Choose a decimal value between 0-1\n\n")
 
@@ -150,7 +161,7 @@ func request_change_loss() {
 		reader := bufio.NewReader(os.Stdin)
 		input, err := reader.ReadString('\n')
 		if err != nil {
-			fmt.Println("Error reading input:", err)
+			cli_log.Error("Error reading input", "err", err)
 			return
 		}
 		input = strings.TrimSpace(input)
@@ -166,14 +177,14 @@ func request_change_loss() {
 	fmt.Print("You have chosen to send packets at a loss rate of: ", val)
 
 	//--------------------------------------------------
-	// change global of send with loss multiplier
+	// change the default impairment's loss
 	//--------------------------------------------------
 
-	loss_constant = val
+	node.SetImpairment("", fmt.Sprintf("loss=%g", val))
 }
 
 // function for demonstrating defection and consensus
-func request_duplicates() {
+func request_duplicates(node *core.Node) {
 	fmt.Print("-----------------------------------------------------------------------------------\n") //83
 	fmt.Print("Please Choose a integer value between 0-255\n\n")
 
@@ -182,7 +193,7 @@ func request_duplicates() {
 		reader := bufio.NewReader(os.Stdin)
 		input, err := reader.ReadString('\n')
 		if err != nil {
-			fmt.Println("Error reading input:", err)
+			cli_log.Error("Error reading input", "err", err)
 			return
 		}
 		input = strings.TrimSpace(input)
@@ -198,19 +209,56 @@ func request_duplicates() {
 	fmt.Print("You have chosen to send packets with a this many duplicates: ", val)
 
 	//--------------------------------------------------
-	// change global of send with loss multiplier
+	// change the default impairment's duplicates
 	//--------------------------------------------------
 
-	duplicates_mode = val
+	node.SetImpairment("", fmt.Sprintf("duplicates=%d", val))
+}
+
+// function for emulating a worse network, towards everyone or one peer
+func request_impairment(node *core.Node) {
+	fmt.Print("-----------------------------------------------------------------------------------\n") //83
+	fmt.Print("Current network impairments:\n", node.Impairments())
+	fmt.Print("\nPlease input the peer (IP or IP:port) to change, or nothing for the default: ")
+
+	reader := bufio.NewReader(os.Stdin)
+	peer, err := reader.ReadString('\n')
+	if err != nil {
+		cli_log.Error("Error reading input", "err", err)
+		return
+	}
+	peer = strings.TrimSpace(peer)
+
+	fmt.Print("Please input the settings to change, 'reset' to drop the peer's profile, e.g.\n")
+	fmt.Print("loss=0.2 loss_in=0 duplicates=0 latency=50ms jitter=10ms reorder=0.1 corrupt=0.01 corrupt_in=0 partition=5s+10s\n\n")
+
+	settings, err := reader.ReadString('\n')
+	if err != nil {
+		cli_log.Error("Error reading input", "err", err)
+		return
+	}
+	settings = strings.TrimSpace(settings)
+
+	if settings == "reset" {
+		node.ResetImpairment(peer)
+		fmt.Print("Network impairments now:\n", node.Impairments())
+		return
+	}
+
+	if err := node.SetImpairment(peer, settings); err != nil {
+		fmt.Println("Couldn't change impairments:", err)
+		return
+	}
+
+	fmt.Print("Network impairments now:\n", node.Impairments())
 }
 
-func request_send_hello() {
+func request_send_hello(node *core.Node) {
 	fmt.Print("-----------------------------------------------------------------------------------\n") //83
 	fmt.Print("Sending Hello...\n")
 
-	for _, server := range conversations {
-		server.sendHello()
-		break
+	if err := node.SendHello(); err != nil {
+		cli_log.Warn("Couldn't send hello", "err", err)
 	}
 }
 
@@ -218,14 +266,14 @@ func request_disconnect() {
 	fmt.Print("-----------------------------------------------------------------------------------\n") //83
 	fmt.Print("You have chosen to disconnect from the server.\n")
 
-	//--------------------------------------------------
-	// Send a message to disconnect client from server
-	//--------------------------------------------------
-	os.Exit(0)
+	// Shuts down like a SIGINT would, the server gets told and main exits
+	disconnect()
+	select {}
 }
 
 // handler of inputs following initial input
-func requestHandler(input string) {
+func requestHandler(node *core.Node, input string) {
+	cli_log.Debug("Command chosen", "input", input)
 
 	switch input {
 
@@ -233,7 +281,7 @@ func requestHandler(input string) {
 		printWelcome()
 
 	case "1", "request vote":
-		request_vote_initiator()
+		request_vote_initiator(node)
 
 	// case "1", "number of clients":
 	// 	request_client_number()
@@ -242,19 +290,25 @@ func requestHandler(input string) {
 	// 	request_client_ips()
 
 	case "2", "send with duplicates":
-		request_duplicates()
+		request_duplicates(node)
 
 	case "3", "set loss constant":
-		request_change_loss()
+		request_change_loss(node)
 
 	case "4", "set chance of defect":
-		request_defect_rate()
+		request_defect_rate(node)
 
 	case "5", "send hello":
-		request_send_hello()
+		request_send_hello(node)
 
 	case "6", "disconnect":
 		request_disconnect()
+
+	case "7", "network impairment":
+		request_impairment(node)
+
+	default:
+		cli_log.Debug("Unknown command", "input", input)
 	}
 
 }
@@ -0,0 +1,113 @@
+// Boot up sequence for a client type node
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"core"
+)
+
+// Exit codes
+const (
+	EXIT_OK       = 0 // Shut down cleanly
+	EXIT_ERROR    = 1 // Bad configuration or couldn't start
+	EXIT_USAGE    = 2 // Bad flags (the flag package's own code)
+	EXIT_DEADLINE = 3 // Shutdown ran out of time with data left unacked
+)
+
+// How long the CLI waits for the verdict on a vote it proposed
+var verdict_timeout time.Duration
+
+// The node's cli subsystem logger
+var cli_log *slog.Logger
+
+// Starts the graceful shutdown, for the disconnect command
+var disconnect context.CancelFunc
+
+func main() {
+	defaults := core.DefaultSettings()
+	defaults.Vote.DefectChance = 0.1 // 0.0-1.0 (0-100%) chance of defecting to a vote
+	defaults.Impairment = "loss=0.4" // Emulated network, 40% of packets sent get lost (see impair.go for latency, reordering, corruption and partitions)
+
+	// Settings from -config, CONSENSUS_* environment variables and flags (./client -h lists them)
+	command, err := core.ParseCommandLine("client", defaults, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	if command.PrintConfig {
+		if err := command.Settings.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Ask for the server if it wasn't configured
+	if command.Settings.Server == "" {
+		command.Settings.Server = Startup()
+	}
+	verdict_timeout = time.Duration(command.Settings.Vote.VerdictTimeout)
+
+	node, err := core.NewClient(command.Settings)
+	if err != nil {
+		log.Printf("Failed to set up client: %v", err)
+		os.Exit(EXIT_ERROR)
+	}
+	cli_log = node.Logger(core.LOG_CLI)
+
+	// SIGINT, SIGTERM or the disconnect command shuts down gracefully, a second signal kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	disconnect = stop
+
+	// Connect, then hand over to the CLI
+	go func() {
+		if err := node.Connect(); err != nil {
+			return
+		}
+		Brainloop(node)
+	}()
+
+	// Handle packets until the node is closed
+	running := make(chan struct{})
+	go func() {
+		node.Run()
+		close(running)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-running:
+		os.Exit(EXIT_ERROR)
+	}
+	stop()
+
+	os.Exit(shutdown(node, time.Duration(command.Settings.ShutdownTimeout)))
+}
+
+// shutdown stops the node gracefully within timeout, returns the exit code
+func shutdown(node *core.Node, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := node.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return EXIT_DEADLINE
+		}
+		return EXIT_ERROR
+	}
+	return EXIT_OK
+}
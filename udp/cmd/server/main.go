@@ -0,0 +1,93 @@
+// Boot up sequence for a server type node
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"core"
+)
+
+// Exit codes
+const (
+	EXIT_OK       = 0 // Shut down cleanly
+	EXIT_ERROR    = 1 // Bad configuration, couldn't start, or couldn't save state
+	EXIT_USAGE    = 2 // Bad flags (the flag package's own code)
+	EXIT_DEADLINE = 3 // Shutdown ran out of time with referendums or data left
+)
+
+func main() {
+	defaults := core.DefaultSettings()
+	defaults.Log.Level = "debug"     // Log everything
+	defaults.Impairment = "loss=0.4" // Emulated network, 40% of packets sent get lost (see impair.go for latency, reordering, corruption and partitions)
+
+	// Settings from -config, CONSENSUS_* environment variables and flags (./server -h lists them)
+	command, err := core.ParseCommandLine("server", defaults, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	// Addresses to listen at can also be listed after the flags (e.g. ./server 192.168.1.10 [::1]:9000),
+	// every IPv4 and IPv6 interface otherwise
+	if len(command.Args) > 0 {
+		command.Settings.Listen = command.Args
+	}
+
+	if command.PrintConfig {
+		if err := command.Settings.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	node, err := core.NewServer(command.Settings)
+	if err != nil {
+		log.Print(err)
+		os.Exit(EXIT_ERROR)
+	}
+
+	// SIGINT or SIGTERM shuts down gracefully, a second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Handle packets until the node is closed
+	running := make(chan struct{})
+	go func() {
+		node.Run()
+		close(running)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-running:
+		os.Exit(EXIT_ERROR) // Nothing to listen on
+	}
+	stop()
+
+	os.Exit(shutdown(node, time.Duration(command.Settings.ShutdownTimeout)))
+}
+
+// shutdown stops the node gracefully within timeout, returns the exit code
+func shutdown(node *core.Node, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := node.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return EXIT_DEADLINE
+		}
+		return EXIT_ERROR
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,437 @@
+// Node configuration, from a JSON file, CONSENSUS_* environment variables and command line flags
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings start from the command's defaults, then a JSON config file (given with -config or CONSENSUS_CONFIG)
+// overrides whatever it mentions, then environment variables override that (every flag has one, e.g.
+// -initial-rto is CONSENSUS_INITIAL_RTO), and flags given on the command line have the last word. The result
+// is validated before any node is created, and -print-config prints it in its effective form, as a config file
+// that would give the same settings.
+
+const ENV_PREFIX = "CONSENSUS_"
+
+// A time.Duration written as "20ms" or "1.5s" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		return fmt.Errorf("durations are strings like \"20ms\": %v", err)
+	}
+
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// What a node is set up with
+type Settings struct {
+	Port       string   `json:"port"`        // Port used for any address given without one
+	Listen     []string `json:"listen"`      // Addresses a server listens at, IPv4 or IPv6, with or without a port
+	Server     string   `json:"server"`      // Server a client connects to, asked for on startup if empty
+	TicketPath string   `json:"ticket_path"` // Where a client keeps its Resumption Ticket between restarts
+
+	Log LogSettings `json:"log"`
+
+	Transport TransportSettings `json:"transport"`
+
+	// Emulated network conditions towards every peer, e.g. "loss=0.4 latency=50ms" (see applyImpairment)
+	Impairment string `json:"impairment"`
+
+	Vote VoteSettings `json:"vote"`
+
+	// Where a server keeps its secret, handed out Conversation IDs and bans across restarts, empty for nowhere
+	StatePath string `json:"state_path"`
+
+	// How long a graceful shutdown waits for referendums to be decided and data to be Acked
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// Address to serve Prometheus metrics at (e.g. "127.0.0.1:9090" for /metrics), empty for none
+	MetricsAddr string `json:"metrics_addr"`
+
+	// Address to serve the admin API at (e.g. "127.0.0.1:9091"), empty for none, keep it on loopback unless
+	// AdminToken is set
+	AdminAddr string `json:"admin_addr"`
+
+	// Bearer token every admin API and dashboard request has to carry, empty for none
+	AdminToken string `json:"admin_token"`
+
+	// Address to serve the live dashboard at (e.g. "127.0.0.1:9092"), empty for none, keep it on loopback
+	// unless AdminToken is set (open the page with ?token=...)
+	DashboardAddr string `json:"dashboard_addr"`
+}
+
+// Sockets, windows and timers
+type TransportSettings struct {
+	BatchIO          bool     `json:"batch_io"`           // Batch socket reads and writes (recvmmsg/sendmmsg), false for one datagram per syscall
+	FECGroupSize     uint16   `json:"fec_group_size"`     // 0 turns off Forward Error Correction, otherwise one parity packet per this many DATA packets
+	PacingRate       float64  `json:"pacing_rate"`        // 0 paces each conversation by its congestion window and RTT, otherwise packets per second
+	NodePacingRate   float64  `json:"node_pacing_rate"`   // 0 for no limit, otherwise packets per second for the whole node
+	WindowSize       uint32   `json:"window_size"`        // Selective Repeat window, in packets
+	InitialCwnd      float64  `json:"initial_cwnd"`       // Congestion window (in packets) to start with
+	LoopInterval     Duration `json:"loop_interval"`      // How often a conversation loops when it has nothing paced to send
+	InitialRTO       Duration `json:"initial_rto"`        // Retransmission timeout before any RTT has been measured
+	MinRTO           Duration `json:"min_rto"`            // Smallest retransmission timeout
+	MaxRTO           Duration `json:"max_rto"`            // Largest, kept low, a vote shouldn't stall for long behind one lost packet
+	KeepaliveAfter   Duration `json:"keepalive_after"`    // Silence before a conversation starts sending SYNs
+	OfflineAfterSYNs uint64   `json:"offline_after_syns"` // Unanswered SYNs before a server takes a conversation to be offline
+	PingInterval     Duration `json:"ping_interval"`      // How often a client pings (and SYNs) its server while connecting
+}
+
+// Logging levels (debug, info, warn or error) and format, see logging.go
+type LogSettings struct {
+	Format    string    `json:"format"`    // "text" or "json"
+	Level     string    `json:"level"`     // For every subsystem not given its own
+	Transport string    `json:"transport"` // Sockets, conversations and retransmissions, Level if empty
+	Vote      string    `json:"vote"`      // Referendums, Level if empty
+	CLI       string    `json:"cli"`       // The client's command line, Level if empty
+	Output    io.Writer `json:"-"`         // Where records go, standard error if nil
+}
+
+// Referendums
+type VoteSettings struct {
+	DefectChance   float64  `json:"defect_chance"`   // 0.0-1.0 (0-100%) chance of defecting to a vote
+	VerdictTimeout Duration `json:"verdict_timeout"` // How long a proposer waits for a verdict
+	Deadline       Duration `json:"deadline"`        // How long a server keeps a referendum open, unless its proposer asks otherwise
+	MaxDeadline    Duration `json:"max_deadline"`    // The longest deadline a proposer may ask for, longer requests are refused
+	TimeoutPolicy  string   `json:"timeout_policy"`  // How a referendum still open at its deadline is closed, "plurality" or "timeout"
+}
+
+// DefaultSettings returns the settings the commands start from
+func DefaultSettings() Settings {
+	return Settings{
+		Port:       SERVER_PORT_CONST,
+		Listen:     []string{"0.0.0.0", "::"},
+		TicketPath: ".session_ticket",
+		Log: LogSettings{
+			Format: "text",
+			Level:  "info",
+		},
+		Transport: TransportSettings{
+			BatchIO:          true,
+			FECGroupSize:     0, // Off unless asked for, parity costs bandwidth on paths that don't lose much
+			PacingRate:       0,
+			NodePacingRate:   2000,
+			WindowSize:       5,
+			InitialCwnd:      INITIAL_CWND,
+			LoopInterval:     Duration(LOOP_INTERVAL),
+			InitialRTO:       Duration(INITIAL_RTO),
+			MinRTO:           Duration(MIN_RTO),
+			MaxRTO:           Duration(MAX_RTO),
+			KeepaliveAfter:   Duration(5000 * time.Millisecond),
+			OfflineAfterSYNs: 100,
+			PingInterval:     Duration(time.Second),
+		},
+		Impairment: "",
+		Vote: VoteSettings{
+			DefectChance:   0,
+			VerdictTimeout: Duration(time.Minute),
+			Deadline:       Duration(30 * time.Second),
+			MaxDeadline:    Duration(5 * time.Minute),
+			TimeoutPolicy:  TIMEOUT_POLICY_PLURALITY,
+		},
+		ShutdownTimeout: Duration(10 * time.Second),
+	}
+}
+
+// Validate checks every setting makes sense, listing everything that doesn't
+func (settings Settings) Validate() error {
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(settings.Port); err != nil || port < 1 || port > 65535 {
+		problem("port: %q isn't a port number", settings.Port)
+	}
+	for _, listen_addr := range settings.Listen {
+		if _, err := net.ResolveUDPAddr("udp", withDefaultPort(listen_addr, settings.Port)); err != nil {
+			problem("listen: %v", err)
+		}
+	}
+	if settings.TicketPath == "" {
+		problem("ticket_path: can't be empty")
+	}
+
+	if !strings.EqualFold(settings.Log.Format, "text") && !strings.EqualFold(settings.Log.Format, "json") {
+		problem("log.format: %q isn't text or json", settings.Log.Format)
+	}
+	if _, err := parseLogLevel(settings.Log.Level); err != nil {
+		problem("log.level: %v", err)
+	}
+	for _, subsystem := range log_subsystems {
+		if level := settings.Log.levelFor(subsystem); level != settings.Log.Level {
+			if _, err := parseLogLevel(level); err != nil {
+				problem("log.%s: %v", subsystem, err)
+			}
+		}
+	}
+
+	transport := settings.Transport
+	if transport.PacingRate < 0 {
+		problem("transport.pacing_rate: can't be negative")
+	}
+	if transport.NodePacingRate < 0 {
+		problem("transport.node_pacing_rate: can't be negative")
+	}
+	if transport.WindowSize < 1 {
+		problem("transport.window_size: has to be at least 1")
+	}
+	if transport.InitialCwnd < 1 || transport.InitialCwnd > float64(transport.WindowSize) {
+		problem("transport.initial_cwnd: has to be between 1 and window_size")
+	}
+	if transport.LoopInterval <= 0 || transport.InitialRTO <= 0 || transport.MinRTO <= 0 || transport.KeepaliveAfter <= 0 || transport.PingInterval <= 0 {
+		problem("transport: timers have to be positive")
+	}
+	if transport.MinRTO > transport.MaxRTO {
+		problem("transport.min_rto: can't be more than max_rto")
+	}
+	if transport.OfflineAfterSYNs < 1 {
+		problem("transport.offline_after_syns: has to be at least 1")
+	}
+
+	if err := applyImpairment(&impairment_profile{}, settings.Impairment, time.Now()); err != nil {
+		problem("impairment: %v", err)
+	}
+
+	if settings.Vote.DefectChance < 0 || settings.Vote.DefectChance > 1 {
+		problem("vote.defect_chance: %g isn't between 0 and 1", settings.Vote.DefectChance)
+	}
+	if settings.Vote.VerdictTimeout <= 0 {
+		problem("vote.verdict_timeout: has to be positive")
+	}
+	if settings.Vote.Deadline <= 0 {
+		problem("vote.deadline: has to be positive")
+	}
+	if settings.Vote.MaxDeadline < settings.Vote.Deadline {
+		problem("vote.max_deadline: can't be less than deadline")
+	}
+	if settings.Vote.TimeoutPolicy != TIMEOUT_POLICY_PLURALITY && settings.Vote.TimeoutPolicy != TIMEOUT_POLICY_TIMEOUT {
+		problem("vote.timeout_policy: %q isn't plurality or timeout", settings.Vote.TimeoutPolicy)
+	}
+
+	if settings.ShutdownTimeout <= 0 {
+		problem("shutdown_timeout: has to be positive")
+	}
+
+	if settings.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(settings.MetricsAddr); err != nil {
+			problem("metrics_addr: %v", err)
+		}
+	}
+	if settings.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(settings.AdminAddr); err != nil {
+			problem("admin_addr: %v", err)
+		}
+	}
+	if settings.DashboardAddr != "" {
+		if _, _, err := net.SplitHostPort(settings.DashboardAddr); err != nil {
+			problem("dashboard_addr: %v", err)
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// Print writes the settings out as a config file, with the admin token redacted
+func (settings Settings) Print(out io.Writer) error {
+	if settings.AdminToken != "" {
+		settings.AdminToken = "<set>"
+	}
+
+	raw, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%s\n", raw)
+	return err
+}
+
+// loadSettingsFile overrides settings with whatever a config file mentions
+func loadSettingsFile(path string, settings *Settings) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// A list flag, given comma separated
+type string_list struct {
+	list *[]string
+}
+
+func (value string_list) String() string {
+	if value.list == nil {
+		return ""
+	}
+	return strings.Join(*value.list, ",")
+}
+
+func (value string_list) Set(text string) error {
+	*value.list = strings.Split(text, ",")
+	return nil
+}
+
+// A flag for the smaller unsigned integers
+type uint_flag[T uint16 | uint32] struct {
+	value *T
+	bits  int
+}
+
+func (value uint_flag[T]) String() string {
+	if value.value == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*value.value), 10)
+}
+
+func (value uint_flag[T]) Set(text string) error {
+	parsed, err := strconv.ParseUint(text, 10, value.bits)
+	if err != nil {
+		return err
+	}
+	*value.value = T(parsed)
+	return nil
+}
+
+// bindFlags defines a flag for every setting, defaulting to its current value
+func (settings *Settings) bindFlags(flags *flag.FlagSet) {
+	flags.StringVar(&settings.Port, "port", settings.Port, "port used for any address given without one")
+	flags.Var(string_list{&settings.Listen}, "listen", "comma separated addresses a server listens at")
+	flags.StringVar(&settings.Server, "server", settings.Server, "server a client connects to, asked for on startup if empty")
+	flags.StringVar(&settings.TicketPath, "ticket-path", settings.TicketPath, "where a client keeps its resumption ticket")
+
+	flags.StringVar(&settings.Log.Format, "log-format", settings.Log.Format, "log as text or json")
+	flags.StringVar(&settings.Log.Level, "log-level", settings.Log.Level, "log level (debug, info, warn or error) for every subsystem not given its own")
+	flags.StringVar(&settings.Log.Transport, "log-transport", settings.Log.Transport, "log level for sockets, conversations and retransmissions")
+	flags.StringVar(&settings.Log.Vote, "log-vote", settings.Log.Vote, "log level for referendums")
+	flags.StringVar(&settings.Log.CLI, "log-cli", settings.Log.CLI, "log level for the client's command line")
+
+	transport := &settings.Transport
+	flags.BoolVar(&transport.BatchIO, "batch-io", transport.BatchIO, "batch socket reads and writes")
+	flags.Var(uint_flag[uint16]{&transport.FECGroupSize, 16}, "fec-group-size", "DATA packets per parity packet, 0 turns FEC off")
+	flags.Float64Var(&transport.PacingRate, "pacing-rate", transport.PacingRate, "DATA packets per second per conversation, 0 paces by congestion window and RTT")
+	flags.Float64Var(&transport.NodePacingRate, "node-pacing-rate", transport.NodePacingRate, "DATA packets per second for the whole node, 0 for no limit")
+	flags.Var(uint_flag[uint32]{&transport.WindowSize, 32}, "window-size", "Selective Repeat window, in packets")
+	flags.Float64Var(&transport.InitialCwnd, "initial-cwnd", transport.InitialCwnd, "congestion window to start with, in packets")
+	flags.DurationVar((*time.Duration)(&transport.LoopInterval), "loop-interval", time.Duration(transport.LoopInterval), "how often an idle conversation loops")
+	flags.DurationVar((*time.Duration)(&transport.InitialRTO), "initial-rto", time.Duration(transport.InitialRTO), "retransmission timeout before any RTT is measured")
+	flags.DurationVar((*time.Duration)(&transport.MinRTO), "min-rto", time.Duration(transport.MinRTO), "smallest retransmission timeout")
+	flags.DurationVar((*time.Duration)(&transport.MaxRTO), "max-rto", time.Duration(transport.MaxRTO), "largest retransmission timeout")
+	flags.DurationVar((*time.Duration)(&transport.KeepaliveAfter), "keepalive-after", time.Duration(transport.KeepaliveAfter), "silence before a conversation sends SYNs")
+	flags.Uint64Var(&transport.OfflineAfterSYNs, "offline-after-syns", transport.OfflineAfterSYNs, "unanswered SYNs before a conversation is offline")
+	flags.DurationVar((*time.Duration)(&transport.PingInterval), "ping-interval", time.Duration(transport.PingInterval), "how often a connecting client pings its server")
+
+	flags.StringVar(&settings.Impairment, "impairment", settings.Impairment, "emulated network towards every peer, e.g. \"loss=0.4 latency=50ms\"")
+
+	flags.Float64Var(&settings.Vote.DefectChance, "defect-chance", settings.Vote.DefectChance, "chance (0-1) of defecting to a vote")
+	flags.DurationVar((*time.Duration)(&settings.Vote.VerdictTimeout), "verdict-timeout", time.Duration(settings.Vote.VerdictTimeout), "how long a proposer waits for a verdict")
+	flags.DurationVar((*time.Duration)(&settings.Vote.Deadline), "vote-deadline", time.Duration(settings.Vote.Deadline), "how long a server keeps a referendum open, unless its proposer asks otherwise")
+	flags.DurationVar((*time.Duration)(&settings.Vote.MaxDeadline), "max-vote-deadline", time.Duration(settings.Vote.MaxDeadline), "the longest deadline a proposer may ask for, longer requests are refused")
+	flags.StringVar(&settings.Vote.TimeoutPolicy, "timeout-policy", settings.Vote.TimeoutPolicy, "how a referendum still open at its deadline is closed, plurality of the ballots cast or timeout")
+
+	flags.StringVar(&settings.StatePath, "state-path", settings.StatePath, "where a server keeps its secret, handed out IDs and bans across restarts")
+	flags.DurationVar((*time.Duration)(&settings.ShutdownTimeout), "shutdown-timeout", time.Duration(settings.ShutdownTimeout), "how long a graceful shutdown waits for referendums and unacked data")
+
+	flags.StringVar(&settings.MetricsAddr, "metrics-addr", settings.MetricsAddr, "address to serve Prometheus /metrics at, e.g. 127.0.0.1:9090")
+	flags.StringVar(&settings.AdminAddr, "admin-addr", settings.AdminAddr, "address to serve the admin API at, e.g. 127.0.0.1:9091 (keep it on loopback unless -admin-token is set)")
+	flags.StringVar(&settings.AdminToken, "admin-token", settings.AdminToken, "bearer token the admin API and dashboard require, empty for none (CONSENSUS_ADMIN_TOKEN keeps it out of ps)")
+	flags.StringVar(&settings.DashboardAddr, "dashboard-addr", settings.DashboardAddr, "address to serve the live dashboard at, e.g. 127.0.0.1:9092 (keep it on loopback unless -admin-token is set)")
+}
+
+// envName is the environment variable overriding a flag
+func envName(flag_name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flag_name, "-", "_"))
+}
+
+// A command's parsed command line
+type CommandLine struct {
+	Settings    Settings
+	Args        []string // Arguments left after the flags
+	PrintConfig bool     // -print-config was given
+}
+
+// ParseCommandLine works out a command's settings from its defaults, config file, environment and flags, and validates them
+func ParseCommandLine(command string, defaults Settings, args []string) (*CommandLine, error) {
+	var configPath string
+	var printConfig bool
+
+	// First pass, finds the config file and which flags were given (against the defaults, so -h shows them)
+	given := flag.NewFlagSet(command, flag.ContinueOnError)
+	scratch := defaults
+	scratch.bindFlags(given)
+	given.StringVar(&configPath, "config", os.Getenv(envName("config")), "JSON config file")
+	given.BoolVar(&printConfig, "print-config", false, "print the effective config and exit")
+	if err := given.Parse(args); err != nil {
+		return nil, err
+	}
+
+	settings := defaults
+	settings.Listen = append([]string(nil), defaults.Listen...)
+
+	if configPath != "" {
+		if err := loadSettingsFile(configPath, &settings); err != nil {
+			return nil, err
+		}
+	}
+
+	// The environment, then the flags, are applied through a second set bound to the real settings
+	final := flag.NewFlagSet(command, flag.ContinueOnError)
+	settings.bindFlags(final)
+
+	var err error
+	final.VisitAll(func(f *flag.Flag) {
+		if value, exists := os.LookupEnv(envName(f.Name)); exists && err == nil {
+			if setErr := final.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	given.Visit(func(f *flag.Flag) {
+		if final.Lookup(f.Name) != nil && err == nil {
+			err = final.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &CommandLine{Settings: settings, Args: given.Args(), PrintConfig: printConfig}, nil
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file into the test's directory
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Defaults, then the config file, then the environment, then flags, each only overriding what it mentions
+func TestParseCommandLine(t *testing.T) {
+	path := writeConfig(t, `{
+		"port": "7001",
+		"ticket_path": "from-file",
+		"log": {"level": "warn"},
+		"transport": {"window_size": 20, "initial_rto": "300ms"},
+		"vote": {"deadline": "10s"}
+	}`)
+
+	t.Setenv(envName("config"), path)
+	t.Setenv(envName("ticket-path"), "from-env")
+	t.Setenv(envName("window-size"), "30")
+	t.Setenv(envName("listen"), "127.0.0.1,::1")
+
+	command, err := ParseCommandLine("test", DefaultSettings(), []string{"-window-size", "40", "-log-level", "debug", "first", "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := command.Settings
+
+	for _, test := range []struct {
+		name      string
+		got, want any
+	}{
+		{"default", settings.Log.Format, "text"},
+		{"default", settings.Vote.MaxDeadline, Duration(5 * time.Minute)},
+		{"file", settings.Port, "7001"},
+		{"file", settings.Transport.InitialRTO, Duration(300 * time.Millisecond)},
+		{"file", settings.Vote.Deadline, Duration(10 * time.Second)},
+		{"environment over file", settings.TicketPath, "from-env"},
+		{"environment over default", strings.Join(settings.Listen, ","), "127.0.0.1,::1"},
+		{"flag over environment", settings.Transport.WindowSize, uint32(40)},
+		{"flag over file", settings.Log.Level, "debug"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+
+	if strings.Join(command.Args, " ") != "first second" {
+		t.Errorf("args left are %q", command.Args)
+	}
+	if command.PrintConfig {
+		t.Error("-print-config set without being given")
+	}
+
+	// -config beats CONSENSUS_CONFIG
+	other := writeConfig(t, `{"port": "7002"}`)
+	command, err = ParseCommandLine("test", DefaultSettings(), []string{"-config", other, "-print-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command.Settings.Port != "7002" || command.Settings.Transport.WindowSize != 30 || !command.PrintConfig {
+		t.Errorf("got port %s, window %d, print %v", command.Settings.Port, command.Settings.Transport.WindowSize, command.PrintConfig)
+	}
+
+	// What's printed reads back as the same settings
+	var printed strings.Builder
+	if err := command.Settings.Print(&printed); err != nil {
+		t.Fatal(err)
+	}
+	reread := DefaultSettings()
+	if err := loadSettingsFile(writeConfig(t, printed.String()), &reread); err != nil {
+		t.Fatal(err)
+	}
+	var again strings.Builder
+	reread.Print(&again)
+	if again.String() != printed.String() {
+		t.Errorf("printed config reads back differently:\n%s\nvs\n%s", printed.String(), again.String())
+	}
+
+	// The admin token never comes out, only whether there is one
+	for _, token := range []string{"", "secret"} {
+		settings := DefaultSettings()
+		settings.AdminToken = token
+
+		var out strings.Builder
+		if err := settings.Print(&out); err != nil {
+			t.Fatal(err)
+		}
+		printed := DefaultSettings()
+		if err := loadSettingsFile(writeConfig(t, out.String()), &printed); err != nil {
+			t.Fatal(err)
+		}
+		if token != "" && (strings.Contains(out.String(), token) || printed.AdminToken != "<set>") {
+			t.Errorf("admin token printed as %q", printed.AdminToken)
+		}
+		if token == "" && printed.AdminToken != "" {
+			t.Errorf("no admin token printed as %q", printed.AdminToken)
+		}
+		if settings.AdminToken != token {
+			t.Errorf("printing changed the admin token to %q", settings.AdminToken)
+		}
+	}
+
+	// The defaults passed in are left alone
+	defaults := DefaultSettings()
+	if _, err := ParseCommandLine("test", defaults, []string{"-listen", "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(defaults.Listen, ",") != "0.0.0.0,::" {
+		t.Errorf("defaults changed to %q", defaults.Listen)
+	}
+}
+
+// Mistakes in any layer are reported, naming where they came from
+func TestParseCommandLineErrors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		env    map[string]string
+		args   []string
+		want   string
+	}{
+		{name: "unknown flag", args: []string{"-bogus"}, want: "bogus"},
+		{name: "bad flag", args: []string{"-window-size", "big"}, want: "window-size"},
+		{name: "unknown field", config: `{"prot": "7001"}`, want: "prot"},
+		{name: "bad duration in file", config: `{"transport": {"min_rto": 20}}`, want: "durations are strings"},
+		{name: "bad environment", env: map[string]string{"CONSENSUS_INITIAL_RTO": "soon"}, want: "CONSENSUS_INITIAL_RTO"},
+		{name: "invalid result", env: map[string]string{"CONSENSUS_PORT": "0"}, want: "port"},
+		{name: "missing file", args: []string{"-config", filepath.Join(t.TempDir(), "missing.json")}, want: "missing.json"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			args := test.args
+			if test.config != "" {
+				args = append([]string{"-config", writeConfig(t, test.config)}, args...)
+			}
+
+			_, err := ParseCommandLine("test", DefaultSettings(), args)
+			if err == nil {
+				t.Fatal("accepted")
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error %q doesn't mention %q", err, test.want)
+			}
+		})
+	}
+}
+
+// The defaults are valid, and every broken setting is reported by its config file name
+func TestValidate(t *testing.T) {
+	if err := DefaultSettings().Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+
+	for _, test := range []struct {
+		want    string
+		mistake func(*Settings)
+	}{
+		{"port", func(s *Settings) { s.Port = "65536" }},
+		{"listen", func(s *Settings) { s.Listen = []string{"not an address"} }},
+		{"ticket_path", func(s *Settings) { s.TicketPath = "" }},
+		{"log.format", func(s *Settings) { s.Log.Format = "xml" }},
+		{"log.level", func(s *Settings) { s.Log.Level = "loud" }},
+		{"log.vote", func(s *Settings) { s.Log.Vote = "loud" }},
+		{"transport.pacing_rate", func(s *Settings) { s.Transport.PacingRate = -1 }},
+		{"transport.node_pacing_rate", func(s *Settings) { s.Transport.NodePacingRate = -1 }},
+		{"transport.window_size", func(s *Settings) { s.Transport.WindowSize = 0 }},
+		{"transport.initial_cwnd", func(s *Settings) { s.Transport.InitialCwnd = float64(s.Transport.WindowSize) + 1 }},
+		{"transport: timers", func(s *Settings) { s.Transport.PingInterval = 0 }},
+		{"transport.min_rto", func(s *Settings) { s.Transport.MinRTO = s.Transport.MaxRTO + 1 }},
+		{"transport.offline_after_syns", func(s *Settings) { s.Transport.OfflineAfterSYNs = 0 }},
+		{"impairment", func(s *Settings) { s.Impairment = "loss=2" }},
+		{"vote.defect_chance", func(s *Settings) { s.Vote.DefectChance = 1.5 }},
+		{"vote.verdict_timeout", func(s *Settings) { s.Vote.VerdictTimeout = 0 }},
+		{"vote.deadline", func(s *Settings) { s.Vote.Deadline = -1 }},
+		{"vote.max_deadline", func(s *Settings) { s.Vote.MaxDeadline = s.Vote.Deadline - 1 }},
+		{"vote.timeout_policy", func(s *Settings) { s.Vote.TimeoutPolicy = "coin" }},
+		{"shutdown_timeout", func(s *Settings) { s.ShutdownTimeout = 0 }},
+		{"metrics_addr", func(s *Settings) { s.MetricsAddr = "9090" }},
+		{"admin_addr", func(s *Settings) { s.AdminAddr = "localhost" }},
+		{"dashboard_addr", func(s *Settings) { s.DashboardAddr = "::1" }},
+	} {
+		settings := DefaultSettings()
+		test.mistake(&settings)
+
+		err := settings.Validate()
+		if err == nil {
+			t.Errorf("%s: accepted", test.want)
+		} else if !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("%s: got %q", test.want, err)
+		}
+	}
+
+	// Everything wrong is listed, not just the first
+	settings := DefaultSettings()
+	settings.Port = "port"
+	settings.Vote.TimeoutPolicy = ""
+	err := settings.Validate()
+	if err == nil || !strings.Contains(err.Error(), "port:") || !strings.Contains(err.Error(), "vote.timeout_policy:") {
+		t.Errorf("got %v", err)
+	}
+}
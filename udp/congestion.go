@@ -0,0 +1,210 @@
+// Congestion control and pacing for the Selective Repeat sender
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Each conversation keeps a smoothed RTT (RFC 6298) from the ACKs it gets back, and a congestion window
+// that grows with every ACK and halves on loss. DATA packets are then paced out at roughly one congestion
+// window per RTT (or at pacing_rate if set), instead of in a burst every loop, and node_pacing_rate caps
+// the whole node so a broadcast to every conversation doesn't overflow the socket buffers either.
+
+// Defaults for TransportSettings
+const (
+	LOOP_INTERVAL = 20 * time.Millisecond   // How often a conversation loops when it has nothing paced to send
+	INITIAL_RTO   = 1000 * time.Millisecond // Retransmission timeout before any RTT has been measured
+	MIN_RTO       = 200 * time.Millisecond
+	MAX_RTO       = 2000 * time.Millisecond // Kept low, a vote shouldn't stall for long behind one lost packet
+	INITIAL_CWND  = 2                       // Congestion window (in packets) to start with
+)
+
+const (
+	PACING_GAIN     = 1.25 // Pace a little faster than cwnd/RTT so the window can actually fill
+	PACING_BURST    = 2    // Packets that can go out back to back
+	MIN_PACING_WAIT = time.Millisecond
+)
+
+// Token bucket, refilled at whatever rate it is asked for
+type pacer struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// refill adds tokens for the time since the last refill (the caller must hold the lock)
+func (p *pacer) refill(rate float64, now time.Time) {
+	if p.last.IsZero() {
+		p.tokens = PACING_BURST
+	} else {
+		p.tokens += now.Sub(p.last).Seconds() * rate
+		if p.tokens > PACING_BURST {
+			p.tokens = PACING_BURST
+		}
+	}
+	p.last = now
+}
+
+// ready reports whether a packet can go out now at rate packets per second, and if not, how long until one can
+func (p *pacer) ready(rate float64, now time.Time) (bool, time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.refill(rate, now)
+	if p.tokens >= 1 {
+		return true, 0
+	}
+
+	return false, time.Duration((1 - p.tokens) / rate * float64(time.Second))
+}
+
+// take uses up a token once a packet has gone out
+func (p *pacer) take() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.tokens -= 1
+}
+
+// pacingRate returns how many DATA packets per second this conversation may send, 0 if it isn't paced yet
+func (conv *conversation) pacingRate() float64 {
+	if conv.node.pacing_rate > 0 {
+		return conv.node.pacing_rate
+	}
+
+	// Nothing to pace by until the first RTT sample
+	if conv.sender.srtt == 0 {
+		return 0
+	}
+
+	return PACING_GAIN * conv.sender.cwnd / conv.sender.srtt.Seconds()
+}
+
+// canSendPaced checks both this conversation's and the node's pacer, when the answer is no it also
+// remembers how long the wait is so the loop can wake up in time (the caller must hold the outgoing lock)
+func (conv *conversation) canSendPaced() bool {
+	if rate := conv.pacingRate(); rate > 0 {
+		if ok, wait := conv.sender.pacer.ready(rate, conv.node.now()); !ok {
+			conv.sender.pacingWait = wait
+			return false
+		}
+	}
+
+	if conv.node.node_pacing_rate > 0 {
+		if ok, wait := conv.node.node_pacer.ready(conv.node.node_pacing_rate, conv.node.now()); !ok {
+			conv.sender.pacingWait = wait
+			return false
+		}
+	}
+
+	return true
+}
+
+// sendPaced sends a DATA packet and uses up the pacing tokens for it (the caller must hold the outgoing lock)
+func (conv *conversation) sendPaced(pckt *Pckt) error {
+	if conv.pacingRate() > 0 {
+		conv.sender.pacer.take()
+	}
+	if conv.node.node_pacing_rate > 0 {
+		conv.node.node_pacer.take()
+	}
+
+	return conv.sendPacket(pckt)
+}
+
+// effectiveWindow is how many packets may be in flight, the smaller of the congestion and Selective Repeat windows
+func (conv *conversation) effectiveWindow() uint32 {
+	if conv.sender.cwnd < float64(conv.sender.windowSize) {
+		return uint32(conv.sender.cwnd)
+	}
+	return conv.sender.windowSize
+}
+
+// loopDelay returns how long the conversation loop should sleep, shorter than usual if a paced packet is waiting
+func (conv *conversation) loopDelay() time.Duration {
+	conv.sender.outgoing_lock.Lock()
+	defer conv.sender.outgoing_lock.Unlock()
+
+	wait := conv.sender.pacingWait
+	conv.sender.pacingWait = 0
+
+	if wait == 0 || wait > conv.node.loop_interval {
+		return conv.node.loop_interval
+	}
+	if wait < MIN_PACING_WAIT {
+		return MIN_PACING_WAIT
+	}
+	return wait
+}
+
+// onAck updates the RTT estimate and grows the congestion window (the caller must hold the outgoing lock)
+func (conv *conversation) onAck(pckt *Pckt) {
+	sender := conv.sender
+
+	// Karn's algorithm, a retransmitted packet's ACK could be for any of its copies
+	if pckt.TimesSent == 1 {
+		sample := conv.node.since(pckt.LastSent)
+		conv.node.metrics.rtt.observe(sample.Seconds())
+
+		if sender.srtt == 0 {
+			sender.srtt = sample
+			sender.rttvar = sample / 2
+		} else {
+			delta := sender.srtt - sample
+			if delta < 0 {
+				delta = -delta
+			}
+			sender.rttvar = (3*sender.rttvar + delta) / 4
+			sender.srtt = (7*sender.srtt + sample) / 8
+		}
+
+		sender.rto = sender.srtt + 4*sender.rttvar
+		if sender.rto < conv.node.min_rto {
+			sender.rto = conv.node.min_rto
+		} else if sender.rto > conv.node.max_rto {
+			sender.rto = conv.node.max_rto
+		}
+	}
+
+	// Slow start, then additive increase
+	if sender.cwnd < sender.ssthresh {
+		sender.cwnd += 1
+	} else {
+		sender.cwnd += 1 / sender.cwnd
+	}
+	if sender.cwnd > float64(sender.windowSize) {
+		sender.cwnd = float64(sender.windowSize)
+	}
+}
+
+// onLoss halves the congestion window, at most once per RTT so one burst of losses counts once
+// (the caller must hold the outgoing lock)
+func (conv *conversation) onLoss(timeout bool) {
+	sender := conv.sender
+
+	// Back off the timer until a fresh RTT sample comes in
+	if timeout {
+		sender.rto *= 2
+		if sender.rto > conv.node.max_rto {
+			sender.rto = conv.node.max_rto
+		}
+	}
+
+	rtt := sender.srtt
+	if rtt == 0 {
+		rtt = conv.node.initial_rto
+	}
+	if conv.node.since(sender.lastCut) < rtt {
+		return
+	}
+	sender.lastCut = conv.node.now()
+
+	sender.ssthresh = sender.cwnd / 2
+	if sender.ssthresh < 1 {
+		sender.ssthresh = 1
+	}
+	sender.cwnd = sender.ssthresh
+
+	conv.transport_log.Debug("Loss, congestion window cut", "cwnd", sender.cwnd)
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testConversation is a server conversation with nobody on the other end, for poking at its state directly
+func testConversation(t *testing.T, configure ...func(*Settings)) *conversation {
+	t.Helper()
+
+	settings := DefaultSettings()
+	settings.Log.Output = io.Discard
+	for _, c := range configure {
+		c(&settings)
+	}
+	if err := settings.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return newConversation(newNode(settings, true), 1, nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+}
+
+// within checks got is want give or take a few milliseconds of test scheduling
+func within(t *testing.T, what string, got time.Duration, want time.Duration) {
+	t.Helper()
+
+	if got < want || got > want+20*time.Millisecond {
+		t.Errorf("%s %s, expected %s", what, got, want)
+	}
+}
+
+// ackedAfter is a packet sent times times, the last of them rtt ago
+func ackedAfter(conv *conversation, rtt time.Duration, times uint32) *Pckt {
+	return &Pckt{TimesSent: times, LastSent: conv.node.now().Add(-rtt)}
+}
+
+// The RTO follows RFC 6298 from ACKs of packets sent once, ignores ACKs of retransmitted ones (Karn's
+// algorithm), backs off on timeouts, and stays between the minimum and maximum
+func TestRTO(t *testing.T) {
+	conv := testConversation(t)
+	sender := conv.sender
+
+	if sender.rto != INITIAL_RTO {
+		t.Fatalf("RTO %s before any sample, expected %s", sender.rto, INITIAL_RTO)
+	}
+
+	// First sample, SRTT = R, RTTVAR = R/2, RTO = SRTT + 4 RTTVAR
+	conv.onAck(ackedAfter(conv, 100*time.Millisecond, 1))
+	within(t, "SRTT", sender.srtt, 100*time.Millisecond)
+	within(t, "RTTVAR", sender.rttvar, 50*time.Millisecond)
+	within(t, "RTO", sender.rto, 300*time.Millisecond)
+
+	// An ACK for a retransmitted packet could be for either copy, no sample
+	srtt, rto := sender.srtt, sender.rto
+	conv.onAck(ackedAfter(conv, 1500*time.Millisecond, 2))
+	if sender.srtt != srtt || sender.rto != rto {
+		t.Errorf("retransmitted packet's ACK moved SRTT to %s and RTO to %s", sender.srtt, sender.rto)
+	}
+
+	// Timeouts double it, up to the maximum
+	conv.onLoss(true)
+	within(t, "RTO after a timeout", sender.rto, 2*rto)
+	for i := 0; i < 5; i++ {
+		conv.onLoss(true)
+	}
+	if sender.rto != MAX_RTO {
+		t.Errorf("RTO %s after repeated timeouts, expected the %s maximum", sender.rto, MAX_RTO)
+	}
+
+	// The next fresh sample brings it back down, never under the minimum
+	for i := 0; i < 20; i++ {
+		conv.onAck(ackedAfter(conv, time.Millisecond, 1))
+	}
+	if sender.rto != MIN_RTO {
+		t.Errorf("RTO %s on a 1ms path, expected the %s minimum", sender.rto, MIN_RTO)
+	}
+}
+
+// The congestion window grows by one per ACK in slow start and by about one per window after, is cut
+// in half at most once per RTT on loss, and never leaves 1..windowSize
+func TestCongestionWindow(t *testing.T) {
+	conv := testConversation(t, func(settings *Settings) { settings.Transport.WindowSize = 16 })
+	sender := conv.sender
+
+	if sender.cwnd != INITIAL_CWND || conv.effectiveWindow() != INITIAL_CWND {
+		t.Fatalf("cwnd %g (window %d), expected %d", sender.cwnd, conv.effectiveWindow(), INITIAL_CWND)
+	}
+
+	// Slow start
+	for i := 0; i < 6; i++ {
+		conv.onAck(ackedAfter(conv, 50*time.Millisecond, 1))
+	}
+	if sender.cwnd != INITIAL_CWND+6 {
+		t.Errorf("cwnd %g after 6 ACKs in slow start, expected %d", sender.cwnd, INITIAL_CWND+6)
+	}
+
+	// Loss halves it, and becomes the slow start threshold
+	conv.onLoss(false)
+	if sender.cwnd != 4 || sender.ssthresh != 4 {
+		t.Errorf("cwnd %g, ssthresh %g after loss, expected 4 and 4", sender.cwnd, sender.ssthresh)
+	}
+
+	// More loss within the same RTT is the same loss event
+	conv.onLoss(false)
+	conv.onLoss(true)
+	if sender.cwnd != 4 {
+		t.Errorf("cwnd %g after losses within one RTT, expected it to stay 4", sender.cwnd)
+	}
+
+	// Additive increase, a window's worth of ACKs for one packet
+	for i := 0; i < 4; i++ {
+		conv.onAck(ackedAfter(conv, 50*time.Millisecond, 1))
+	}
+	if sender.cwnd < 4.9 || sender.cwnd > 5 {
+		t.Errorf("cwnd %g after a window of ACKs in congestion avoidance, expected about 5", sender.cwnd)
+	}
+
+	// Repeated loss, an RTT apart, bottoms out at one packet
+	for i := 0; i < 10; i++ {
+		sender.lastCut = conv.node.now().Add(-time.Second)
+		conv.onLoss(false)
+	}
+	if sender.cwnd != 1 || conv.effectiveWindow() != 1 {
+		t.Errorf("cwnd %g (window %d) after repeated loss, expected 1", sender.cwnd, conv.effectiveWindow())
+	}
+
+	// And growth stops at the Selective Repeat window
+	for i := 0; i < 1000; i++ {
+		conv.onAck(ackedAfter(conv, 50*time.Millisecond, 1))
+	}
+	if sender.cwnd != 16 || conv.effectiveWindow() != 16 {
+		t.Errorf("cwnd %g (window %d), expected it capped at 16", sender.cwnd, conv.effectiveWindow())
+	}
+}
@@ -1,10 +1,11 @@
-package main // Declares that this file is part of the main package.
+package core // Declares that this file is part of the core package.
 
 import (
-	// Import the fmt package for printing.
+	"encoding/binary"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
 	"sync" // Import the sync package for mutexes.
 	"time"
 
@@ -22,6 +23,21 @@ type sliding_window struct {
 	windowStart uint32
 	windowSize  uint32
 	nextPcktNum uint32
+
+	// Forward Error Correction group being filled
+	fecGroup *fec_group
+
+	// Congestion control, the congestion window is in packets and never exceeds windowSize
+	cwnd     float64
+	ssthresh float64
+	srtt     time.Duration // Smoothed RTT, 0 until the first sample
+	rttvar   time.Duration
+	rto      time.Duration // Retransmission timeout
+	lastCut  time.Time     // Last time the congestion window was cut for loss
+
+	// Pacing of DATA packets
+	pacer      *pacer
+	pacingWait time.Duration // How long until the next paced packet can go, 0 if nothing is waiting
 }
 
 // Handles the SR functionality for incoming packets
@@ -31,10 +47,22 @@ type receiving_window struct {
 	incoming         map[uint32]*Pckt
 	incoming_lock    sync.Mutex
 	lastPcktReceived uint32
+
+	// Recently received bodies, kept for Forward Error Correction, the key is the packet number
+	fecCache map[uint32][]byte
+	// Parity that arrived with more than one of its group missing, the key is the group's first packet number
+	parityCache map[uint32]Pckt
 }
 
 // Structure container, connection free and instead dependent on the conversation's ID
 type conversation struct {
+	// Node this conversation belongs to
+	node *Node
+
+	// The node's loggers, with this conversation's ID attached
+	transport_log *slog.Logger
+	vote_log      *slog.Logger
+
 	// Conversation ID
 	conversation_id uint32
 
@@ -44,44 +72,188 @@ type conversation struct {
 	// SR Sender Structure
 	sender *sliding_window
 
+	// Path MTU Discovery state, decides how big our packets to this node can be
+	pmtu *pmtu_state
+
+	// Guards everything below it up to the done channel, the listener's workers update it while the looper,
+	// the cleaner and the HTTP handlers read it, use the methods below rather than the fields
+	state_lock sync.Mutex
+
 	// UDP Address of the Node Corresponding to this Conversation
 	conversation_addr *net.UDPAddr
 
+	// Transport the other node reaches us on, replies go out through it too
+	conversation_conn transport
+
 	conversation_features []uint16
 
+	// Group size the other node asked for in its hello (0 if it didn't)
+	conversation_fec_group_size uint16
+
 	LastOnline time.Time
 	missedSYNs uint64
 	online     bool
+
+	// When the cookie in the ownership proof that last moved the conversation was issued
+	proved_at int64
+
+	// Closed when the conversation is dropped (kicked or banned), stops its looper
+	done      chan struct{}
+	done_once sync.Once
 }
 
 // newConversation creates a new conversation instance
-func newConversation(conversation_id uint32, conv_addr *net.UDPAddr) *conversation {
+func newConversation(node *Node, conversation_id uint32, conv_conn transport, conv_addr *net.UDPAddr) *conversation {
 	return &conversation{
+		node:              node,
+		transport_log:     node.transport_log.With("conversation", conversation_id),
+		vote_log:          node.vote_log.With("conversation", conversation_id),
 		conversation_id:   conversation_id,
 		conversation_addr: conv_addr,
+		conversation_conn: conv_conn,
 		receiver: &receiving_window{
 			incoming:         make(map[uint32]*Pckt),
 			lastPcktReceived: 0,
+			fecCache:         make(map[uint32][]byte),
+			parityCache:      make(map[uint32]Pckt),
 		},
 		sender: &sliding_window{
 			outgoing:    make(map[uint32]*Pckt),
 			windowStart: 0,
-			windowSize:  5,
+			windowSize:  node.window_size,
 			nextPcktNum: 0,
+			fecGroup:    &fec_group{},
+			cwnd:        node.initial_cwnd,
+			ssthresh:    float64(node.window_size), // Slow start all the way up to windowSize
+			rto:         node.initial_rto,
+			pacer:       &pacer{},
 		},
-		LastOnline: time.Now(),
+		pmtu:       newPMTUState(),
+		LastOnline: node.now(),
 		missedSYNs: 0,
 		online:     true,
+		done:       make(chan struct{}),
 	}
 }
 
-func (conv *conversation) updateConversationAddr(conv_addr *net.UDPAddr) {
-	if conv_addr != conv.conversation_addr {
-		conv.conversation_addr = conv_addr
+// hasFeature checks the features the other node listed in its hello
+func (conv *conversation) hasFeature(feature uint16) bool {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	for _, f := range conv.conversation_features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// features returns the features the other node listed in its hello
+func (conv *conversation) features() []uint16 {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	return conv.conversation_features
+}
+
+// setFeatures keeps what the other node's hello said
+func (conv *conversation) setFeatures(features []uint16, fec_group_size uint16) {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	conv.conversation_features = features
+	conv.conversation_fec_group_size = fec_group_size
+}
+
+// peerFECGroupSize is the group size the other node asked for in its hello (0 if it didn't)
+func (conv *conversation) peerFECGroupSize() uint16 {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	return conv.conversation_fec_group_size
+}
+
+// peer returns the transport and address the other node is reached at
+func (conv *conversation) peer() (transport, *net.UDPAddr) {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	return conv.conversation_conn, conv.conversation_addr
+}
+
+// address returns the other node's address
+func (conv *conversation) address() *net.UDPAddr {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	return conv.conversation_addr
+}
+
+// heardFrom marks the conversation online, last heard from now at conv_addr through conv_conn,
+// returns whether it was offline
+func (conv *conversation) heardFrom(conv_conn transport, conv_addr *net.UDPAddr) bool {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	was_offline := !conv.online
+
+	conv.conversation_addr = conv_addr
+	conv.conversation_conn = conv_conn
+	conv.online = true
+	conv.LastOnline = conv.node.now()
+	conv.missedSYNs = 0
+
+	return was_offline
+}
+
+// claim takes an ownership proof whose cookie was issued at provedAt, returns false unless it's newer than the
+// one that last moved the conversation, anything else could be a replay
+func (conv *conversation) claim(provedAt int64) bool {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	if provedAt <= conv.proved_at {
+		return false
 	}
+
+	conv.proved_at = provedAt
+	return true
+}
+
+// isOnline reports whether the other node is taken to be there
+func (conv *conversation) isOnline() bool {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	return conv.online
+}
+
+// setOffline marks the conversation offline, returns whether it was online
+func (conv *conversation) setOffline() bool {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	was_online := conv.online
+	conv.online = false
+	return was_online
+}
+
+// lastSeen returns when the other node was last heard from
+func (conv *conversation) lastSeen() time.Time {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	return conv.LastOnline
 }
 
 func (conv *conversation) startUp() {
+	// Simulations run the looper's steps as events instead
+	if conv.node.sim != nil {
+		conv.node.sim.startConversation(conv)
+		return
+	}
+
 	go conv.looper()
 }
 
@@ -89,86 +261,86 @@ func (conv *conversation) startUp() {
 func (conv *conversation) looper() {
 	conv.sendHello()
 	for true {
-		conv.incomingProcessor()
-		conv.sendWindowPackets()
-		conv.checkForRetransmissions()
-		conv.checkLastOnline()
-		time.Sleep(20 * time.Millisecond)
+		conv.step()
+
+		select {
+		case <-conv.done:
+			return
+		case <-time.After(conv.loopDelay()):
+		}
 	}
 }
 
+// step is one round of the looper
+func (conv *conversation) step() {
+	conv.incomingProcessor()
+	conv.sendWindowPackets()
+	conv.checkForRetransmissions()
+	conv.checkLastOnline()
+	conv.probePMTU()
+}
+
+// stop ends the conversation's looper, nothing more is sent or retransmitted
+func (conv *conversation) stop() {
+	conv.done_once.Do(func() {
+		close(conv.done)
+	})
+}
+
 func (conv *conversation) checkLastOnline() {
-	if time.Since(conv.LastOnline) > 5000*time.Millisecond {
-		conv.sendSYN()
+	conv.state_lock.Lock()
+	quiet := conv.node.since(conv.LastOnline) > conv.node.keepalive_after
+	if quiet {
 		conv.missedSYNs += 1
 	}
+	conv.state_lock.Unlock()
+
+	if quiet {
+		conv.sendSYN()
+	}
 }
 
-// ARQ_Receive handles incoming packets, checks for duplicates, and sends ACKs/NAKs, updates receivedPackets
-func (conv *conversation) ARQ_Receive(conn *net.UDPConn, addr *net.UDPAddr, pckt Pckt) {
-	// Update Address
-	conv.updateConversationAddr(addr)
+// goneQuiet takes the conversation offline if it hasn't been heard from in a while and hasn't answered enough
+// SYNs, returns true if it did
+func (conv *conversation) goneQuiet() bool {
+	conv.state_lock.Lock()
+	defer conv.state_lock.Unlock()
+
+	if conv.online && conv.node.since(conv.LastOnline) > conv.node.keepalive_after && conv.missedSYNs > conv.node.offline_after_syns {
+		conv.online = false
+		return true
+	}
+	return false
+}
 
-	// Update last online
-	if conv.online == false {
-		log.Printf("\n\nSetting Conversation ID: %d to Online on reconnection.\n\n", conv.conversation_id)
+// ARQ_Receive handles incoming packets, checks for duplicates, and sends ACKs/NAKs, updates receivedPackets
+func (conv *conversation) ARQ_Receive(conn transport, addr *net.UDPAddr, pckt Pckt) {
+	// The other node is going away, don't count it as online again
+	if pckt.Header.Type == RESET {
+		conv.handleReset()
+		return
 	}
 
-	conv.online = true
-	conv.LastOnline = time.Now()
-	conv.missedSYNs = 0
+	// Update Address and last online
+	if conv.heardFrom(conn, addr) {
+		conv.transport_log.Info("Conversation back Online on reconnection", "addr", addr)
+	}
 
 	switch pckt.Header.Type {
 	case DATA:
 		{
-			// Send ACK for packet
-			conv.sendACK(pckt.Header.PacketNum, pckt.Header.SequenceNum)
-
-			// Lock Receiver
-			conv.receiver.incoming_lock.Lock()
-			defer conv.receiver.incoming_lock.Unlock()
-
-			// Check if single fragment packet
-			if pckt.Header.IsFinal == 0 || pckt.Header.SequenceNum > 0 {
-				// drop fragment packet
-				conv.receiver.lastPcktReceived = pckt.Header.PacketNum
-				if debug_mode {
-					log.Printf("Rejecting Multi Fragment Packet %d.\n", pckt.Header.PacketNum)
-				}
-				return
-			}
-
-			// Check if duplicate
-			if _, exists := conv.receiver.incoming[pckt.Header.PacketNum]; !exists {
-				conv.receiver.incoming[pckt.Header.PacketNum] = &pckt
-				conv.receiver.lastPcktReceived = pckt.Header.PacketNum
-			} else {
-				if debug_mode {
-					log.Printf("Duplicate packet received: %d.\n", pckt.Header.PacketNum)
-				}
-				return
-			}
+			conv.receiveDATA(pckt)
+			conv.retryParity(pckt.Header.PacketNum)
+		}
 
-			// Updates the highest sequence number if required
-			if pckt.Header.PacketNum > conv.receiver.lastPcktReceived {
-				// check for gap
-				if pckt.Header.PacketNum > conv.receiver.lastPcktReceived+1 {
-					for i := conv.receiver.lastPcktReceived + 1; i < pckt.Header.PacketNum; i++ {
-						if debug_mode {
-							log.Printf("Packet %d: %d does not exist, sending NACK\n", pckt.Header.PacketNum, pckt.Header.SequenceNum)
-						}
-						conv.sendNAK(i, 0)
-					}
-				}
-				conv.receiver.lastPcktReceived = pckt.Header.PacketNum
-			}
+	case FEC_PARITY:
+		{
+			conv.receiveParity(pckt)
 		}
 
 	case ACK:
 		{
-			if debug_mode {
-				log.Printf("Got an ACK for Packet %d.\n", pckt.Header.PacketNum)
-			}
+			conv.transport_log.Debug("Got an ACK", "packet", pckt.Header.PacketNum)
 
 			// Lock Sender
 			conv.sender.outgoing_lock.Lock()
@@ -176,21 +348,21 @@ func (conv *conversation) ARQ_Receive(conn *net.UDPConn, addr *net.UDPAddr, pckt
 
 			// Make sure outgoing packet exists
 			if _, exists := conv.sender.outgoing[pckt.Header.PacketNum]; !exists {
-				if debug_mode {
-					log.Printf("Packet %d does not exist, cannot Ack.", pckt.Header.PacketNum)
-				}
+				conv.transport_log.Debug("Packet does not exist, cannot Ack", "packet", pckt.Header.PacketNum)
 				return // Drop Ack
 			}
 
-			// Set Ack received state to true
-			conv.sender.outgoing[pckt.Header.PacketNum].AckReceived = true
+			// Set Ack received state to true, only the first ACK counts towards congestion control
+			if !conv.sender.outgoing[pckt.Header.PacketNum].AckReceived {
+				conv.sender.outgoing[pckt.Header.PacketNum].AckReceived = true
+				conv.onAck(conv.sender.outgoing[pckt.Header.PacketNum])
+				conv.pmtuAcked(PCKT_HEADER_SIZE + len(conv.sender.outgoing[pckt.Header.PacketNum].Body))
+			}
 		}
 
 	case NAK:
 		{
-			if debug_mode {
-				log.Printf("Got a NACK for Packet %d.\n", pckt.Header.PacketNum)
-			}
+			conv.transport_log.Debug("Got a NACK", "packet", pckt.Header.PacketNum)
 
 			// Lock Sender
 			conv.sender.outgoing_lock.Lock()
@@ -198,45 +370,64 @@ func (conv *conversation) ARQ_Receive(conn *net.UDPConn, addr *net.UDPAddr, pckt
 
 			// Make sure outgoing packet exists
 			if _, exists := conv.sender.outgoing[pckt.Header.PacketNum]; !exists {
-				if debug_mode {
-					log.Printf("Packet %d does not exist, cannot resend for Nack.", pckt.Header.PacketNum)
-				}
+				conv.transport_log.Debug("Packet does not exist, cannot resend for Nack", "packet", pckt.Header.PacketNum)
 				return // Drop Nack
 			}
 
 			// Make sure packet wasn't Acked before the lock
 			if conv.sender.outgoing[pckt.Header.PacketNum].AckReceived == true {
-				if debug_mode {
-					log.Printf("Packet %d already Acked, won't resend.", pckt.Header.PacketNum)
-				}
+				conv.transport_log.Debug("Packet already Acked, won't resend", "packet", pckt.Header.PacketNum)
 				return // Drop Nack
 			}
 
-			// Resend Packet
+			// Resend Packet, and slow down
+			conv.node.metrics.retransmits_nak.Add(1)
+			conv.onLoss(false)
 			conv.sendPacket(conv.sender.outgoing[pckt.Header.PacketNum])
 		}
 
 	case SYN:
 		{
-			if debug_mode {
-				log.Printf("Got a SYN\n")
-			}
+			conv.transport_log.Debug("Got a SYN")
+			// The server may want a proof made for the address it sees us at
+			conv.node.handleOwnershipChallenge(pckt.Body, addr)
 			// Instantly respond with SYN_ACK
 			conv.sendSYN_ACK()
 		}
 
 	case SYN_ACK:
 		{
-			if debug_mode {
-				log.Printf("Got a SYN ACK\n")
+			conv.transport_log.Debug("Got a SYN ACK")
+		}
+
+	case PROBE:
+		{
+			// Tell the prober its packet made it through, and how big it was
+			conv.sendProbeACK(uint32(PCKT_HEADER_SIZE + len(pckt.Body)))
+		}
+
+	case PROBE_ACK:
+		{
+			conv.transport_log.Debug("Got a Probe ACK", "bytes", pckt.Header.PacketNum)
+			conv.handleProbeACK(pckt.Header.PacketNum)
+		}
+
+	case DATAGRAM:
+		{
+			// No ACK, no window, hand it straight to the Data ID dispatcher,
+			// whether a body goes reliably or not is up to the sender's call to sendData
+			if pckt.Header.IsFinal == 0 || pckt.Header.SequenceNum > 0 {
+				conv.transport_log.Debug("Rejecting Multi Fragment Datagram")
+				conv.node.metrics.dropped_fragments.Add(1)
+				return
 			}
+
+			conv.processData(pckt.Body)
 		}
 
 	default:
 		{
-			if debug_mode {
-				log.Printf("Received an Unknown Packet Type\n")
-			}
+			conv.transport_log.Debug("Received an Unknown Packet Type", "packet", pckt.Header.PacketNum, "type", pckt.Header.Type)
 
 			// Send ACK for packet
 			conv.sendACK(pckt.Header.PacketNum, pckt.Header.SequenceNum)
@@ -244,14 +435,58 @@ func (conv *conversation) ARQ_Receive(conn *net.UDPConn, addr *net.UDPAddr, pckt
 	}
 }
 
+// receiveDATA Acks a DATA packet and stores it in incoming for the processor, unless it's a duplicate
+func (conv *conversation) receiveDATA(pckt Pckt) {
+	// Send ACK for packet
+	conv.sendACK(pckt.Header.PacketNum, pckt.Header.SequenceNum)
+
+	// Lock Receiver
+	conv.receiver.incoming_lock.Lock()
+	defer conv.receiver.incoming_lock.Unlock()
+
+	// Check if single fragment packet
+	if pckt.Header.IsFinal == 0 || pckt.Header.SequenceNum > 0 {
+		// drop fragment packet
+		conv.receiver.lastPcktReceived = pckt.Header.PacketNum
+		conv.transport_log.Debug("Rejecting Multi Fragment Packet", "packet", pckt.Header.PacketNum)
+		conv.node.metrics.dropped_fragments.Add(1)
+		return
+	}
+
+	// Keep a copy around in case a parity packet needs it to rebuild a lost neighbour
+	conv.cacheForFEC(&pckt)
+
+	// Check if duplicate
+	if _, exists := conv.receiver.incoming[pckt.Header.PacketNum]; !exists {
+		conv.receiver.incoming[pckt.Header.PacketNum] = &pckt
+		conv.receiver.lastPcktReceived = pckt.Header.PacketNum
+	} else {
+		conv.transport_log.Debug("Duplicate packet received", "packet", pckt.Header.PacketNum)
+		return
+	}
+
+	// Updates the highest sequence number if required
+	if pckt.Header.PacketNum > conv.receiver.lastPcktReceived {
+		// check for gap
+		if pckt.Header.PacketNum > conv.receiver.lastPcktReceived+1 {
+			for i := conv.receiver.lastPcktReceived + 1; i < pckt.Header.PacketNum; i++ {
+				conv.transport_log.Debug("Packet does not exist, sending NACK", "packet", i)
+				conv.sendNAK(i, 0)
+			}
+		}
+		conv.receiver.lastPcktReceived = pckt.Header.PacketNum
+	}
+}
+
 // sendHello sends a Hello Packet
 func (conv *conversation) sendHello() {
 	// Create the Hello Struct for the body of the Packet
 	helloBody := PcktHello{
-		DataID:      hello_c2s,
-		Version:     0,
-		NumFeatures: uint16(len(my_features)),
-		Features:    my_features,
+		DataID:       hello_c2s,
+		Version:      0,
+		NumFeatures:  uint16(len(conv.node.my_features)),
+		Features:     conv.node.my_features,
+		FECGroupSize: conv.node.fec_group_size,
 	}
 
 	helloBody_bytes, err := SerializeHello(&helloBody)
@@ -259,35 +494,8 @@ func (conv *conversation) sendHello() {
 		return
 	}
 
-	// Lock outgoing
-	conv.sender.outgoing_lock.Lock()
-	defer conv.sender.outgoing_lock.Unlock()
-
-	helloPacket := Pckt{
-		Header: PcktHeader{
-			Magic:       MAGIC_CONST,
-			Checksum:    0,
-			ConvID:      conversation_id_self,
-			PacketNum:   conv.sender.nextPcktNum,
-			SequenceNum: 0,
-			Type:        DATA,
-			IsFinal:     1,
-		},
-		Body: make([]byte, 0),
-	}
-
-	helloPacket.Body = append(helloPacket.Body, helloBody_bytes...)
-
-	// Make Sure we're not exceeding Maximum Packet Size
-	if len(helloPacket.Body) > MAX_PCKT_SIZE {
-		// Drop this packet
-		return
-	} else {
-		// Append to outgoing
-		conv.sender.outgoing[helloPacket.Header.PacketNum] = &helloPacket
-
-		// Increment next Packet Number
-		conv.sender.nextPcktNum += 1
+	if err := conv.sendData(helloBody_bytes, true); err != nil {
+		conv.transport_log.Warn("Couldn't send the hello", "err", err)
 	}
 }
 
@@ -295,10 +503,11 @@ func (conv *conversation) sendHello() {
 func (conv *conversation) sendHelloResonse() {
 	// Create the Hello Struct for the body of the Packet
 	helloBackBody := PcktHello{
-		DataID:      hello_back_s2c,
-		Version:     0,
-		NumFeatures: uint16(len(my_features)),
-		Features:    my_features,
+		DataID:       hello_back_s2c,
+		Version:      0,
+		NumFeatures:  uint16(len(conv.node.my_features)),
+		Features:     conv.node.my_features,
+		FECGroupSize: conv.node.fec_group_size,
 	}
 
 	helloBackBody_bytes, err := SerializeHello(&helloBackBody)
@@ -306,89 +515,27 @@ func (conv *conversation) sendHelloResonse() {
 		return
 	}
 
-	// Lock outgoing
-	conv.sender.outgoing_lock.Lock()
-	defer conv.sender.outgoing_lock.Unlock()
-
-	helloBackPacket := Pckt{
-		Header: PcktHeader{
-			Magic:       MAGIC_CONST,
-			Checksum:    0,
-			ConvID:      conversation_id_self,
-			PacketNum:   conv.sender.nextPcktNum,
-			SequenceNum: 0,
-			Type:        DATA,
-			IsFinal:     1,
-		},
-		Body: make([]byte, 0),
-	}
-
-	helloBackPacket.Body = append(helloBackPacket.Body, helloBackBody_bytes...)
-
-	// Make Sure we're not exceeding Maximum Packet Size
-	if len(helloBackPacket.Body) > MAX_PCKT_SIZE {
-		// Drop this packet
-		return
-	} else {
-		// Append to outgoing
-		conv.sender.outgoing[helloBackPacket.Header.PacketNum] = &helloBackPacket
-
-		// Increment next Packet Number
-		conv.sender.nextPcktNum += 1
+	if err := conv.sendData(helloBackBody_bytes, true); err != nil {
+		conv.transport_log.Warn("Couldn't send the hello back", "err", err)
 	}
 }
 
-func (conv *conversation) sendVoteRequestToServer(question string) {
+func (conv *conversation) sendVoteRequestToServer(voteid uuid.UUID, question string, deadline time.Duration) error {
 	// Create the Vote Request Struct for the body of the Packet
-	voteid, err := uuid.NewUUID()
-	if err != nil {
-		log.Print(err)
-		return
-	}
-
 	voteReqBody := PcktVoteRequest{
 		DataID:         vote_c2s_request_vote,
 		VoteID:         voteid,
 		QuestionLength: uint32(len(question)),
 		Question:       question,
+		Deadline:       uint32(deadline.Milliseconds()),
 	}
 
 	voteReqBody_bytes, err := SerializeVoteRequest(&voteReqBody)
 	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	// Lock outgoing
-	conv.sender.outgoing_lock.Lock()
-	defer conv.sender.outgoing_lock.Unlock()
-
-	voteReqPacket := Pckt{
-		Header: PcktHeader{
-			Magic:       MAGIC_CONST,
-			Checksum:    0,
-			ConvID:      conversation_id_self,
-			PacketNum:   conv.sender.nextPcktNum,
-			SequenceNum: 0,
-			Type:        DATA,
-			IsFinal:     1,
-		},
-		Body: make([]byte, 0),
+		return err
 	}
 
-	voteReqPacket.Body = append(voteReqPacket.Body, voteReqBody_bytes...)
-
-	// Make Sure we're not exceeding Maximum Packet Size
-	if len(voteReqPacket.Body) > MAX_PCKT_SIZE {
-		// Drop this packet
-		return
-	} else {
-		// Append to outgoing
-		conv.sender.outgoing[voteReqPacket.Header.PacketNum] = &voteReqPacket
-
-		// Increment next Packet Number
-		conv.sender.nextPcktNum += 1
-	}
+	return conv.sendData(voteReqBody_bytes, true)
 }
 
 func (conv *conversation) sendVoteBroadcastToClient(h_ref *host_referendum) {
@@ -405,35 +552,8 @@ func (conv *conversation) sendVoteBroadcastToClient(h_ref *host_referendum) {
 		return
 	}
 
-	// Lock outgoing
-	conv.sender.outgoing_lock.Lock()
-	defer conv.sender.outgoing_lock.Unlock()
-
-	voteBrPacket := Pckt{
-		Header: PcktHeader{
-			Magic:       MAGIC_CONST,
-			Checksum:    0,
-			ConvID:      conversation_id_self,
-			PacketNum:   conv.sender.nextPcktNum,
-			SequenceNum: 0,
-			Type:        DATA,
-			IsFinal:     1,
-		},
-		Body: make([]byte, 0),
-	}
-
-	voteBrPacket.Body = append(voteBrPacket.Body, voteBrBody_bytes...)
-
-	// Make Sure we're not exceeding Maximum Packet Size
-	if len(voteBrPacket.Body) > MAX_PCKT_SIZE {
-		// Drop this packet
-		return
-	} else {
-		// Append to outgoing
-		conv.sender.outgoing[voteBrPacket.Header.PacketNum] = &voteBrPacket
-
-		// Increment next Packet Number
-		conv.sender.nextPcktNum += 1
+	if err := conv.sendData(voteBrBody_bytes, true); err != nil {
+		conv.vote_log.Warn("Couldn't send the question", "vote_id", h_ref.VoteID, "err", err)
 	}
 }
 
@@ -450,35 +570,8 @@ func (conv *conversation) sendResponseToServer(c_ref *client_referendum) {
 		return
 	}
 
-	// Lock outgoing
-	conv.sender.outgoing_lock.Lock()
-	defer conv.sender.outgoing_lock.Unlock()
-
-	voteResPacket := Pckt{
-		Header: PcktHeader{
-			Magic:       MAGIC_CONST,
-			Checksum:    0,
-			ConvID:      conversation_id_self,
-			PacketNum:   conv.sender.nextPcktNum,
-			SequenceNum: 0,
-			Type:        DATA,
-			IsFinal:     1,
-		},
-		Body: make([]byte, 0),
-	}
-
-	voteResPacket.Body = append(voteResPacket.Body, voteResBody_bytes...)
-
-	// Make Sure we're not exceeding Maximum Packet Size
-	if len(voteResPacket.Body) > MAX_PCKT_SIZE {
-		// Drop this packet
-		return
-	} else {
-		// Append to outgoing
-		conv.sender.outgoing[voteResPacket.Header.PacketNum] = &voteResPacket
-
-		// Increment next Packet Number
-		conv.sender.nextPcktNum += 1
+	if err := conv.sendData(voteResBody_bytes, true); err != nil {
+		conv.vote_log.Warn("Couldn't send our response", "vote_id", c_ref.VoteID, "err", err)
 	}
 }
 
@@ -495,15 +588,108 @@ func (conv *conversation) sendResultBroadcastToClient(h_ref *host_referendum) {
 		return
 	}
 
+	if err := conv.sendData(voteResBrBody_bytes, true); err != nil {
+		conv.vote_log.Warn("Couldn't send the result", "vote_id", h_ref.VoteID, "err", err)
+	}
+}
+
+// Live tallies are stale as soon as the next ballot arrives, so they're sent unreliably
+// (the caller must hold the referendum lock)
+func (conv *conversation) sendTallyUpdateToClient(h_ref *host_referendum) {
+	tallyBody := PcktVoteTally{
+		DataID:       vote_s2c_tally_update,
+		VoteID:       h_ref.VoteID,
+		Participants: uint32(len(h_ref.participants)),
+	}
+
+	empty, err := SerializeVoteTally(&tallyBody)
+	if err != nil {
+		return
+	}
+	tallyBody.Tallies = fitTallies(h_ref.votes, conv.maxBodySize()-len(empty))
+	tallyBody.NumTallies = uint16(len(tallyBody.Tallies))
+
+	tallyBody_bytes, err := SerializeVoteTally(&tallyBody)
+	if err != nil {
+		return
+	}
+
+	if err := conv.sendData(tallyBody_bytes, false); err != nil {
+		conv.vote_log.Debug("Couldn't send the tally", "vote_id", h_ref.VoteID, "err", err)
+	}
+}
+
+// The verdict goes to the client that proposed the referendum, reliably since it's waiting on it
+// (the caller must hold the referendum lock)
+func (conv *conversation) sendVerdictToClient(h_ref *host_referendum) {
+	verdictBody := PcktVoteVerdict{
+		DataID:       vote_s2c_verdict,
+		VoteID:       h_ref.VoteID,
+		Result:       h_ref.result,
+		Participants: uint32(len(h_ref.participants)),
+	}
+
+	empty, err := SerializeVoteVerdict(&verdictBody)
+	if err != nil {
+		return
+	}
+	verdictBody.Tallies = fitTallies(h_ref.votes, conv.maxBodySize()-len(empty))
+	verdictBody.NumTallies = uint16(len(verdictBody.Tallies))
+
+	verdictBody_bytes, err := SerializeVoteVerdict(&verdictBody)
+	if err != nil {
+		return
+	}
+
+	if err := conv.sendData(verdictBody_bytes, true); err != nil {
+		conv.vote_log.Warn("Couldn't send the verdict", "vote_id", h_ref.VoteID, "err", err)
+	}
+}
+
+// fitTallies lists as many tallies as fit in room bytes, biggest first, so a referendum with more distinct
+// responses than fit in one packet loses its rarest ones rather than the whole body
+func fitTallies(votes map[uint16]uint64, room int) []PcktTallyEntry {
+	tallies := make([]PcktTallyEntry, 0, len(votes))
+	for response, count := range votes {
+		tallies = append(tallies, PcktTallyEntry{Response: response, Count: uint32(count)})
+	}
+	sort.Slice(tallies, func(i, j int) bool {
+		if tallies[i].Count != tallies[j].Count {
+			return tallies[i].Count > tallies[j].Count
+		}
+		return tallies[i].Response < tallies[j].Response
+	})
+
+	fit := max(room/binary.Size(PcktTallyEntry{}), 0)
+	if len(tallies) > fit {
+		tallies = tallies[:fit]
+	}
+	return tallies
+}
+
+// sendData hands a serialized body (starting with its Data ID) to the conversation,
+// reliable bodies go through the Selective Repeat window, unreliable ones are sent once as a DATAGRAM,
+// nothing is split up, so a body bigger than the path currently carries is refused with an error
+func (conv *conversation) sendData(body []byte, reliable bool) error {
+	// Make Sure we're not exceeding the Maximum Packet Size for this path
+	if len(body) > conv.maxBodySize() {
+		// Drop this packet
+		return errors.New("Exceeded Max Packet Size")
+	}
+
+	if !reliable {
+		return conv.sendDatagram(body)
+	}
+
 	// Lock outgoing
 	conv.sender.outgoing_lock.Lock()
 	defer conv.sender.outgoing_lock.Unlock()
 
-	voteResBrPacket := Pckt{
+	dataPacket := Pckt{
 		Header: PcktHeader{
 			Magic:       MAGIC_CONST,
 			Checksum:    0,
-			ConvID:      conversation_id_self,
+			ConvID:      conv.node.ConversationID(),
 			PacketNum:   conv.sender.nextPcktNum,
 			SequenceNum: 0,
 			Type:        DATA,
@@ -512,22 +698,33 @@ func (conv *conversation) sendResultBroadcastToClient(h_ref *host_referendum) {
 		Body: make([]byte, 0),
 	}
 
-	voteResBrPacket.Body = append(voteResBrPacket.Body, voteResBrBody_bytes...)
+	dataPacket.Body = append(dataPacket.Body, body...)
 
-	// Make Sure we're not exceeding Maximum Packet Size
-	if len(voteResBrPacket.Body) > MAX_PCKT_SIZE {
-		// Drop this packet
-		if debug_mode {
-			log.Println("\n\nExceeded Max Packet Size\n\n")
-		}
-		return
-	} else {
-		// Append to outgoing
-		conv.sender.outgoing[voteResBrPacket.Header.PacketNum] = &voteResBrPacket
+	// Append to outgoing
+	conv.sender.outgoing[dataPacket.Header.PacketNum] = &dataPacket
+
+	// Increment next Packet Number
+	conv.sender.nextPcktNum += 1
+
+	return nil
+}
 
-		// Increment next Packet Number
-		conv.sender.nextPcktNum += 1
+// sendDatagram sends a body straight away, it is checksummed like any other packet, but never Acked or Retransmitted
+func (conv *conversation) sendDatagram(body []byte) error {
+	datagramPacket := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      conv.node.ConversationID(),
+			PacketNum:   0,
+			SequenceNum: 0,
+			Type:        DATAGRAM,
+			IsFinal:     1,
+		},
+		Body: body,
 	}
+
+	return conv.sendPacket(&datagramPacket)
 }
 
 // sendSYN sends a SYN
@@ -536,13 +733,13 @@ func (conv *conversation) sendSYN() {
 		Header: PcktHeader{
 			Magic:       MAGIC_CONST,
 			Checksum:    0,
-			ConvID:      conversation_id_self,
+			ConvID:      conv.node.ConversationID(),
 			PacketNum:   0,
 			SequenceNum: 0,
 			Type:        SYN,
 			IsFinal:     1,
 		},
-		Body: []byte{},
+		Body: conv.node.ownershipProof(),
 	}
 
 	conv.sendPacket(&synPacket)
@@ -554,13 +751,13 @@ func (conv *conversation) sendSYN_ACK() {
 		Header: PcktHeader{
 			Magic:       MAGIC_CONST,
 			Checksum:    0,
-			ConvID:      conversation_id_self,
+			ConvID:      conv.node.ConversationID(),
 			PacketNum:   0,
 			SequenceNum: 0,
 			Type:        SYN_ACK,
 			IsFinal:     1,
 		},
-		Body: []byte{},
+		Body: conv.node.ownershipProof(),
 	}
 
 	conv.sendPacket(&syn_ackPacket)
@@ -572,7 +769,7 @@ func (conv *conversation) sendNAK(missingPcktNum uint32, missingSeqNum uint32) {
 		Header: PcktHeader{
 			Magic:       MAGIC_CONST,
 			Checksum:    0,
-			ConvID:      conversation_id_self,
+			ConvID:      conv.node.ConversationID(),
 			PacketNum:   missingPcktNum,
 			SequenceNum: missingSeqNum,
 			Type:        NAK,
@@ -590,7 +787,7 @@ func (conv *conversation) sendACK(pcktNum uint32, seqNum uint32) {
 		Header: PcktHeader{
 			Magic:       MAGIC_CONST,
 			Checksum:    0,
-			ConvID:      conversation_id_self,
+			ConvID:      conv.node.ConversationID(),
 			PacketNum:   pcktNum,
 			SequenceNum: seqNum,
 			Type:        ACK,
@@ -605,7 +802,8 @@ func (conv *conversation) sendACK(pcktNum uint32, seqNum uint32) {
 // Sends a packet and updates its state in the packetStates map, marks it as sent and records the sending time.
 func (conv *conversation) sendPacket(pckt *Pckt) error {
 	// Send Packet
-	if err := sendUDP(conv.conversation_addr, pckt); err != nil {
+	conn, addr := conv.peer()
+	if err := conv.node.sendUDP(conn, addr, pckt); err != nil {
 		return errors.New("Packet Couldn't Send")
 	}
 
@@ -614,31 +812,39 @@ func (conv *conversation) sendPacket(pckt *Pckt) error {
 		pckt.AckReceived = false
 
 		// Reset Last Sent Timestamp
-		pckt.LastSent = time.Now()
+		pckt.LastSent = conv.node.now()
+		pckt.TimesSent += 1
 	}
 
 	return nil
 }
 
-// Manages the sending window by sending packets within the window size, ensures packets are sent in sequence
+// Manages the sending window by sending new packets within the window size, ensures packets are sent in sequence,
+// paced rather than in one burst (packets already sent are left to the retransmission timer and NAKs)
 func (conv *conversation) sendWindowPackets() {
 	conv.sender.outgoing_lock.Lock()
 
 	conv.moveWindow()
 
-	for i := conv.sender.windowStart; i < conv.sender.windowStart+conv.sender.windowSize; i++ {
+	for i := conv.sender.windowStart; i < conv.sender.windowStart+conv.effectiveWindow(); i++ {
 		// Make sure packet exists in outgoing
 		if _, exists := conv.sender.outgoing[i]; exists {
 			// Make sure it's not a NULL pointer
 			if conv.sender.outgoing[i] != nil {
-				// Make sure we haven't received an ACK for it before this function
-				if !conv.sender.outgoing[i].AckReceived {
-					conv.sendPacket(conv.sender.outgoing[i])
+				// Make sure we haven't received an ACK for it before this function, or sent it already
+				if !conv.sender.outgoing[i].AckReceived && conv.sender.outgoing[i].LastSent.IsZero() {
+					// Wait for the pacer, the next loop picks up from here
+					if !conv.canSendPaced() {
+						break
+					}
+
+					conv.sendPaced(conv.sender.outgoing[i])
+
+					// The first transmission goes into a parity group
+					conv.addToParityGroup(conv.sender.outgoing[i])
 				}
 			} else {
-				if debug_mode {
-					log.Printf("NULL pointer in window slice")
-				}
+				conv.transport_log.Error("NULL pointer in window slice", "packet", i)
 			}
 		} else {
 			//log.Printf("Send Window Packets: Reached the end of the window")
@@ -646,6 +852,8 @@ func (conv *conversation) sendWindowPackets() {
 		}
 	}
 
+	conv.flushParityGroup()
+
 	conv.sender.outgoing_lock.Unlock()
 }
 
@@ -668,9 +876,7 @@ func (conv *conversation) moveWindow() {
 					break
 				}
 			} else {
-				if debug_mode {
-					log.Printf("NULL pointer in outgoing.\n")
-				}
+				conv.transport_log.Error("NULL pointer in outgoing", "packet", i)
 			}
 		} else {
 			//log.Printf("Packet %d doesn't exist in outgoing.\n", i)
@@ -683,21 +889,27 @@ func (conv *conversation) moveWindow() {
 func (conv *conversation) checkForRetransmissions() {
 	conv.sender.outgoing_lock.Lock() // Ensure thread-safe access to sender
 
+	var timedOut bool = false
+
 	if len(conv.sender.outgoing) > 0 {
 		for i := conv.sender.windowStart; i < conv.sender.windowStart+conv.sender.windowSize; i++ {
 			// Make sure packet exists in outgoing
 			if _, exists := conv.sender.outgoing[i]; exists {
 				if conv.sender.outgoing[i] != nil {
-					if !conv.sender.outgoing[i].AckReceived && time.Since(conv.sender.outgoing[i].LastSent) > 1000*time.Millisecond {
-						if debug_mode {
-							log.Println("Resending %d.\n", conv.sender.outgoing[i].Header.PacketNum)
+					if !conv.sender.outgoing[i].AckReceived && !conv.sender.outgoing[i].LastSent.IsZero() && conv.node.since(conv.sender.outgoing[i].LastSent) > conv.sender.rto {
+						// Wait for the pacer, the next loop picks up from here
+						if !conv.canSendPaced() {
+							break
 						}
-						conv.sendPacket(conv.sender.outgoing[i])
+
+						conv.transport_log.Debug("Resending", "packet", conv.sender.outgoing[i].Header.PacketNum)
+						conv.node.metrics.retransmits_rto.Add(1)
+						timedOut = true
+						conv.pmtuTimedOut(PCKT_HEADER_SIZE + len(conv.sender.outgoing[i].Body))
+						conv.sendPaced(conv.sender.outgoing[i])
 					}
 				} else {
-					if debug_mode {
-						log.Printf("NULL pointer in outgoing.\n")
-					}
+					conv.transport_log.Error("NULL pointer in outgoing", "packet", i)
 				}
 			} else {
 				//log.Printf("Packet %d doesn't exist in outgoing.\n", i)
@@ -705,6 +917,11 @@ func (conv *conversation) checkForRetransmissions() {
 		}
 	}
 
+	// One loss event per scan, however many packets timed out
+	if timedOut {
+		conv.onLoss(true)
+	}
+
 	conv.sender.outgoing_lock.Unlock()
 }
 
@@ -717,17 +934,19 @@ func (conv *conversation) incomingProcessor() {
 	if len(conv.receiver.incoming) > 0 {
 
 		var minPcktNum uint32
+		first := true
 
+		// Oldest first, map order is random
 		for pcktNum := range conv.receiver.incoming {
-			minPcktNum = pcktNum
-			break
+			if first || pcktNum < minPcktNum {
+				minPcktNum = pcktNum
+				first = false
+			}
 		}
 
 		// Make sure it actually exists
 		if _, exists := conv.receiver.incoming[minPcktNum]; !exists {
-			if debug_mode {
-				log.Printf("Packet %d does not exist in incoming.", minPcktNum)
-			}
+			conv.transport_log.Error("Packet does not exist in incoming", "packet", minPcktNum)
 			return
 		} else {
 			// Delete Packet from incoming after we're done with it
@@ -735,127 +954,147 @@ func (conv *conversation) incomingProcessor() {
 		}
 
 		// Process the next packet
-		DataID, err := DeserializeDataID(conv.receiver.incoming[minPcktNum].Body[:2])
-		if err != nil {
-			if debug_mode {
-				log.Printf("Couldn't get Data ID")
+		conv.processData(conv.receiver.incoming[minPcktNum].Body)
+	}
+}
+
+// processData dispatches a DATA or DATAGRAM body by its Data ID
+func (conv *conversation) processData(body []byte) {
+	DataID, err := DeserializeDataID(body)
+	if err != nil {
+		conv.transport_log.Debug("Couldn't get Data ID")
+		return
+	}
+
+	switch DataID {
+	case hello_c2s:
+		{
+			conv.transport_log.Debug("Got a hello")
+			hello, err := DeserializeHello(body)
+			if err != nil {
+				conv.transport_log.Debug("Couldn't Deserialize Hello Packet", "err", err)
+				return
 			}
-			return
-		}
 
-		switch DataID {
-		case hello_c2s:
-			{
-				if debug_mode {
-					log.Printf("Got a hello\n")
-				}
-				hello, err := DeserializeHello(conv.receiver.incoming[minPcktNum].Body)
-				if err != nil {
-					if debug_mode {
-						log.Printf("Could't Deserialize Hello Packet")
-					}
-					return
-				}
+			conv.setFeatures(hello.Features, hello.FECGroupSize)
+
+			// Send a Hello Back
+			conv.sendHelloResonse()
 
-				conv.conversation_features = hello.Features
+			// As Server, give the client a way back in if it restarts
+			if conv.node.i_am_server {
+				conv.sendResumptionTicket()
+			}
 
-				// Send a Hello Back
-				conv.sendHelloResonse()
+		}
 
+	case hello_back_s2c:
+		{
+			conv.transport_log.Info("Got a hello back")
+			hello_response, err := DeserializeHello(body)
+			if err != nil {
+				conv.transport_log.Debug("Couldn't Deserialize Hello Response Packet", "err", err)
+				return
 			}
 
-		case hello_back_s2c:
-			{
-				log.Printf("\n\nGot a hello back...\n\n")
-				hello_response, err := DeserializeHello(conv.receiver.incoming[minPcktNum].Body)
-				if err != nil {
-					if debug_mode {
-						log.Printf("Could't Deserialize Hello Response Packet")
-					}
-					return
-				}
+			conv.setFeatures(hello_response.Features, hello_response.FECGroupSize)
+		}
 
-				conv.conversation_features = hello_response.Features
+	case vote_c2s_request_vote:
+		{
+			conv.vote_log.Debug("Got a Request to Host Referendum")
+			vote_request, err := DeserializeVoteRequest(body)
+			if err != nil {
+				conv.vote_log.Debug("Couldn't Deserialize Vote Request from Client Packet", "err", err)
+				return
 			}
 
-		case vote_c2s_request_vote:
-			{
-				if debug_mode {
-					log.Printf("Got a Request to Host Referendum\n")
-				}
-				vote_request, err := DeserializeVoteRequest(conv.receiver.incoming[minPcktNum].Body)
-				if err != nil {
-					if debug_mode {
-						log.Printf("Could't Deserialize Vote Request from Client Packet")
-					}
-					return
-				}
+			conv.vote_log.Debug("Got Question from client", "vote_id", vote_request.VoteID, "question", vote_request.Question)
 
-				if debug_mode {
-					log.Printf("Got Question from client: %d: \"%s\"", conv.receiver.incoming[minPcktNum], vote_request.Question)
-				}
+			// As Server, Begin a vote
+			conv.node.ref_manager.create_referendum_from_client_request(vote_request, conv)
+		}
 
-				// As Server, Begin a vote
-				ref_manager.create_referendum_from_client_request(vote_request)
+	case vote_s2c_broadcast_question:
+		{
+			conv.vote_log.Debug("Got a Question to answer for the host")
+			vote_broadcast_question, err := DeserializeVoteRequest(body)
+			if err != nil {
+				conv.vote_log.Debug("Couldn't Deserialize Vote Broadcast Question from Server Packet", "err", err)
+				return
 			}
 
-		case vote_s2c_broadcast_question:
-			{
-				if debug_mode {
-					log.Printf("Got a Question to answer for the host\n")
-				}
-				vote_broadcast_question, err := DeserializeVoteRequest(conv.receiver.incoming[minPcktNum].Body)
-				if err != nil {
-					if debug_mode {
-						log.Printf("Could't Deserialize Vote Broadcast Question from Server Packet")
-					}
-					return
-				}
+			// As a Client, Process Question and send your response back to server
+			conv.node.ref_manager.handle_new_question_from_server(vote_broadcast_question, conv)
+		}
 
-				// As a Client, Process Question and send your response back to server
-				ref_manager.handle_new_question_from_server(vote_broadcast_question, conv)
+	case vote_c2s_response_to_question:
+		{
+			conv.vote_log.Debug("Got a Response from a Voter")
+			vote_response, err := DeserializeVoteResponse(body)
+			if err != nil {
+				conv.vote_log.Debug("Couldn't Deserialize Vote Response from Client Packet", "err", err)
+				return
 			}
 
-		case vote_c2s_response_to_question:
-			{
-				if debug_mode {
-					log.Printf("Got a Response from a Voter\n")
-				}
-				vote_response, err := DeserializeVoteResponse(conv.receiver.incoming[minPcktNum].Body)
-				if err != nil {
-					if debug_mode {
-						log.Printf("Could't Deserialize Vote Response from Client Packet")
-					}
-					return
-				}
+			// As Server, log Client response
+			conv.node.ref_manager.handle_response_from_client(vote_response, conv)
+		}
 
-				// As Server, log Client response
-				ref_manager.handle_response_from_client(vote_response, conv)
+	case vote_s2c_broadcast_result:
+		{
+			conv.vote_log.Debug("Got a Winning Result for Referendum")
+			vote_broadcast_result, err := DeserializeVoteResponse(body)
+			if err != nil {
+				conv.vote_log.Debug("Couldn't Deserialize Vote Broadcast Result from Server Packet", "err", err)
+				return
 			}
 
-		case vote_s2c_broadcast_result:
-			{
-				if debug_mode {
-					log.Printf("Got a Winning Result for Referendum\n")
-				}
-				vote_broadcast_result, err := DeserializeVoteResponse(conv.receiver.incoming[minPcktNum].Body)
-				if err != nil {
-					if debug_mode {
-						log.Printf("Could't Deserialize Vote Broadcast Result from Server Packet")
-					}
-					return
-				}
+			// As Client, overwrite your own response to the Question if you got it wrong
+			conv.node.ref_manager.handle_result_from_server(vote_broadcast_result)
+		}
 
-				// As Client, overwrite your own response to the Question if you got it wrong
-				ref_manager.handle_result_from_server(vote_broadcast_result)
+	case resumption_ticket_s2c:
+		{
+			ticket, err := DeserializeResumptionTicket(body)
+			if err != nil {
+				conv.transport_log.Debug("Couldn't Deserialize Resumption Ticket from Server Packet", "err", err)
+				return
 			}
 
-		default:
-			{
-				if debug_mode {
-					log.Printf("Received an Unknown Data ID")
-				}
+			// As Client, keep the newest ticket for the next time we start up
+			if err := conv.node.saveTicket(conv.address().String(), ticket.Ticket); err != nil {
+				conv.transport_log.Warn("Couldn't save Resumption Ticket", "path", conv.node.session_ticket_path, "err", err)
+			}
+		}
+
+	case vote_s2c_tally_update:
+		{
+			vote_tally, err := DeserializeVoteTally(body)
+			if err != nil {
+				conv.vote_log.Debug("Couldn't Deserialize Vote Tally Update from Server Packet", "err", err)
+				return
 			}
+
+			// As Client, keep track of how the vote is going
+			conv.node.ref_manager.handle_tally_from_server(vote_tally)
+		}
+
+	case vote_s2c_verdict:
+		{
+			vote_verdict, err := DeserializeVoteVerdict(body)
+			if err != nil {
+				conv.vote_log.Debug("Couldn't Deserialize Vote Verdict from Server Packet", "err", err)
+				return
+			}
+
+			// As Client, hand the verdict to whoever proposed the referendum
+			conv.node.ref_manager.handle_verdict_from_server(vote_verdict)
+		}
+
+	default:
+		{
+			conv.transport_log.Debug("Received an Unknown Data ID", "data_id", DataID)
 		}
 	}
 }
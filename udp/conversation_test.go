@@ -0,0 +1,84 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// An unreliable body goes out once as a DATAGRAM, is handled by the other end without an ACK,
+// and never joins the window to be retransmitted
+func TestSendDatagram(t *testing.T) {
+	network := newMemoryNetwork()
+	serverConn, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.close()
+	clientConn, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.close()
+
+	server := testConversation(t)
+	server.heardFrom(serverConn, clientConn.localAddr())
+
+	settings := DefaultSettings()
+	settings.Log.Output = io.Discard
+	client := newConversation(newNode(settings, false), 1, clientConn, serverConn.localAddr())
+
+	voteID := uuid.New()
+	client.node.ref_manager.c_referendums[voteID] = &client_referendum{VoteID: voteID}
+
+	body, err := SerializeVoteTally(&PcktVoteTally{
+		DataID:       vote_s2c_tally_update,
+		VoteID:       voteID,
+		Participants: 3,
+		NumTallies:   1,
+		Tallies:      []PcktTallyEntry{{Response: 1, Count: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := server.sender.nextPcktNum
+	if err := server.sendData(body, false); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, from, err := readOne(t, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pckt, err := DeserializePacket([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pckt.Header.Type != DATAGRAM {
+		t.Fatalf("sent as type %d, expected a DATAGRAM", pckt.Header.Type)
+	}
+
+	client.ARQ_Receive(clientConn, from, *pckt)
+	if cast := client.node.ref_manager.c_referendums[voteID].tallyCast; cast != 2 {
+		t.Errorf("client counted %d ballots from the tally, expected 2", cast)
+	}
+	select {
+	case datagram := <-serverConn.inbox:
+		t.Errorf("client answered the DATAGRAM with %x", datagram.data)
+	default:
+	}
+
+	// Nothing was queued for the window, so there's nothing to retransmit
+	if len(server.sender.outgoing) != 0 || server.sender.nextPcktNum != next {
+		t.Errorf("%d packets waiting and next packet %d, expected none and %d", len(server.sender.outgoing), server.sender.nextPcktNum, next)
+	}
+	server.sendWindowPackets()
+	server.checkForRetransmissions()
+	select {
+	case datagram := <-clientConn.inbox:
+		t.Errorf("server sent %x again", datagram.data)
+	default:
+	}
+}
@@ -0,0 +1,206 @@
+// Address validation cookies and per-IP rate limits, so no per-client state is allocated for spoofed traffic
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	COOKIE_LIFETIME  = 30 * time.Second
+	COOKIE_MAC_SIZE  = 16
+	COOKIE_SIZE      = 8 + COOKIE_MAC_SIZE // IssuedAt + truncated MAC
+	PING_MIN_BODY    = 64                  // Pings are padded to this, so a retry never outweighs the ping it answers
+	IP_RATE          = 5.0                 // Pings and new conversations allowed per second per IP
+	IP_BURST         = 10.0
+	IP_LIMITER_IDLE  = time.Minute // Forget about IPs that have been quiet this long
+	IP_LIMITER_PRUNE = 10 * time.Second
+)
+
+// Per-IP token buckets
+type ip_limiter struct {
+	lock      sync.Mutex
+	buckets   map[string]*ip_bucket
+	lastPrune time.Time
+}
+
+type ip_bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the IP's bucket, returns false if it's empty
+func (limiter *ip_limiter) allow(ip net.IP, now time.Time) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.prune(now)
+
+	bucket, exists := limiter.buckets[ip.String()]
+	if !exists {
+		bucket = &ip_bucket{tokens: IP_BURST, last: now}
+		limiter.buckets[ip.String()] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * IP_RATE
+	if bucket.tokens > IP_BURST {
+		bucket.tokens = IP_BURST
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens -= 1
+	return true
+}
+
+// prune drops buckets for IPs that have gone quiet, every so often (the caller must hold the lock)
+func (limiter *ip_limiter) prune(now time.Time) {
+	if now.Sub(limiter.lastPrune) < IP_LIMITER_PRUNE {
+		return
+	}
+	limiter.lastPrune = now
+
+	for ip, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) > IP_LIMITER_IDLE {
+			delete(limiter.buckets, ip)
+		}
+	}
+}
+
+// cookieMAC signs an address and issue time
+func (node *Node) cookieMAC(addr *net.UDPAddr, issuedAt int64) []byte {
+	mac := hmac.New(sha256.New, node.server_secret)
+	mac.Write([]byte("cookie"))
+	mac.Write([]byte(addr.String()))
+	binary.Write(mac, binary.BigEndian, issuedAt)
+	return mac.Sum(nil)[:COOKIE_MAC_SIZE]
+}
+
+// issueCookie creates a cookie for an address, a MAC over it and the time keyed with the server secret,
+// so nothing has to be remembered about the client
+func (node *Node) issueCookie(addr *net.UDPAddr) []byte {
+	issuedAt := node.now().Unix()
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, issuedAt)
+	buf.Write(node.cookieMAC(addr, issuedAt))
+
+	return buf.Bytes()
+}
+
+// verifyCookie checks a cookie was issued by us, to this address, not too long ago
+func (node *Node) verifyCookie(cookie []byte, addr *net.UDPAddr) error {
+	if len(cookie) != COOKIE_SIZE {
+		return errors.New("verifyCookie: wrong cookie size")
+	}
+
+	issuedAt := int64(binary.BigEndian.Uint64(cookie[0:8]))
+
+	if !hmac.Equal(node.cookieMAC(addr, issuedAt), cookie[8:]) {
+		return errors.New("verifyCookie: bad MAC")
+	}
+
+	if age := node.since(time.Unix(issuedAt, 0)); age > COOKIE_LIFETIME || age < -COOKIE_LIFETIME {
+		return errors.New("verifyCookie: cookie expired")
+	}
+
+	return nil
+}
+
+// sendPingRetry answers a Ping that didn't have a valid cookie with one, only a Ping echoing it back (so able
+// to receive at its address) gets a Conversation ID, and the retry is never bigger than the Ping it answers
+func (node *Node) sendPingRetry(conn transport, addr *net.UDPAddr) {
+	retryPckt := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      0,
+			PacketNum:   0,
+			SequenceNum: 0,
+			Type:        PING_RETRY,
+			IsFinal:     1,
+		},
+		Body: node.issueCookie(addr),
+	}
+
+	node.sendUDP(conn, addr, &retryPckt)
+}
+
+// mayOpenConversation decides whether a packet for an unknown ConvID is allowed to start a conversation,
+// servers only talk to IDs they handed out, clients only talk to their server
+func (node *Node) mayOpenConversation(conversation_id uint32, addr *net.UDPAddr) bool {
+	if !node.i_am_server {
+		return node.serverAddr != nil && addr.IP.Equal(node.serverAddr.IP) && addr.Port == node.serverAddr.Port
+	}
+
+	if conversation_id == node.ConversationID() {
+		return false
+	}
+
+	node.generatedConvIDs_lock.Lock()
+	_, issued := node.generatedConvIDs[conversation_id]
+	node.generatedConvIDs_lock.Unlock()
+
+	if !issued {
+		return false
+	}
+
+	return node.ping_limiter.allow(addr.IP, node.now())
+}
+
+// sendPing asks the server for a Conversation ID, with our cookie (once we have one) and Resumption Ticket (if we have one)
+func (node *Node) sendPing(serverAddr *net.UDPAddr) {
+	node.ping_cookie_lock.Lock()
+	cookie := node.ping_cookie
+	node.ping_cookie_lock.Unlock()
+
+	ticket, proof := node.resumptionProof(serverAddr.String(), cookie)
+
+	pingBody, err := SerializePing(&PcktPing{
+		Ticket:    ticket,
+		Cookie:    cookie,
+		ClientKey: node.key_exchange.PublicKey().Bytes(),
+		Ownership: proof,
+	})
+	if err != nil {
+		return
+	}
+
+	pingPckt := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      0,
+			PacketNum:   0,
+			SequenceNum: 0,
+			Type:        PING_REQ,
+			IsFinal:     1,
+		},
+		Body: pingBody,
+	}
+
+	node.sendUDP(node.conn, serverAddr, &pingPckt)
+}
+
+// handlePingRetry keeps the cookie the server sent and pings again with it straight away
+func (node *Node) handlePingRetry(cookie []byte, addr *net.UDPAddr) {
+	// Only our server gets to hand us cookies, and only while we're still waiting for an ID
+	if node.i_am_server || node.serverAddr == nil || !addr.IP.Equal(node.serverAddr.IP) || addr.Port != node.serverAddr.Port || node.ConversationID() != 0 {
+		return
+	}
+
+	node.ping_cookie_lock.Lock()
+	node.ping_cookie = cookie
+	node.ping_cookie_lock.Unlock()
+
+	node.sendPing(node.serverAddr)
+}
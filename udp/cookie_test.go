@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// A cookie only holds for the address it was issued to, untouched, and for COOKIE_LIFETIME either side of now
+func TestCookie(t *testing.T) {
+	node := testNode(t)
+	if err := node.generateServerSecret(); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+
+	cookie := node.issueCookie(addr)
+	if err := node.verifyCookie(cookie, addr); err != nil {
+		t.Errorf("fresh cookie refused: %v", err)
+	}
+
+	if err := node.verifyCookie(cookie, &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1}); err == nil {
+		t.Error("cookie accepted from another port")
+	}
+	if err := node.verifyCookie(cookie, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: addr.Port}); err == nil {
+		t.Error("cookie accepted from another IP")
+	}
+
+	tampered := bytes.Clone(cookie)
+	tampered[len(tampered)-1] ^= 1
+	if err := node.verifyCookie(tampered, addr); err == nil {
+		t.Error("tampered cookie accepted")
+	}
+	if err := node.verifyCookie(cookie[:COOKIE_SIZE-1], addr); err == nil {
+		t.Error("short cookie accepted")
+	}
+
+	// issuedAt makes a correctly signed cookie from some other time
+	issuedAt := func(at time.Time) []byte {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, at.Unix())
+		buf.Write(node.cookieMAC(addr, at.Unix()))
+		return buf.Bytes()
+	}
+
+	if err := node.verifyCookie(issuedAt(node.now().Add(-COOKIE_LIFETIME+2*time.Second)), addr); err != nil {
+		t.Errorf("cookie about to expire refused: %v", err)
+	}
+	if err := node.verifyCookie(issuedAt(node.now().Add(-COOKIE_LIFETIME-2*time.Second)), addr); err == nil {
+		t.Error("expired cookie accepted")
+	}
+	if err := node.verifyCookie(issuedAt(node.now().Add(COOKIE_LIFETIME+2*time.Second)), addr); err == nil {
+		t.Error("cookie from the future accepted")
+	}
+
+	// Another server's secret makes another server's cookies
+	other := testNode(t)
+	if err := other.generateServerSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.verifyCookie(cookie, addr); err == nil {
+		t.Error("cookie accepted by a server that didn't issue it")
+	}
+}
+
+// Each IP gets IP_BURST at once and IP_RATE a second after that, on its own, and is forgotten once quiet
+func TestIPLimiter(t *testing.T) {
+	limiter := &ip_limiter{buckets: make(map[string]*ip_bucket)}
+	busy, quiet := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	now := time.Unix(1_000_000, 0)
+
+	for i := 0; i < IP_BURST; i++ {
+		if !limiter.allow(busy, now) {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	if limiter.allow(busy, now) {
+		t.Error("request past the burst allowed")
+	}
+	if !limiter.allow(quiet, now) {
+		t.Error("another IP was limited by the busy one")
+	}
+
+	// A second later there's IP_RATE more
+	now = now.Add(time.Second)
+	for i := 0; i < IP_RATE; i++ {
+		if !limiter.allow(busy, now) {
+			t.Fatalf("request %d after a second refused", i+1)
+		}
+	}
+	if limiter.allow(busy, now) {
+		t.Error("more than IP_RATE allowed after a second")
+	}
+
+	// Never more than the burst saved up
+	now = now.Add(time.Hour)
+	allowed := 0
+	for limiter.allow(quiet, now) {
+		allowed++
+	}
+	if allowed != IP_BURST {
+		t.Errorf("%d requests allowed after an hour's quiet, expected the burst of %d", allowed, int(IP_BURST))
+	}
+
+	// busy has been quiet for an hour, and is pruned
+	limiter.lock.Lock()
+	_, kept := limiter.buckets[busy.String()]
+	limiter.lock.Unlock()
+	if kept {
+		t.Error("IP quiet for longer than IP_LIMITER_IDLE is still remembered")
+	}
+}
@@ -0,0 +1,175 @@
+// Live web dashboard, a single embedded page following a server's referendums over Server-Sent Events
+package core
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Settings.DashboardAddr turns it on. The page polls /api/conversations for the connected nodes and
+// /api/referendums once on load, then follows /events, where a ReferendumObserver forwards every
+// referendum event as it happens: created, participants snapshotted, each ballot, the winner being called
+// and the result going out, and participants going offline. Slow browsers miss events rather than hold up
+// the node, the page catches up from /api/referendums when it reconnects. It's guarded like the admin API,
+// by the admin token if there is one and by the Host and Origin of requests.
+
+//go:embed dashboard
+var dashboard_files embed.FS
+
+// Events buffered per browser before it starts missing them
+const DASHBOARD_EVENT_BUFFER = 64
+
+// One event for the browsers
+type dashboard_event struct {
+	name string // SSE event name
+	data []byte // JSON
+}
+
+// Forwards referendum events to every browser following /events
+type dashboard_hub struct {
+	lock        sync.Mutex
+	subscribers map[chan dashboard_event]bool
+}
+
+func newDashboardHub() *dashboard_hub {
+	return &dashboard_hub{subscribers: make(map[chan dashboard_event]bool)}
+}
+
+func (hub *dashboard_hub) subscribe() chan dashboard_event {
+	events := make(chan dashboard_event, DASHBOARD_EVENT_BUFFER)
+
+	hub.lock.Lock()
+	hub.subscribers[events] = true
+	hub.lock.Unlock()
+
+	return events
+}
+
+func (hub *dashboard_hub) unsubscribe(events chan dashboard_event) {
+	hub.lock.Lock()
+	delete(hub.subscribers, events)
+	hub.lock.Unlock()
+}
+
+// publish hands an event to every browser without waiting on any of them
+func (hub *dashboard_hub) publish(name string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	event := dashboard_event{name: name, data: data}
+
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	for events := range hub.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// The hub is the dashboard's ReferendumObserver
+
+func (hub *dashboard_hub) ReferendumCreated(vote_id uuid.UUID, question string, proposer uint32) {
+	hub.publish("referendum_created", map[string]any{"vote_id": vote_id, "question": question, "proposer": proposer, "time": time.Now()})
+}
+
+func (hub *dashboard_hub) ParticipantsSnapshot(vote_id uuid.UUID, participants []uint32) {
+	hub.publish("participants", map[string]any{"vote_id": vote_id, "participants": participants})
+}
+
+func (hub *dashboard_hub) BallotReceived(vote_id uuid.UUID, voter uint32, response uint16) {
+	hub.publish("ballot", map[string]any{"vote_id": vote_id, "voter": voter, "response": response, "time": time.Now()})
+}
+
+func (hub *dashboard_hub) WinnerCalled(vote_id uuid.UUID, result uint16, early bool, tallies map[uint16]uint64) {
+	hub.publish("winner", map[string]any{"vote_id": vote_id, "result": result, "early": early, "tallies": tallies, "time": time.Now()})
+}
+
+func (hub *dashboard_hub) ResultBroadcast(vote_id uuid.UUID, result uint16, recipients int) {
+	hub.publish("result_broadcast", map[string]any{"vote_id": vote_id, "result": result, "recipients": recipients})
+}
+
+func (hub *dashboard_hub) ParticipantOffline(conversation_id uint32, ongoing []uuid.UUID) {
+	hub.publish("participant_offline", map[string]any{"conversation": conversation_id, "ongoing": ongoing})
+}
+
+// DashboardHandler serves the dashboard page, its JSON and its event stream, it starts observing the
+// node's referendums the first time it's called
+func (node *Node) DashboardHandler() http.Handler {
+	node.dashboard_once.Do(func() {
+		node.dashboard = newDashboardHub()
+		node.Observe(node.dashboard)
+	})
+	hub := node.dashboard
+
+	static, _ := fs.Sub(dashboard_files, "dashboard")
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServer(http.FS(static)))
+
+	mux.HandleFunc("GET /api/conversations", func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, http.StatusOK, node.Conversations())
+	})
+
+	mux.HandleFunc("GET /api/referendums", func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, http.StatusOK, node.Referendums())
+	})
+
+	mux.HandleFunc("GET /events", func(writer http.ResponseWriter, request *http.Request) {
+		flusher, ok := writer.(http.Flusher)
+		if !ok {
+			writeError(writer, http.StatusInternalServerError, fmt.Errorf("streaming isn't supported"))
+			return
+		}
+
+		writer.Header().Set("Content-Type", "text/event-stream")
+		writer.Header().Set("Cache-Control", "no-cache")
+		writer.Header().Set("Connection", "keep-alive")
+		writer.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		events := hub.subscribe()
+		defer hub.unsubscribe(events)
+
+		// Comments keep proxies from timing the stream out
+		keepalive := time.NewTicker(15 * time.Second)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-request.Context().Done():
+				return
+			case <-keepalive.C:
+				fmt.Fprint(writer, ": keepalive\n\n")
+			case event := <-events:
+				fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.name, event.data)
+			}
+			flusher.Flush()
+		}
+	})
+
+	return tokenFromQuery(node.guardHTTP(node.dashboard_addr, mux))
+}
+
+// tokenFromQuery takes the admin token from ?token= when there's no Authorization header, browsers can't
+// put headers on an EventSource, so the page passes along the token it was opened with
+func tokenFromQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if token := request.URL.Query().Get("token"); token != "" && request.Header.Get("Authorization") == "" {
+			request = request.Clone(request.Context())
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// The dashboard is guarded like the admin API, and takes the token from the query too, as an EventSource
+// can't send it in a header
+func TestDashboardGuard(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Log.Output = io.Discard
+	settings.DashboardAddr = "127.0.0.1:9092"
+	settings.AdminToken = "secret"
+	dashboard := newNode(settings, true).DashboardHandler()
+
+	requests := []struct {
+		name   string
+		target string
+		host   string
+		token  string
+		status int
+	}{
+		{"no token", "/api/referendums", "127.0.0.1:9092", "", http.StatusUnauthorized},
+		{"wrong token in the query", "/api/referendums?token=guess", "127.0.0.1:9092", "", http.StatusUnauthorized},
+		{"token", "/api/referendums", "127.0.0.1:9092", "secret", http.StatusOK},
+		{"token in the query", "/api/referendums?token=secret", "127.0.0.1:9092", "", http.StatusOK},
+		{"page without a token", "/", "127.0.0.1:9092", "", http.StatusUnauthorized},
+		{"rebound name", "/api/referendums?token=secret", "evil.example:9092", "", http.StatusForbidden},
+	}
+
+	for _, r := range requests {
+		request := httptest.NewRequest(http.MethodGet, r.target, nil)
+		request.Host = r.host
+		if r.token != "" {
+			request.Header.Set("Authorization", "Bearer "+r.token)
+		}
+
+		recorder := httptest.NewRecorder()
+		dashboard.ServeHTTP(recorder, request)
+		if recorder.Code != r.status {
+			t.Errorf("%s: status %d, expected %d", r.name, recorder.Code, r.status)
+		}
+	}
+}
+
+// A browser following /events is subscribed while it's connected, gets referendum events as they happen,
+// and is unsubscribed once it goes away
+func TestDashboardEvents(t *testing.T) {
+	node := testNode(t)
+	server := httptest.NewServer(node.DashboardHandler())
+	defer server.Close()
+	hub := node.dashboard
+
+	subscribers := func() int {
+		hub.lock.Lock()
+		defer hub.lock.Unlock()
+		return len(hub.subscribers)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if content_type := response.Header.Get("Content-Type"); content_type != "text/event-stream" {
+		t.Errorf("content type %q", content_type)
+	}
+
+	// The handler subscribes after the headers are out
+	waitUntil(t, "the browser to be subscribed", func() bool { return subscribers() == 1 })
+
+	vote_id := uuid.New()
+	hub.ReferendumCreated(vote_id, "(assert true)", 3)
+
+	lines := bufio.NewScanner(response.Body)
+	var event []string
+	for lines.Scan() && lines.Text() != "" {
+		event = append(event, lines.Text())
+	}
+	if len(event) != 2 || event[0] != "event: referendum_created" || !strings.Contains(event[1], vote_id.String()) {
+		t.Errorf("got event %q", event)
+	}
+
+	cancel()
+	waitUntil(t, "the browser to be unsubscribed", func() bool { return subscribers() == 0 })
+}
@@ -0,0 +1,232 @@
+// Forward Error Correction, XOR parity over groups of DATA packets
+package core
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// When both nodes advertise the fec_xor feature in their hellos, the sender follows every group of
+// DATA packets with a FEC_PARITY packet holding the XOR of the group's bodies. A receiver missing
+// exactly one packet of a group can rebuild it from the parity and the rest of the group, instead of
+// waiting for a retransmission. The parity header carries the first Packet Number of the group in
+// PacketNum and the number of packets in the group in SequenceNum. Parity that comes in with more than
+// one of its group missing (reordered ahead of it, or more was lost) is kept until the group fills in.
+
+const (
+	FEC_FLUSH_TIMEOUT = 100 * time.Millisecond // Send parity for a group that hasn't filled up after this long
+	FEC_CACHE_SPAN    = 256                    // How many Packet Numbers back received bodies are kept
+	FEC_LENGTH_SIZE   = 2                      // Each body is prefixed by its length before XORing
+)
+
+// Sender side of a parity group
+type fec_group struct {
+	start   uint32  // Packet Number of the first packet in the group
+	members []*Pckt // Packets in the group, in order
+	opened  time.Time
+}
+
+// fecGroupSize returns how many DATA packets go into one parity group for this conversation, 0 if FEC is off
+func (conv *conversation) fecGroupSize() int {
+	if conv.node.fec_group_size == 0 || !conv.hasFeature(fec_xor) {
+		return 0
+	}
+
+	// The node asking for more redundancy (the smaller group) wins
+	if asked := conv.peerFECGroupSize(); asked != 0 && asked < conv.node.fec_group_size {
+		return int(asked)
+	}
+
+	return int(conv.node.fec_group_size)
+}
+
+// addToParityGroup is called when a DATA packet goes out for the first time (the caller must hold the outgoing lock)
+func (conv *conversation) addToParityGroup(pckt *Pckt) {
+	groupSize := conv.fecGroupSize()
+	if groupSize == 0 {
+		return
+	}
+
+	group := conv.sender.fecGroup
+
+	// Packets in a group have to be consecutive, otherwise close off the old group first
+	if len(group.members) > 0 && group.start+uint32(len(group.members)) != pckt.Header.PacketNum {
+		conv.sendParity()
+	}
+
+	if len(group.members) == 0 {
+		group.start = pckt.Header.PacketNum
+		group.opened = conv.node.now()
+	}
+	group.members = append(group.members, pckt)
+
+	if len(group.members) >= groupSize {
+		conv.sendParity()
+	}
+}
+
+// flushParityGroup sends parity for a group that has been waiting too long to fill up (the caller must hold the outgoing lock)
+func (conv *conversation) flushParityGroup() {
+	if len(conv.sender.fecGroup.members) > 0 && conv.node.since(conv.sender.fecGroup.opened) > FEC_FLUSH_TIMEOUT {
+		conv.sendParity()
+	}
+}
+
+// sendParity sends the parity packet for the current group and starts a new one (the caller must hold the outgoing lock)
+func (conv *conversation) sendParity() {
+	group := conv.sender.fecGroup
+	defer func() {
+		group.members = group.members[:0]
+	}()
+
+	// Parity is as long as the biggest member plus its length prefix
+	parityLength := 0
+	for _, member := range group.members {
+		if len(member.Body)+FEC_LENGTH_SIZE > parityLength {
+			parityLength = len(member.Body) + FEC_LENGTH_SIZE
+		}
+	}
+
+	parity := make([]byte, parityLength)
+	for _, member := range group.members {
+		xorPrefixedBody(parity, member.Body)
+	}
+
+	// The length prefix makes parity a little bigger than the biggest member, skip it if that no longer fits
+	if len(parity) > conv.maxBodySize() {
+		conv.transport_log.Debug("Parity too big to send", "first_packet", group.start, "last_packet", group.start+uint32(len(group.members))-1)
+		return
+	}
+
+	parityPacket := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      conv.node.ConversationID(),
+			PacketNum:   group.start,
+			SequenceNum: uint32(len(group.members)),
+			Type:        FEC_PARITY,
+			IsFinal:     1,
+		},
+		Body: parity,
+	}
+
+	conv.sendPacket(&parityPacket)
+}
+
+// cacheForFEC remembers a received DATA body for rebuilding its neighbours (the caller must hold the incoming lock)
+func (conv *conversation) cacheForFEC(pckt *Pckt) {
+	conv.receiver.fecCache[pckt.Header.PacketNum] = pckt.Body
+
+	// Forget about packets too far behind to still be in an open group
+	if pckt.Header.PacketNum > FEC_CACHE_SPAN {
+		for pcktNum := range conv.receiver.fecCache {
+			if pcktNum < pckt.Header.PacketNum-FEC_CACHE_SPAN {
+				delete(conv.receiver.fecCache, pcktNum)
+			}
+		}
+		for start := range conv.receiver.parityCache {
+			if start < pckt.Header.PacketNum-FEC_CACHE_SPAN {
+				delete(conv.receiver.parityCache, start)
+			}
+		}
+	}
+}
+
+// retryParity tries kept parity again once a packet of its group has come in
+func (conv *conversation) retryParity(pcktNum uint32) {
+	conv.receiver.incoming_lock.Lock()
+	var parity Pckt
+	found := false
+	for start, kept := range conv.receiver.parityCache {
+		if start <= pcktNum && pcktNum-start < kept.Header.SequenceNum {
+			parity, found = kept, true
+			delete(conv.receiver.parityCache, start)
+			break
+		}
+	}
+	conv.receiver.incoming_lock.Unlock()
+
+	if found {
+		conv.receiveParity(parity)
+	}
+}
+
+// receiveParity rebuilds the one missing packet of a group, if exactly one is missing
+func (conv *conversation) receiveParity(pckt Pckt) {
+	start := pckt.Header.PacketNum
+	count := pckt.Header.SequenceNum
+
+	if count == 0 || count > FEC_CACHE_SPAN {
+		return
+	}
+
+	conv.receiver.incoming_lock.Lock()
+
+	var missing uint32
+	var numMissing int = 0
+
+	// XORing the parity with everything we have leaves the missing body
+	rebuilt := make([]byte, len(pckt.Body))
+	copy(rebuilt, pckt.Body)
+
+	for i := start; i < start+count; i++ {
+		if body, exists := conv.receiver.fecCache[i]; exists {
+			xorPrefixedBody(rebuilt, body)
+		} else {
+			missing = i
+			numMissing += 1
+		}
+	}
+
+	// Too much missing for XOR to help yet, keep it for when more of the group turns up
+	if numMissing > 1 {
+		conv.receiver.parityCache[start] = pckt
+	}
+
+	conv.receiver.incoming_lock.Unlock()
+
+	if numMissing != 1 {
+		return
+	}
+
+	if len(rebuilt) < FEC_LENGTH_SIZE {
+		return
+	}
+
+	length := int(binary.BigEndian.Uint16(rebuilt[:FEC_LENGTH_SIZE]))
+	if length > len(rebuilt)-FEC_LENGTH_SIZE {
+		conv.transport_log.Debug("Parity is inconsistent", "first_packet", start, "last_packet", start+count-1)
+		return
+	}
+
+	conv.transport_log.Debug("Rebuilt Packet from parity", "packet", missing)
+
+	// Carry on as if it had arrived, this also Acks it so the sender won't retransmit
+	conv.receiveDATA(Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			ConvID:      pckt.Header.ConvID,
+			PacketNum:   missing,
+			SequenceNum: 0,
+			Type:        DATA,
+			IsFinal:     1,
+		},
+		Body: rebuilt[FEC_LENGTH_SIZE : FEC_LENGTH_SIZE+length],
+	})
+}
+
+// xorPrefixedBody XORs a body, prefixed by its length, into dst (bodies too long for dst are cut short,
+// which only happens with a corrupt parity packet and leads to a failed length check)
+func xorPrefixedBody(dst []byte, body []byte) {
+	var prefix [FEC_LENGTH_SIZE]byte
+	binary.BigEndian.PutUint16(prefix[:], uint16(len(body)))
+
+	for i := 0; i < FEC_LENGTH_SIZE && i < len(dst); i++ {
+		dst[i] ^= prefix[i]
+	}
+
+	for i := 0; i < len(body) && FEC_LENGTH_SIZE+i < len(dst); i++ {
+		dst[FEC_LENGTH_SIZE+i] ^= body[i]
+	}
+}
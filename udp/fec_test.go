@@ -0,0 +1,197 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// fecConversation is a conversation whose ACKs go out over a memory network to nobody
+func fecConversation(t *testing.T) (*conversation, func(pckt Pckt)) {
+	t.Helper()
+
+	conv := testConversation(t)
+	conn, err := newMemoryNetwork().listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.close() })
+
+	addr := conv.address()
+	return conv, func(pckt Pckt) { conv.ARQ_Receive(conn, addr, pckt) }
+}
+
+func dataPacket(number uint32, body []byte) Pckt {
+	return Pckt{Header: PcktHeader{Magic: MAGIC_CONST, PacketNum: number, Type: DATA, IsFinal: 1}, Body: body}
+}
+
+// parityPacket is the parity a sender makes for a group starting at start
+func parityPacket(start uint32, bodies [][]byte) Pckt {
+	length := 0
+	for _, body := range bodies {
+		length = max(length, len(body)+FEC_LENGTH_SIZE)
+	}
+
+	parity := make([]byte, length)
+	for _, body := range bodies {
+		xorPrefixedBody(parity, body)
+	}
+
+	return Pckt{Header: PcktHeader{Magic: MAGIC_CONST, PacketNum: start, SequenceNum: uint32(len(bodies)), Type: FEC_PARITY, IsFinal: 1}, Body: parity}
+}
+
+// received returns the body waiting in incoming for a packet number, nil if there isn't one
+func received(conv *conversation, number uint32) []byte {
+	conv.receiver.incoming_lock.Lock()
+	defer conv.receiver.incoming_lock.Unlock()
+
+	if pckt, exists := conv.receiver.incoming[number]; exists {
+		return pckt.Body
+	}
+	return nil
+}
+
+// One lost packet of a group is rebuilt from the parity and the rest, whatever the lengths of the bodies,
+// two aren't until one of them turns up, and parity that overtakes its group waits for it
+func TestFECRebuild(t *testing.T) {
+	const start = 10
+	bodies := [][]byte{
+		[]byte("three"),
+		bytes.Repeat([]byte("forty bytes long "), 3)[:40],
+		[]byte("seven.."),
+		{},
+	}
+
+	for _, test := range []struct {
+		name        string
+		parityFirst bool
+		lost        []int // Indexes into bodies not delivered along with the rest
+		retransmit  int   // Index of a lost one delivered after the parity, -1 for none
+		rebuilt     []int // Indexes expected in incoming without having been delivered
+		notRebuilt  []int
+	}{
+		{name: "longest lost", lost: []int{1}, retransmit: -1, rebuilt: []int{1}},
+		{name: "shortest lost", lost: []int{0}, retransmit: -1, rebuilt: []int{0}},
+		{name: "empty lost", lost: []int{3}, retransmit: -1, rebuilt: []int{3}},
+		{name: "two lost", lost: []int{1, 2}, retransmit: -1, notRebuilt: []int{1, 2}},
+		{name: "two lost then one retransmitted", lost: []int{1, 2}, retransmit: 1, rebuilt: []int{2}},
+		{name: "parity first", parityFirst: true, lost: []int{2}, retransmit: -1, rebuilt: []int{2}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conv, receive := fecConversation(t)
+			lost := make(map[int]bool)
+			for _, i := range test.lost {
+				lost[i] = true
+			}
+
+			if test.parityFirst {
+				receive(parityPacket(start, bodies))
+				for i := range bodies {
+					if received(conv, start+uint32(i)) != nil {
+						t.Fatalf("packet %d made up from parity alone", i)
+					}
+				}
+			}
+			for i, body := range bodies {
+				if !lost[i] {
+					receive(dataPacket(start+uint32(i), body))
+				}
+			}
+			if !test.parityFirst {
+				receive(parityPacket(start, bodies))
+			}
+
+			if test.retransmit >= 0 {
+				for _, i := range test.lost {
+					if received(conv, start+uint32(i)) != nil {
+						t.Fatalf("packet %d rebuilt with %d of the group missing", i, len(test.lost))
+					}
+				}
+				receive(dataPacket(start+uint32(test.retransmit), bodies[test.retransmit]))
+			}
+
+			for _, i := range test.rebuilt {
+				if got := received(conv, start+uint32(i)); got == nil || !bytes.Equal(got, bodies[i]) {
+					t.Errorf("packet %d rebuilt as %q, expected %q", i, got, bodies[i])
+				}
+			}
+			for _, i := range test.notRebuilt {
+				if got := received(conv, start+uint32(i)); got != nil {
+					t.Errorf("packet %d rebuilt as %q with %d of the group missing", i, got, len(test.lost))
+				}
+			}
+
+			// Everything delivered is there untouched
+			for i, body := range bodies {
+				if !lost[i] || i == test.retransmit {
+					if got := received(conv, start+uint32(i)); !bytes.Equal(got, body) {
+						t.Errorf("packet %d is %q, expected %q", i, got, body)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Parity that doesn't add up (corrupted, or not for these bodies) rebuilds nothing
+func TestFECInconsistentParity(t *testing.T) {
+	conv, receive := fecConversation(t)
+
+	bodies := [][]byte{[]byte("a"), []byte("bb"), []byte("ccc")}
+	receive(dataPacket(0, bodies[0]))
+	receive(dataPacket(2, bodies[2]))
+
+	parity := parityPacket(0, bodies)
+	parity.Body[0] ^= 0xff // Length prefix now says far more than the parity holds
+	receive(parity)
+
+	if got := received(conv, 1); got != nil {
+		t.Errorf("rebuilt %q from bad parity", got)
+	}
+}
+
+// The sender follows each full group with the parity the receiver expects, covering the group's packets
+func TestFECSenderParity(t *testing.T) {
+	conv := testConversation(t, func(settings *Settings) { settings.Transport.FECGroupSize = 3 })
+
+	network := newMemoryNetwork()
+	local, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.close()
+	peer, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.close()
+
+	conv.heardFrom(local, peer.localAddr())
+	conv.setFeatures([]uint16{simple_eval, fec_xor}, 0)
+
+	const start = 5
+	bodies := [][]byte{[]byte("one"), []byte("a little longer"), {}}
+	conv.sender.outgoing_lock.Lock()
+	for i, body := range bodies {
+		pckt := dataPacket(start+uint32(i), body)
+		conv.addToParityGroup(&pckt)
+	}
+	conv.sender.outgoing_lock.Unlock()
+
+	raw, _, err := readOne(t, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parity, err := DeserializePacket([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := parityPacket(start, bodies)
+	if parity.Header.Type != FEC_PARITY || parity.Header.PacketNum != start || parity.Header.SequenceNum != uint32(len(bodies)) {
+		t.Errorf("parity header %+v, expected type %d from packet %d for %d packets", parity.Header, FEC_PARITY, start, len(bodies))
+	}
+	if !bytes.Equal(parity.Body, want.Body) {
+		t.Errorf("parity body %x, expected %x", parity.Body, want.Body)
+	}
+}
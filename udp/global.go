@@ -1,28 +1,31 @@
 // Version 1.3
-package main
+package core
 
 import (
-	"log"
-	"math/rand"
 	"net"
-	"sync"
+	"strings"
 	"time"
 )
 
-// This file includes all of the global variables necessary for the function of the Node
+// This file includes all of the constants and helpers shared by every Node
 
 // Global Constants ////////////////////////////////////////////////////////////////////
 
 // Types
 const (
-	DATA     uint16 = 0
-	ACK      uint16 = 1
-	NAK      uint16 = 2
-	SYN      uint16 = 3
-	SYN_ACK  uint16 = 4
-	RESET    uint16 = 5
-	PING_REQ uint16 = 0xFFFE
-	PING_RES uint16 = 0xFFFF
+	DATA       uint16 = 0
+	ACK        uint16 = 1
+	NAK        uint16 = 2
+	SYN        uint16 = 3
+	SYN_ACK    uint16 = 4
+	RESET      uint16 = 5
+	DATAGRAM   uint16 = 6      // Unreliable, never Acked or Retransmitted
+	PROBE      uint16 = 7      // Path MTU probe, padded out to the size being tested
+	PROBE_ACK  uint16 = 8      // Path MTU probe answer, carries the size received in PacketNum
+	FEC_PARITY uint16 = 9      // XOR of a group of DATA packets, covers PacketNum onwards for SequenceNum packets
+	PING_RETRY uint16 = 0xFFFD // Answer to a Ping without a valid cookie, carries one to ping again with
+	PING_REQ   uint16 = 0xFFFE
+	PING_RES   uint16 = 0xFFFF
 )
 
 // Responses
@@ -33,6 +36,12 @@ const (
 	TIMEOUT      uint16 = 3
 )
 
+// How a referendum still open at its deadline is closed
+const (
+	TIMEOUT_POLICY_PLURALITY = "plurality" // The response with the most ballots cast wins, TIMEOUT if nobody voted
+	TIMEOUT_POLICY_TIMEOUT   = "timeout"   // The result is TIMEOUT whatever was cast
+)
+
 // Data IDs
 const (
 	hello_c2s                     uint16 = 0 // from client to server, basically SYN
@@ -41,118 +50,121 @@ const (
 	vote_s2c_broadcast_question   uint16 = 3 // from server to all clients to vote on
 	vote_c2s_response_to_question uint16 = 4 // from client to server
 	vote_s2c_broadcast_result     uint16 = 5 // from server to all clients
+	vote_s2c_tally_update         uint16 = 6 // from server to all clients
+	resumption_ticket_s2c         uint16 = 7 // from server to client, lets it resume its conversation after a restart
+	vote_s2c_verdict              uint16 = 8 // from server to the client that proposed a referendum, the result with its final tally
 )
 
 // Features
 const (
 	none        uint16 = 0
 	simple_eval uint16 = 1
+	fec_xor     uint16 = 4 // Forward Error Correction with XOR parity packets
 )
 
 const MAGIC_CONST = 0x01051117
 
+// Body size every path is assumed to carry, conversations raise their own limit with Path MTU Discovery
 const MAX_PCKT_SIZE = 250
 
+// Longest question a referendum takes, what's left of MAX_PCKT_SIZE after a vote request's other fields
+// (Data ID, Vote ID, Question Length and Deadline), so it reaches every client whatever their path
+const MAX_QUESTION_SIZE = MAX_PCKT_SIZE - 2 - 16 - 4 - 4
+
+const PCKT_HEADER_SIZE = 24
+
+const LISTEN_BUFFER_SIZE = 8192
+
 // Returns MAGIC_CONST in Big Endian Bytes
 func MAGIC_BYTES_CONST() []byte {
 	return []byte{byte(1), byte(5), byte(17), byte(23)}
 }
 
-const SERVER_PORT_CONST = "8080"
-
-// Global Objects
-var (
-	i_am_server           bool
-	debug_mode            bool
-	loss_constant         float64
-	duplicates_mode       uint64
-	defect_constant       float64
-	serverAddr            *net.UDPAddr
-	conn                  *net.UDPConn
-	conversation_id_self  uint32 = 0
-	conversations_lock    sync.Mutex
-	conversations         map[uint32]*conversation = make(map[uint32]*conversation)
-	generatedConvIDs_lock sync.Mutex
-	generatedConvIDs      map[uint32]bool = make(map[uint32]bool)
-	globalWaitGroup       sync.WaitGroup
-	ref_manager           *referendum_manager = newReferendumManager()
-	my_features           []uint16
-)
+const SERVER_PORT_CONST = "8080" // Default for Settings.Port
+
+const CLEAN_INTERVAL = 50 * time.Millisecond // How often the cleaner looks for quiet conversations
+
+// withDefaultPort turns "host", "host:port", "IPv6", "[IPv6]" or "[IPv6]:port" into a host:port, adding
+// port when there isn't one
+func withDefaultPort(input string, port string) string {
+	if host, port, err := net.SplitHostPort(input); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(input, "["), "]")
+	return net.JoinHostPort(host, port)
+}
 
-func generateConversationID() uint32 {
+// generateConversationID picks an unused Conversation ID (the caller must hold the generatedConvIDs lock)
+func (node *Node) generateConversationID() uint32 {
 	var newConversationID uint32 = 0
 
-	_, exists := generatedConvIDs[newConversationID]
+	_, exists := node.generatedConvIDs[newConversationID]
 
 	// keep generating until unique
 	for newConversationID == 0 || exists {
-		newConversationID = rand.Uint32()
-		_, exists = generatedConvIDs[newConversationID]
+		newConversationID = node.rng.Uint32()
+		_, exists = node.generatedConvIDs[newConversationID]
 	}
 
 	// Save into history bank
-	generatedConvIDs[newConversationID] = true
+	node.generatedConvIDs[newConversationID] = true
 
 	return newConversationID
 }
 
 // Global Functions
-func sendUDP(addr *net.UDPAddr, pckt *Pckt) error {
+
+// sendUDP sends a packet to addr through conn, connected sockets (a client's) always send to their server
+func (node *Node) sendUDP(conn transport, addr *net.UDPAddr, pckt *Pckt) error {
 	// Serialize Packet
 	pckt_bytes, err := SerializePacket(pckt)
 	if err != nil {
-		if debug_mode {
-			log.Printf("Error Serializing Packet %d: %d", pckt.Header.PacketNum, pckt.Header.SequenceNum)
-		}
+		node.transport_log.Error("Error Serializing Packet", "conversation", pckt.Header.ConvID, "packet", pckt.Header.PacketNum, "seq", pckt.Header.SequenceNum, "err", err)
 		return err
 	}
 
 	// Generate Checksum
 	checksum_bytes, err := ComputeChecksum(pckt_bytes)
 	if err != nil {
-		if debug_mode {
-			log.Printf("Error generating checksum for Packet %d: %d", pckt.Header.PacketNum, pckt.Header.SequenceNum)
-		}
+		node.transport_log.Error("Error generating checksum", "conversation", pckt.Header.ConvID, "packet", pckt.Header.PacketNum, "seq", pckt.Header.SequenceNum, "err", err)
 		return err
 	}
 
 	// Insert Checksum into the checksum field of the packet_bytes
 	copy(pckt_bytes[4:8], checksum_bytes[:4])
+	node.metrics.packets_sent.add(pckt.Header.Type)
 
-	// Send it off over UDP, with chance of loss
-	if loss_constant <= rand.Float64() {
-		for i := uint64(0); i <= duplicates_mode; i++ {
-			if i_am_server {
-				if _, err := conn.WriteTo(pckt_bytes, addr); err != nil {
-					if debug_mode {
-						log.Printf("Error sending packet %d: %d", pckt.Header.PacketNum, pckt.Header.SequenceNum)
-					}
-					return err
-				}
-			} else {
-				if _, err := conn.Write(pckt_bytes); err != nil {
-					if debug_mode {
-						log.Printf("Error sending packet %d: %d", pckt.Header.PacketNum, pckt.Header.SequenceNum)
-					}
-					return err
-				}
-			}
-		}
+	// Send it off, through whatever impairments are set up
+	if err := conn.writeTo(pckt_bytes, addr); err != nil {
+		node.transport_log.Debug("Error sending packet", "conversation", pckt.Header.ConvID, "packet", pckt.Header.PacketNum, "seq", pckt.Header.SequenceNum, "err", err)
+		return err
 	}
 
 	return nil
 }
 
 // Clean Conversations Map for offline conversations
-func cleaner() {
-	for true {
-		time.Sleep(50 * time.Millisecond)
-
-		for _, conv := range conversations {
-			if time.Since(conv.LastOnline) > 5000*time.Millisecond && conv.missedSYNs > 100 && conv.online {
-				log.Printf("\n\nSetting Conversation ID: %d to Offline due to inactivity.\n\n", conv.conversation_id)
-				conv.online = false
+func (node *Node) cleaner() {
+	for node.sleep(CLEAN_INTERVAL) {
+		node.clean()
+	}
+}
+
+// clean is one round of the cleaner
+func (node *Node) clean() {
+	for _, conv := range node.conversationsSnapshot() {
+		if conv.goneQuiet() {
+			conv.transport_log.Info("Conversation Offline due to inactivity")
+
+			// Let observers know who won't be voting
+			if node.i_am_server {
+				node.ref_manager.participant_offline(conv)
 			}
+		} else if node.i_am_server && !conv.isOnline() && node.since(conv.lastSeen()) > TICKET_LIFETIME {
+			// Every ticket it was handed has expired, nothing can bring it back
+			conv.transport_log.Info("Forgetting offline Conversation, its tickets have expired")
+			node.forgetConversation(conv)
 		}
 	}
 }
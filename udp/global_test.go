@@ -0,0 +1,24 @@
+package core
+
+import "testing"
+
+// Hosts get the default port, anything with a port of its own keeps it, and IPv6 comes out bracketed
+func TestWithDefaultPort(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		want  string
+	}{
+		{"host", "host:7000"},
+		{"host:9000", "host:9000"},
+		{"127.0.0.1", "127.0.0.1:7000"},
+		{"127.0.0.1:9000", "127.0.0.1:9000"},
+		{"::1", "[::1]:7000"},
+		{"[::1]", "[::1]:7000"},
+		{"[::1]:9000", "[::1]:9000"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:7000"},
+	} {
+		if got := withDefaultPort(test.input, "7000"); got != test.want {
+			t.Errorf("%q gave %q, expected %q", test.input, got, test.want)
+		}
+	}
+}
@@ -5,3 +5,8 @@ go 1.22.0
 require github.com/google/uuid v1.6.0
 
 require github.com/expr-lang/expr v1.16.3
+
+require (
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.20.0 // indirect
+)
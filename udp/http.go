@@ -0,0 +1,51 @@
+// HTTP endpoints a node serves next to its UDP sockets, each at its own address
+package core
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startHTTP serves handler at addr until the node is closed, name is for the logs
+func (node *Node) startHTTP(name string, addr string, handler http.Handler) {
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+
+	node.http_lock.Lock()
+	node.http_servers = append(node.http_servers, server)
+	node.http_lock.Unlock()
+
+	go func() {
+		node.transport_log.Info("Serving "+name, "addr", addr)
+
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			node.transport_log.Error("Couldn't serve "+name, "addr", addr, "err", err)
+		}
+	}()
+}
+
+// isLoopback checks an address ("host:port") can only be reached from this machine
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// closeHTTP stops every HTTP server the node started
+func (node *Node) closeHTTP() {
+	node.http_lock.Lock()
+	defer node.http_lock.Unlock()
+
+	for _, server := range node.http_servers {
+		server.Close()
+	}
+	node.http_servers = nil
+}
@@ -0,0 +1,338 @@
+// Network impairment emulator, a transport wrapper that makes the network as bad as asked
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every transport a node uses is wrapped in an impaired_transport. Each datagram is looked up in the
+// impairments table by the peer it goes to (or comes from), first by IP and port, then by IP alone, then
+// falling back to the default profile. Outgoing datagrams can be lost, duplicated, delayed (a base latency
+// plus normally distributed jitter), held back so later ones overtake them, or have a bit flipped (which the
+// checksum check on the other end should catch). Incoming datagrams can be lost or corrupted too, with their
+// own odds. While a scheduled partition is in effect nothing gets through in either direction.
+
+const REORDER_HOLD = 25 * time.Millisecond // Extra delay for a datagram picked to be reordered
+
+// How the network behaves towards one peer
+type impairment_profile struct {
+	Loss       float64       // Chance an outgoing datagram is dropped
+	LossIn     float64       // Chance an incoming datagram is dropped
+	Duplicates uint64        // Extra copies sent of each datagram
+	Latency    time.Duration // Base one way delay
+	Jitter     time.Duration // Standard deviation of the delay on top of Latency
+	Reorder    float64       // Chance a datagram is held back by REORDER_HOLD, letting later ones overtake it
+	Corrupt    float64       // Chance an outgoing datagram gets a bit flipped
+	CorruptIn  float64       // Chance an incoming datagram gets a bit flipped
+	Partitions []impairment_partition
+}
+
+// A time window when the peer can't be reached at all
+type impairment_partition struct {
+	from  time.Time
+	until time.Time
+}
+
+// Profiles by peer, "" is the default, each node has its own
+type impairment_table struct {
+	lock     sync.RWMutex
+	profiles map[string]impairment_profile
+}
+
+// profileFor returns the profile for a peer
+func (table *impairment_table) profileFor(addr *net.UDPAddr) impairment_profile {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	if addr != nil {
+		if profile, exists := table.profiles[addr.String()]; exists {
+			return profile
+		}
+		if profile, exists := table.profiles[addr.IP.String()]; exists {
+			return profile
+		}
+	}
+
+	return table.profiles[""]
+}
+
+// set replaces the profile for a peer ("" for the default)
+func (table *impairment_table) set(peer string, profile impairment_profile) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	table.profiles[peer] = profile
+}
+
+// update changes the profile for a peer in place, starting from the default if it doesn't have one yet
+func (table *impairment_table) update(peer string, change func(profile *impairment_profile)) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	profile, exists := table.profiles[peer]
+	if !exists {
+		profile = table.profiles[""]
+		profile.Partitions = nil
+	}
+
+	change(&profile)
+	table.profiles[peer] = profile
+}
+
+// remove drops a peer's profile, so the default applies to it again
+func (table *impairment_table) remove(peer string) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	delete(table.profiles, peer)
+}
+
+// snapshot lists every profile by peer ("" for the default), for the admin API
+func (table *impairment_table) snapshot() map[string]string {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	profiles := make(map[string]string, len(table.profiles))
+	for peer, profile := range table.profiles {
+		profiles[peer] = profile.String()
+	}
+	return profiles
+}
+
+// String lists every profile, for the CLI
+func (table *impairment_table) String() string {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	var out strings.Builder
+	for peer, profile := range table.profiles {
+		if peer == "" {
+			peer = "default"
+		}
+		fmt.Fprintf(&out, "%s: %s\n", peer, profile)
+	}
+	return out.String()
+}
+
+func (profile impairment_profile) String() string {
+	out := fmt.Sprintf("loss=%g loss_in=%g duplicates=%d latency=%s jitter=%s reorder=%g corrupt=%g corrupt_in=%g",
+		profile.Loss, profile.LossIn, profile.Duplicates, profile.Latency, profile.Jitter, profile.Reorder, profile.Corrupt, profile.CorruptIn)
+
+	for _, partition := range profile.Partitions {
+		if time.Now().Before(partition.until) {
+			out += fmt.Sprintf(" partition=%s-%s", partition.from.Format(time.TimeOnly), partition.until.Format(time.TimeOnly))
+		}
+	}
+
+	return out
+}
+
+// partitioned checks whether a partition is in effect at now
+func (profile impairment_profile) partitioned(now time.Time) bool {
+	for _, partition := range profile.Partitions {
+		if !now.Before(partition.from) && now.Before(partition.until) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay picks how long a datagram takes
+func (profile impairment_profile) delay(rng *rand.Rand) time.Duration {
+	delay := profile.Latency
+	if profile.Jitter > 0 {
+		delay += time.Duration(rng.NormFloat64() * float64(profile.Jitter))
+	}
+	if chance(rng, profile.Reorder) {
+		delay += REORDER_HOLD
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// chance returns true with probability p
+func chance(rng *rand.Rand, p float64) bool {
+	return p > 0 && rng.Float64() < p
+}
+
+// corrupt flips a random bit in a datagram with probability p
+func corrupt(rng *rand.Rand, data []byte, p float64) {
+	if len(data) > 0 && chance(rng, p) {
+		bit := rng.Intn(len(data) * 8)
+		data[bit/8] ^= 1 << (bit % 8)
+	}
+}
+
+// applyImpairment parses settings like "loss=0.2 loss_in=0.1 latency=50ms jitter=10ms reorder=0.1 corrupt=0.01
+// corrupt_in=0.01 duplicates=1 partition=5s+10s" (a partition starting in 5s, lasting 10s, "partition=off"
+// clears them) into a profile, partitions start counting from now
+func applyImpairment(profile *impairment_profile, settings string, now time.Time) error {
+	for _, setting := range strings.Fields(settings) {
+		name, value, found := strings.Cut(setting, "=")
+		if !found {
+			return fmt.Errorf("expected name=value, got %q", setting)
+		}
+
+		var err error
+		switch name {
+		case "loss":
+			profile.Loss, err = parseChance(value)
+		case "loss_in":
+			profile.LossIn, err = parseChance(value)
+		case "reorder":
+			profile.Reorder, err = parseChance(value)
+		case "corrupt":
+			profile.Corrupt, err = parseChance(value)
+		case "corrupt_in":
+			profile.CorruptIn, err = parseChance(value)
+		case "duplicates":
+			profile.Duplicates, err = strconv.ParseUint(value, 10, 8)
+		case "latency":
+			profile.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			profile.Jitter, err = time.ParseDuration(value)
+		case "partition":
+			if value == "off" {
+				profile.Partitions = nil
+				break
+			}
+
+			start, length, found := strings.Cut(value, "+")
+			if !found {
+				return fmt.Errorf("partition should be start+length, e.g. 5s+10s")
+			}
+
+			var startIn, lasting time.Duration
+			if startIn, err = time.ParseDuration(start); err != nil {
+				break
+			}
+			if lasting, err = time.ParseDuration(length); err != nil {
+				break
+			}
+
+			from := now.Add(startIn)
+			profile.Partitions = append(profile.Partitions, impairment_partition{from: from, until: from.Add(lasting)})
+		default:
+			return fmt.Errorf("unknown setting %q", name)
+		}
+
+		if err != nil {
+			return fmt.Errorf("bad value for %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// parseChance parses a probability between 0 and 1
+func parseChance(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("%g isn't between 0 and 1", p)
+	}
+	return p, nil
+}
+
+// A transport behind an impaired network, impaired as its node's table says
+type impaired_transport struct {
+	inner transport
+	node  *Node
+}
+
+func newImpairedTransport(inner transport, node *Node) *impaired_transport {
+	return &impaired_transport{inner: inner, node: node}
+}
+
+// readBatch drops and corrupts incoming datagrams according to their sender's profile
+func (impaired *impaired_transport) readBatch(buffers []*[]byte, lengths []int, addrs []*net.UDPAddr) (int, error) {
+	for {
+		received, err := impaired.inner.readBatch(buffers, lengths, addrs)
+		if err != nil {
+			return 0, err
+		}
+
+		// Keep the survivors at the front
+		kept := 0
+		for i := 0; i < received; i++ {
+			if !impaired.admit((*buffers[i])[:lengths[i]], addrs[i]) {
+				continue
+			}
+
+			buffers[kept], buffers[i] = buffers[i], buffers[kept]
+			lengths[kept], addrs[kept] = lengths[i], addrs[i]
+			kept += 1
+		}
+
+		if kept > 0 {
+			return kept, nil
+		}
+	}
+}
+
+// admit decides whether an incoming datagram makes it through, maybe corrupting it on the way
+func (impaired *impaired_transport) admit(data []byte, addr *net.UDPAddr) bool {
+	profile := impaired.node.impairments.profileFor(addr)
+	rng := impaired.node.randFor(addr)
+
+	if profile.partitioned(impaired.node.now()) || chance(rng, profile.LossIn) {
+		return false
+	}
+	corrupt(rng, data, profile.CorruptIn)
+
+	return true
+}
+
+// writeTo sends a datagram (and its duplicates) unless it's lost, after its delay, maybe corrupted
+func (impaired *impaired_transport) writeTo(data []byte, addr *net.UDPAddr) error {
+	profile := impaired.node.impairments.profileFor(addr)
+	rng := impaired.node.randFor(addr)
+
+	for i := uint64(0); i <= profile.Duplicates; i++ {
+		if profile.partitioned(impaired.node.now()) || chance(rng, profile.Loss) {
+			continue
+		}
+
+		datagram := data
+		if profile.Corrupt > 0 {
+			datagram = append([]byte(nil), data...)
+			corrupt(rng, datagram, profile.Corrupt)
+		}
+
+		delay := profile.delay(rng)
+		if delay == 0 {
+			// Straight through, so errors (like a datagram too big for the interface) reach the sender
+			if err := impaired.inner.writeTo(datagram, addr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		datagram = append([]byte(nil), datagram...)
+		impaired.node.after(delay, "to "+addr.String(), func() {
+			if err := impaired.inner.writeTo(datagram, addr); err != nil {
+				impaired.node.transport_log.Debug("Error sending delayed datagram", "addr", addr, "err", err)
+			}
+		})
+	}
+
+	return nil
+}
+
+func (impaired *impaired_transport) localAddr() *net.UDPAddr {
+	return impaired.inner.localAddr()
+}
+
+func (impaired *impaired_transport) close() error {
+	return impaired.inner.close()
+}
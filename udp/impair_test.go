@@ -0,0 +1,195 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Settings apply on top of the profile, and a bad one leaves an error naming it
+func TestApplyImpairment(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	good := []struct {
+		settings string
+		want     impairment_profile
+	}{
+		{"", impairment_profile{}},
+		{"loss=0.1 loss_in=0.2", impairment_profile{Loss: 0.1, LossIn: 0.2}},
+		{"reorder=1 corrupt=0 corrupt_in=0.5", impairment_profile{Reorder: 1, CorruptIn: 0.5}},
+		{"duplicates=3", impairment_profile{Duplicates: 3}},
+		{"latency=50ms   jitter=5ms", impairment_profile{Latency: 50 * time.Millisecond, Jitter: 5 * time.Millisecond}},
+	}
+	for _, test := range good {
+		var profile impairment_profile
+		if err := applyImpairment(&profile, test.settings, now); err != nil {
+			t.Errorf("%q: %v", test.settings, err)
+			continue
+		}
+		if profile.String() != test.want.String() {
+			t.Errorf("%q gave %s, want %s", test.settings, profile, test.want)
+		}
+	}
+
+	bad := []string{
+		"loss",
+		"loss=",
+		"loss=x",
+		"loss=1.5",
+		"loss_in=-0.1",
+		"duplicates=256",
+		"duplicates=-1",
+		"latency=50",
+		"jitter=fast",
+		"partition=5s",
+		"partition=x+5s",
+		"partition=5s+x",
+		"bandwidth=1mbit",
+	}
+	for _, settings := range bad {
+		var profile impairment_profile
+		if err := applyImpairment(&profile, settings, now); err == nil {
+			t.Errorf("%q accepted", settings)
+		}
+	}
+
+	// Later settings only change what they name
+	profile := impairment_profile{Loss: 0.3, Latency: time.Second}
+	if err := applyImpairment(&profile, "latency=10ms loss=0.5", now); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Loss != 0.5 || profile.Latency != 10*time.Millisecond {
+		t.Errorf("got loss=%g latency=%s", profile.Loss, profile.Latency)
+	}
+	if err := applyImpairment(&profile, "jitter=1ms", now); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Loss != 0.5 || profile.Latency != 10*time.Millisecond || profile.Jitter != time.Millisecond {
+		t.Errorf("jitter changed the rest: %s", profile)
+	}
+
+	// Partitions are relative to now, add up, and off clears them all
+	if err := applyImpairment(&profile, "partition=5s+10s partition=1m+1s", now); err != nil {
+		t.Fatal(err)
+	}
+	want := []impairment_partition{
+		{from: now.Add(5 * time.Second), until: now.Add(15 * time.Second)},
+		{from: now.Add(time.Minute), until: now.Add(time.Minute + time.Second)},
+	}
+	if len(profile.Partitions) != len(want) {
+		t.Fatalf("got %d partitions, want %d", len(profile.Partitions), len(want))
+	}
+	for i, partition := range profile.Partitions {
+		if !partition.from.Equal(want[i].from) || !partition.until.Equal(want[i].until) {
+			t.Errorf("partition %d is %s-%s, want %s-%s", i, partition.from, partition.until, want[i].from, want[i].until)
+		}
+	}
+	if err := applyImpairment(&profile, "partition=off", now); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Partitions != nil {
+		t.Errorf("partition=off left %d partitions", len(profile.Partitions))
+	}
+}
+
+// A partition covers [from, until), and while it lasts nothing goes either way
+func TestImpairmentPartition(t *testing.T) {
+	now := time.Now()
+
+	var profile impairment_profile
+	if err := applyImpairment(&profile, "partition=5s+10s", now); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, false},
+		{5*time.Second - time.Nanosecond, false},
+		{5 * time.Second, true},
+		{15*time.Second - time.Nanosecond, true},
+		{15 * time.Second, false},
+	} {
+		if got := profile.partitioned(now.Add(test.at)); got != test.want {
+			t.Errorf("partitioned %s in = %v, want %v", test.at, got, test.want)
+		}
+	}
+
+	// A peer's own address beats its IP, which beats the default
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7000}
+	neighbour := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7001}
+	stranger := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 7000}
+
+	table := &impairment_table{profiles: make(map[string]impairment_profile)}
+	table.set("", impairment_profile{Loss: 0.1})
+	table.set("10.0.0.2", impairment_profile{Loss: 0.2})
+	table.set(peer.String(), impairment_profile{Loss: 0.3})
+	for _, test := range []struct {
+		addr *net.UDPAddr
+		want float64
+	}{
+		{peer, 0.3},
+		{neighbour, 0.2},
+		{stranger, 0.1},
+		{nil, 0.1},
+	} {
+		if got := table.profileFor(test.addr).Loss; got != test.want {
+			t.Errorf("%v got loss %g, want %g", test.addr, got, test.want)
+		}
+	}
+
+	// Through the transport: a partitioned peer neither gets nor sends anything, the others are untouched
+	network := newMemoryNetwork()
+	node := testNode(t)
+	inner, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	impaired := newImpairedTransport(inner, node)
+	defer impaired.close()
+
+	cut, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cut.close()
+	open, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.close()
+
+	if err := node.SetImpairment(cut.localAddr().String(), "partition=0s+1h"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := impaired.writeTo([]byte("dropped"), cut.localAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := impaired.writeTo([]byte("through"), open.localAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := readOne(t, open); err != nil || data != "through" {
+		t.Errorf("open peer got %q, %v", data, err)
+	}
+	select {
+	case datagram := <-cut.inbox:
+		t.Errorf("partitioned peer got %q", datagram.data)
+	default:
+	}
+
+	if !impaired.admit([]byte("in"), open.localAddr()) {
+		t.Error("datagram from the open peer dropped")
+	}
+	if impaired.admit([]byte("in"), cut.localAddr()) {
+		t.Error("datagram from the partitioned peer admitted")
+	}
+
+	// Lifting the partition lets the peer through again
+	if err := node.SetImpairment(cut.localAddr().String(), "partition=off"); err != nil {
+		t.Fatal(err)
+	}
+	if !impaired.admit([]byte("in"), cut.localAddr()) {
+		t.Error("datagram dropped after partition=off")
+	}
+}
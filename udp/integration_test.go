@@ -0,0 +1,563 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Loopback integration tests, a real server and clients talking UDP over 127.0.0.1 on random ports,
+// meant to be run with go test -race
+
+const LOOPBACK_CLIENTS = 5
+
+const LOOPBACK_TIMEOUT = 30 * time.Second // However long anything is waited for
+
+// A server and its clients on loopback
+type loopback struct {
+	server         *Node
+	clients        []*Node
+	settings       []Settings // Each client's, to restart it with
+	serverSettings Settings   // The server's, likewise
+	impaired       bool       // Results can overtake their question
+}
+
+// loopbackSettings are quiet, quick to connect, and impaired towards every peer, with Forward Error
+// Correction on whenever there's loss for it to make up for
+func loopbackSettings(t *testing.T, impairment string) Settings {
+	settings := DefaultSettings()
+	settings.Log.Output = io.Discard
+	settings.Impairment = impairment
+	if impairment != "" {
+		settings.Transport.FECGroupSize = 4
+	}
+	settings.TicketPath = filepath.Join(t.TempDir(), "ticket")
+	settings.Transport.PingInterval = Duration(50 * time.Millisecond)
+	return settings
+}
+
+// waitUntil checks done until it's true, failing the test if it isn't within LOOPBACK_TIMEOUT
+func waitUntil(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(LOOPBACK_TIMEOUT)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startLoopback starts a server on a random port and connects clients to it, returning once the server
+// has heard every client's hello, everything is closed when the test ends
+func startLoopback(t *testing.T, clients int, impairment string) *loopback {
+	t.Helper()
+
+	settings := loopbackSettings(t, impairment)
+	settings.Listen = []string{"127.0.0.1:0"}
+	settings.StatePath = filepath.Join(t.TempDir(), "state")
+
+	server, err := NewServer(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	t.Cleanup(func() { server.Close() })
+
+	network := &loopback{server: server, serverSettings: settings, impaired: impairment != ""}
+	connected := make(chan error, clients)
+
+	for i := 0; i < clients; i++ {
+		settings := loopbackSettings(t, impairment)
+		settings.Server = server.listen_conns[0].localAddr().String()
+
+		client := startClient(t, settings)
+		go func() { connected <- client.Connect() }()
+		network.clients = append(network.clients, client)
+		network.settings = append(network.settings, settings)
+	}
+
+	for i := 0; i < clients; i++ {
+		select {
+		case err := <-connected:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(LOOPBACK_TIMEOUT):
+			t.Fatal("timed out waiting for clients to connect")
+		}
+	}
+
+	waitUntil(t, "every client's hello", func() bool { return network.voters() == clients })
+	return network
+}
+
+// startClient runs a client, it's closed when the test ends
+func startClient(t *testing.T, settings Settings) *Node {
+	t.Helper()
+
+	client, err := NewClient(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// voters counts the conversations the server would ask in a referendum
+func (network *loopback) voters() int {
+	voters := 0
+	for _, conv := range network.server.conversationsSnapshot() {
+		if conv.isOnline() && conv.hasFeature(simple_eval) {
+			voters++
+		}
+	}
+	return voters
+}
+
+// propose has the first client propose question and waits for the verdict
+func (network *loopback) propose(t *testing.T, question string) Verdict {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), LOOPBACK_TIMEOUT)
+	defer cancel()
+
+	verdict, err := network.clients[0].Propose(ctx, question)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verdict
+}
+
+// allHold waits for the clients (every one if none are given) to hold result as the final result of a
+// referendum, on an impaired network a client whose question was overtaken by the result only has its own
+// ballot, so there it just has to match and no client may hold another final result
+func (network *loopback) allHold(t *testing.T, verdict Verdict, result uint16, voters ...int) {
+	t.Helper()
+
+	if len(voters) == 0 {
+		for i := range network.clients {
+			voters = append(voters, i)
+		}
+	}
+
+	waitUntil(t, "every client to hold the result", func() bool {
+		for _, i := range voters {
+			held, final, _ := network.clients[i].ref_manager.clientResult(verdict.VoteID)
+			if held != result || (!final && !network.impaired) {
+				return false
+			}
+		}
+		return true
+	})
+
+	for i, client := range network.clients {
+		if held, final, _ := client.ref_manager.clientResult(verdict.VoteID); final && held != result {
+			t.Errorf("client %d: final result %d, expected %d", i, held, result)
+		}
+	}
+}
+
+// Every client gets its own Conversation ID, and both ends learn each other's features from the hellos
+func TestLoopbackConnect(t *testing.T) {
+	network := startLoopback(t, LOOPBACK_CLIENTS, "")
+
+	ids := map[uint32]bool{network.server.ConversationID(): true}
+	for i, client := range network.clients {
+		id := client.ConversationID()
+		if id == 0 || ids[id] {
+			t.Fatalf("client %d got Conversation ID %d, already taken or none", i, id)
+		}
+		ids[id] = true
+
+		server := client.server()
+		if server == nil || server.conversation_id != network.server.ConversationID() {
+			t.Fatalf("client %d has no conversation with the server", i)
+		}
+		waitUntil(t, "the hello back", func() bool { return server.hasFeature(simple_eval) && !server.hasFeature(fec_xor) })
+	}
+
+	for _, conv := range network.server.conversationsSnapshot() {
+		if !ids[conv.conversation_id] {
+			t.Errorf("server has a conversation %d it never handed out", conv.conversation_id)
+		}
+		if !conv.hasFeature(simple_eval) {
+			t.Errorf("server didn't learn conversation %d's features", conv.conversation_id)
+		}
+		if conv.hasFeature(fec_xor) {
+			t.Errorf("conversation %d advertised FEC, which is off by default", conv.conversation_id)
+		}
+	}
+}
+
+// A question reaches every client, and the verdict is called before every ballot is in,
+// on a clean network and on a bad one
+func TestLoopbackVote(t *testing.T) {
+	scenarios := []struct {
+		name       string
+		impairment string
+	}{
+		{"clean", ""},
+		{"loss", "loss=0.2"},
+		{"duplicates", "duplicates=1"},
+		{"loss and duplicates", "loss=0.2 duplicates=1"},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			network := startLoopback(t, LOOPBACK_CLIENTS, scenario.impairment)
+			verdict := network.propose(t, "2 * 2 == 4 && 10 > 3")
+
+			if verdict.Result != SAT {
+				t.Errorf("result %d, expected SAT", verdict.Result)
+			}
+			if verdict.Participants != LOOPBACK_CLIENTS {
+				t.Errorf("%d participants, expected %d", verdict.Participants, LOOPBACK_CLIENTS)
+			}
+			if cast := verdict.Tallies[SAT] + verdict.Tallies[UNSAT]; cast >= LOOPBACK_CLIENTS {
+				t.Errorf("verdict after all %d ballots, expected it called early", cast)
+			}
+
+			network.allHold(t, verdict, SAT)
+		})
+	}
+}
+
+// A defecting client is outvoted, and on a clean network the server's result overwrites its answer
+func TestLoopbackDefectors(t *testing.T) {
+	scenarios := []struct {
+		name       string
+		impairment string
+	}{
+		{"clean", ""},
+		{"loss and duplicates", "loss=0.2 duplicates=1"},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			network := startLoopback(t, LOOPBACK_CLIENTS, scenario.impairment)
+
+			// One of five always flips its answer
+			defectors := network.clients[1:2]
+			for _, client := range defectors {
+				if err := client.SetDefectChance(1); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			verdict := network.propose(t, "3 < 1")
+
+			if verdict.Result != UNSAT {
+				t.Errorf("result %d, expected UNSAT", verdict.Result)
+			}
+			if network.impaired {
+				network.allHold(t, verdict, UNSAT, 0, 2, 3, 4)
+			} else {
+				network.allHold(t, verdict, UNSAT)
+			}
+
+			for i, client := range defectors {
+				if _, _, asked := client.ref_manager.clientResult(verdict.VoteID); !asked {
+					t.Errorf("defector %d was never asked", i)
+				}
+			}
+		})
+	}
+}
+
+// conversation returns the server's conversation with a Conversation ID
+func (network *loopback) conversation(t *testing.T, id uint32) *conversation {
+	t.Helper()
+
+	for _, conv := range network.server.conversationsSnapshot() {
+		if conv.conversation_id == id {
+			return conv
+		}
+	}
+	t.Fatalf("server has no conversation %d", id)
+	return nil
+}
+
+// A client that shuts down cleanly comes back to its conversation with its ticket, and votes again, with
+// the server numbering what it sends from 0 again like the restarted client does
+func TestLoopbackShutdownResume(t *testing.T) {
+	network := startLoopback(t, LOOPBACK_CLIENTS, "")
+	client := network.clients[0]
+	id := client.ConversationID()
+
+	waitUntil(t, "the resumption ticket", func() bool { return client.loadTicket(client.serverAddr.String()) != nil })
+
+	// Get the server well into its numbering first
+	for i := 0; i < 3; i++ {
+		network.allHold(t, network.propose(t, "1 + 1 == 2"), SAT)
+	}
+	conv := network.conversation(t, id)
+	conv.sender.outgoing_lock.Lock()
+	sent := conv.sender.nextPcktNum
+	conv.sender.outgoing_lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), LOOPBACK_TIMEOUT)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	waitUntil(t, "the server to mark it offline", func() bool { return network.voters() == LOOPBACK_CLIENTS-1 })
+	if len(network.server.conversationsSnapshot()) != LOOPBACK_CLIENTS {
+		t.Fatal("server forgot the conversation of a client that closed it")
+	}
+
+	restarted := startClient(t, network.settings[0])
+	if err := restarted.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.ConversationID() != id {
+		t.Fatalf("restarted client got Conversation ID %d, expected %d back", restarted.ConversationID(), id)
+	}
+	network.clients[0] = restarted
+
+	waitUntil(t, "the resumed client's hello", func() bool { return network.voters() == LOOPBACK_CLIENTS })
+	verdict := network.propose(t, "1 + 1 == 2")
+	if verdict.Result != SAT || verdict.Participants != LOOPBACK_CLIENTS {
+		t.Errorf("result %d with %d participants, expected SAT with %d", verdict.Result, verdict.Participants, LOOPBACK_CLIENTS)
+	}
+	network.allHold(t, verdict, SAT)
+
+	for _, server := range restarted.conversationsSnapshot() {
+		server.receiver.incoming_lock.Lock()
+		highest := server.receiver.lastPcktReceived
+		server.receiver.incoming_lock.Unlock()
+
+		if highest >= sent {
+			t.Errorf("restarted client got packet %d from the server, which had sent %d before, numbering wasn't reset", highest, sent)
+		}
+	}
+}
+
+// A server that shuts down with a StatePath and starts again at the same address comes back under its own
+// Conversation ID, its clients carry on in the conversations they had and vote again. If the state has lost
+// the server's ID, the clients swap their old conversation for the new one instead of keeping both.
+func TestLoopbackServerRestart(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		sameID bool
+	}{
+		{"same ID", true},
+		{"new ID", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			network := startLoopback(t, LOOPBACK_CLIENTS, "")
+			for i := 0; i < 3; i++ {
+				network.allHold(t, network.propose(t, "1 + 1 == 2"), SAT)
+			}
+
+			id := network.server.ConversationID()
+			settings := network.serverSettings
+			settings.Listen = []string{network.server.listen_conns[0].localAddr().String()}
+
+			ctx, cancel := context.WithTimeout(context.Background(), LOOPBACK_TIMEOUT)
+			defer cancel()
+			if err := network.server.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.sameID {
+				var state node_state
+				raw, err := os.ReadFile(settings.StatePath)
+				if err == nil {
+					err = json.Unmarshal(raw, &state)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				state.ConversationID = 0
+				if raw, err = json.Marshal(state); err == nil {
+					err = os.WriteFile(settings.StatePath, raw, 0600)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			restarted, err := NewServer(settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go restarted.Run()
+			t.Cleanup(func() { restarted.Close() })
+			network.server = restarted
+
+			if (restarted.ConversationID() == id) != test.sameID {
+				t.Fatalf("restarted server has Conversation ID %d, it had %d", restarted.ConversationID(), id)
+			}
+
+			waitUntil(t, "every client's hello", func() bool { return network.voters() == LOOPBACK_CLIENTS })
+			for i := 0; i < 3; i++ {
+				network.allHold(t, network.propose(t, "1 + 1 == 2"), SAT)
+			}
+
+			for i, client := range network.clients {
+				servers := client.conversationsSnapshot()
+				if len(servers) != 1 || servers[0].conversation_id != restarted.ConversationID() {
+					t.Errorf("client %d has %d server conversations, expected just %d", i, len(servers), restarted.ConversationID())
+				}
+			}
+		})
+	}
+}
+
+// rawPacket serializes and checksums a packet the way sendUDP does, for talking to a node from a bare socket
+func rawPacket(t *testing.T, pckt *Pckt) []byte {
+	t.Helper()
+
+	pckt_bytes, err := SerializePacket(pckt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum_bytes, err := ComputeChecksum(pckt_bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(pckt_bytes[4:8], checksum_bytes[:4])
+
+	return pckt_bytes
+}
+
+// An attacker replaying a client's SYN from another address gets challenged, can't answer the challenge
+// without the client's key, and the conversation stays where it is
+func TestLoopbackReplayedSYN(t *testing.T) {
+	network := startLoopback(t, LOOPBACK_CLIENTS, "")
+	client := network.clients[0]
+	id := client.ConversationID()
+
+	conv := network.conversation(t, id)
+	bound := conv.address().String()
+
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	serverAddr := network.server.listen_conns[0].localAddr()
+
+	// Exactly the body the client puts in its SYNs
+	captured := client.ownershipProof()
+	replay := func(packetType uint16, body []byte) {
+		pckt := &Pckt{
+			Header: PcktHeader{Magic: MAGIC_CONST, ConvID: id, Type: packetType, IsFinal: 1},
+			Body:   body,
+		}
+		if _, err := attacker.WriteToUDP(rawPacket(t, pckt), serverAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The server asks for a proof made over a cookie for the attacker's address, once the clients connecting
+	// from the same IP have left room in its rate limit
+	buf := make([]byte, 2048)
+	n := 0
+	waitUntil(t, "a challenge for the replayed SYN", func() bool {
+		replay(SYN, captured)
+		attacker.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err = attacker.Read(buf)
+		return err == nil
+	})
+	challenge, err := DeserializePacket(buf[:n])
+	if err != nil || challenge.Header.Type != SYN || len(challenge.Body) != COOKIE_SIZE {
+		t.Fatalf("expected a SYN carrying a cookie, got %+v (%v)", challenge, err)
+	}
+
+	// Neither the captured proof, nor the captured token and MAC with the new cookie, will do
+	replay(SYN_ACK, captured)
+	proof, err := DeserializeOwnership(captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof.Cookie = challenge.Body
+	forged, err := SerializeOwnership(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay(SYN_ACK, forged)
+
+	time.Sleep(200 * time.Millisecond)
+	if addr := conv.address().String(); addr != bound {
+		t.Fatalf("conversation moved from %s to %s on a replayed proof", bound, addr)
+	}
+
+	verdict := network.propose(t, "3 > 2")
+	if verdict.Result != SAT || verdict.Participants != LOOPBACK_CLIENTS {
+		t.Errorf("result %d with %d participants, expected SAT with %d", verdict.Result, verdict.Participants, LOOPBACK_CLIENTS)
+	}
+}
+
+// A restarted client's Ping, ticket and proof and all, replayed from another address doesn't get the
+// conversation, not even once the attacker has a cookie of its own to ping with
+func TestLoopbackReplayedTicket(t *testing.T) {
+	network := startLoopback(t, LOOPBACK_CLIENTS, "")
+	client := network.clients[0]
+	id := client.ConversationID()
+	server := client.serverAddr.String()
+
+	waitUntil(t, "the resumption ticket", func() bool { return client.loadTicket(server) != nil })
+	conv := network.conversation(t, id)
+	bound := conv.address().String()
+
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+
+	// Exactly what the client would ping with after a restart
+	client.ping_cookie_lock.Lock()
+	clientCookie := client.ping_cookie
+	client.ping_cookie_lock.Unlock()
+	ticket, proof := client.resumptionProof(server, clientCookie)
+	if ticket == nil {
+		t.Fatal("client has nothing to resume with")
+	}
+
+	// ping sends a Ping with the captured ticket and proof until the server answers with a packet of the type
+	ping := func(cookie []byte, answer uint16) *Pckt {
+		body, err := SerializePing(&PcktPing{Ticket: ticket, Cookie: cookie, ClientKey: make([]byte, CLIENT_KEY_SIZE), Ownership: proof})
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := rawPacket(t, &Pckt{Header: PcktHeader{Magic: MAGIC_CONST, Type: PING_REQ, IsFinal: 1}, Body: body})
+
+		var got *Pckt
+		buf := make([]byte, 2048)
+		waitUntil(t, packet_type_names[answer], func() bool {
+			if _, err := attacker.WriteToUDP(raw, client.serverAddr); err != nil {
+				t.Fatal(err)
+			}
+			attacker.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, err := attacker.Read(buf)
+			if err != nil {
+				return false
+			}
+			got, err = DeserializePacket(buf[:n])
+			return err == nil && got.Header.Type == answer
+		})
+		return got
+	}
+
+	// The client's cookie is for the client's address
+	retry := ping(clientCookie, PING_RETRY)
+	res := ping(retry.Body, PING_RES)
+	if res.Header.ConvID == id {
+		t.Fatalf("attacker was handed conversation %d with a replayed ticket", id)
+	}
+	if addr := conv.address().String(); addr != bound {
+		t.Fatalf("conversation moved from %s to %s on a replayed ticket", bound, addr)
+	}
+}
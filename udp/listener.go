@@ -1,109 +1,284 @@
-package main
-
-import (
-	//"fmt"
-
-	"log"
-	"net"
-)
-
-func listener() {
-	// Listen Continuously
-	for true {
-		buffer := make([]byte, 8192)
-		n, addr, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Println("Error reading from UDP:", err)
-			continue
-		}
-
-		go handleIncomingPackets(conn, addr, buffer[:n])
-	}
-}
-
-func handleIncomingPackets(conn *net.UDPConn, addr *net.UDPAddr, raw_packet []byte) {
-
-	// Make sure Data is at least 24 Bytes
-	if len(raw_packet) < 24 {
-		if debug_mode {
-			log.Printf("handleIncomingPackets: insufficient packet size\n")
-		}
-		return
-	}
-
-	// Magic and Checksum check, if this fails, you would drop the packet
-	verify_packet, err := VerifyPacket(raw_packet)
-	if err != nil {
-		if debug_mode {
-			log.Printf("handleIncomingPackets: VerifyPacket returned Error\n")
-		}
-		return
-	}
-
-	if !verify_packet {
-		if debug_mode {
-			log.Printf("handleIncomingPackets: VerifyPacket returned False\n")
-		}
-		return
-	}
-
-	// Deserialize the Header
-	packet, err := DeserializePacket(raw_packet)
-	if err != nil {
-		if debug_mode {
-			log.Printf("handleIncomingPackets: DeserializeHeader returned Error\n")
-		}
-		return
-	}
-
-	// Check if Ping Request for Conversation ID Assignment
-	if packet.Header.Type == PING_REQ {
-		generatedConvIDs_lock.Lock()
-		defer generatedConvIDs_lock.Unlock()
-		pingPckt := Pckt{
-			Header: PcktHeader{
-				Magic:       MAGIC_CONST,
-				Checksum:    0,
-				ConvID:      generateConversationID(),
-				PacketNum:   0,
-				SequenceNum: 0,
-				Type:        PING_RES,
-				IsFinal:     1,
-			},
-			Body: []byte{},
-		}
-
-		// Send Back Unique Conversation ID for the Client
-		sendUDP(addr, &pingPckt)
-		return
-	}
-
-	// Check if Got Assigned a new Conversation ID
-	if packet.Header.Type == PING_RES {
-		if conversation_id_self == 0 {
-			conversation_id_self = packet.Header.ConvID
-		}
-
-		return // Drop packet, to not accidentally create a conversation with yourself
-	}
-
-	// Block incoming if haven't got a Conversation ID
-	if conversation_id_self == 0 {
-		return
-	}
-
-	conversations_lock.Lock()
-
-	conversationRef, exists := conversations[packet.Header.ConvID]
-	if !exists {
-		conversationRef = newConversation(packet.Header.ConvID, addr)
-		conversations[packet.Header.ConvID] = conversationRef
-		conversationRef.startUp()
-
-		// Print New Connection Credentials
-		log.Println("\nNew Conversation started with ID: ", packet.Header.ConvID, ", IP: ", addr.IP.String(), ", Port: ", addr.Port, "\n")
-	}
-	conversations_lock.Unlock()
-
-	conversationRef.ARQ_Receive(conn, addr, *packet)
-}
+package core
+
+import (
+	//"fmt"
+
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"net"
+	"runtime"
+	"sync"
+)
+
+// Incoming datagrams are handed to a fixed set of workers instead of a goroutine each.
+
+const WORKER_QUEUE_SIZE = 256
+
+// A datagram waiting for its worker, the buffer goes back to the pool once it's handled
+type incoming_datagram struct {
+	conn   transport
+	addr   *net.UDPAddr
+	buffer *[]byte
+	length int
+}
+
+// Buffers are shared by every node in the process
+var (
+	buffer_pool = sync.Pool{
+		New: func() any {
+			buffer := make([]byte, LISTEN_BUFFER_SIZE)
+			return &buffer
+		},
+	}
+)
+
+// startWorkers starts one worker per CPU, each with its own queue
+func (node *Node) startWorkers() {
+	node.worker_queues = make([]chan incoming_datagram, runtime.NumCPU())
+
+	for i := range node.worker_queues {
+		node.worker_queues[i] = make(chan incoming_datagram, WORKER_QUEUE_SIZE)
+		go node.worker(node.worker_queues[i])
+	}
+}
+
+func (node *Node) worker(queue chan incoming_datagram) {
+	for datagram := range queue {
+		node.handleIncomingPackets(datagram.conn, datagram.addr, (*datagram.buffer)[:datagram.length])
+		buffer_pool.Put(datagram.buffer)
+	}
+}
+
+// workerFor picks the worker for a datagram by its ConvID, so a conversation's packets are handled one at a time
+// and in the order they arrived, datagrams without one (Pings from clients that don't have an ID yet) are
+// spread out by address instead
+func (node *Node) workerFor(raw_packet []byte, addr *net.UDPAddr) chan incoming_datagram {
+	var key uint32 = 0
+
+	if len(raw_packet) >= PCKT_HEADER_SIZE {
+		key = binary.BigEndian.Uint32(raw_packet[8:12])
+	}
+
+	if key == 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(addr.String()))
+		key = hash.Sum32()
+	}
+
+	return node.worker_queues[key%uint32(len(node.worker_queues))]
+}
+
+// listener reads from every transport in listen_conns until they're closed
+func (node *Node) listener() {
+	node.startWorkers()
+
+	var wg sync.WaitGroup
+	for _, listen_conn := range node.listen_conns {
+		wg.Add(1)
+		go func(listen_conn transport) {
+			defer wg.Done()
+			node.readLoop(listen_conn)
+		}(listen_conn)
+	}
+	wg.Wait()
+
+	// Nothing is left to dispatch to the workers
+	for _, queue := range node.worker_queues {
+		close(queue)
+	}
+}
+
+// readLoop hands everything arriving on one transport to the workers, until it's closed
+func (node *Node) readLoop(conn transport) {
+	buffers := make([]*[]byte, BATCH_SIZE)
+	lengths := make([]int, BATCH_SIZE)
+	addrs := make([]*net.UDPAddr, BATCH_SIZE)
+
+	// Listen Continuously
+	for true {
+		// Replace the buffers handed to workers last time round
+		for i := range buffers {
+			if buffers[i] == nil {
+				buffers[i] = buffer_pool.Get().(*[]byte)
+			}
+		}
+
+		received, err := conn.readBatch(buffers, lengths, addrs)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			node.transport_log.Error("Error reading from UDP", "err", err)
+			continue
+		}
+
+		for i := 0; i < received; i++ {
+			node.dispatch(conn, addrs[i], buffers[i], lengths[i])
+			buffers[i] = nil
+		}
+	}
+}
+
+// dispatch queues a datagram for its worker, the buffer belongs to the worker (or goes back to the pool) after this,
+// a worker too far behind has new datagrams dropped and counted, the ARQ on the other end will send them again
+func (node *Node) dispatch(conn transport, addr *net.UDPAddr, buffer *[]byte, n int) {
+	datagram := incoming_datagram{conn: conn, addr: addr, buffer: buffer, length: n}
+
+	// Don't block the socket on a busy worker
+	select {
+	case node.workerFor((*buffer)[:n], addr) <- datagram:
+	default:
+		dropped := node.dropped_datagrams.Add(1)
+		buffer_pool.Put(buffer)
+		node.transport_log.Debug("Worker queue full, dropped datagram", "addr", addr, "dropped", dropped)
+	}
+}
+
+func (node *Node) handleIncomingPackets(conn transport, addr *net.UDPAddr, raw_packet []byte) {
+
+	// Make sure Data is at least 24 Bytes
+	if len(raw_packet) < 24 {
+		node.transport_log.Debug("handleIncomingPackets: insufficient packet size", "addr", addr)
+		return
+	}
+
+	// Magic and Checksum check, if this fails, you would drop the packet
+	verify_packet, err := VerifyPacket(raw_packet)
+	if err != nil {
+		node.transport_log.Debug("handleIncomingPackets: VerifyPacket returned Error", "addr", addr, "err", err)
+		return
+	}
+
+	if !verify_packet {
+		node.transport_log.Debug("handleIncomingPackets: VerifyPacket returned False", "addr", addr)
+		if verified_magic, _ := VerifyMagic(raw_packet); !verified_magic {
+			node.metrics.magic_failures.Add(1)
+		} else {
+			node.metrics.checksum_failures.Add(1)
+		}
+		return
+	}
+
+	// Deserialize the Header
+	packet, err := DeserializePacket(raw_packet)
+	if err != nil {
+		node.transport_log.Debug("handleIncomingPackets: DeserializeHeader returned Error", "addr", addr, "err", err)
+		return
+	}
+	node.metrics.packets_received.add(packet.Header.Type)
+
+	// Banned with the admin API
+	if node.isBanned(packet.Header.ConvID, addr.IP) {
+		node.transport_log.Debug("handleIncomingPackets: dropping packet from banned conversation or address", "conversation", packet.Header.ConvID, "addr", addr)
+		return
+	}
+
+	// Check if Ping Request for Conversation ID Assignment
+	if packet.Header.Type == PING_REQ {
+		// Only servers hand out Conversation IDs
+		if !node.i_am_server {
+			return
+		}
+
+		// Unpadded Pings could get more back than they sent, and nobody needs to ping this often
+		if len(packet.Body) < PING_MIN_BODY || !node.ping_limiter.allow(addr.IP, node.now()) {
+			node.transport_log.Debug("handleIncomingPackets: dropping Ping", "addr", addr)
+			return
+		}
+
+		ping, err := DeserializePing(packet.Body)
+		if err != nil {
+			node.transport_log.Debug("handleIncomingPackets: DeserializePing returned Error", "addr", addr, "err", err)
+			return
+		}
+
+		// Make sure the client can actually receive at the address it claims before doing anything else
+		if err := node.verifyCookie(ping.Cookie, addr); err != nil {
+			node.sendPingRetry(conn, addr)
+			return
+		}
+
+		// A returning client gets its old Conversation ID back, everyone else gets a new one
+		assignedConvID, resumed := node.resumeConversation(ping, conn, addr)
+		if !resumed {
+			node.generatedConvIDs_lock.Lock()
+			assignedConvID = node.generateConversationID()
+			node.generatedConvIDs_lock.Unlock()
+		}
+
+		pingPckt := Pckt{
+			Header: PcktHeader{
+				Magic:       MAGIC_CONST,
+				Checksum:    0,
+				ConvID:      assignedConvID,
+				PacketNum:   0,
+				SequenceNum: 0,
+				Type:        PING_RES,
+				IsFinal:     1,
+			},
+			Body: node.pingResponse(assignedConvID, ping.ClientKey),
+		}
+
+		// Send Back Unique Conversation ID for the Client
+		node.sendUDP(conn, addr, &pingPckt)
+		return
+	}
+
+	// Check if the server wants us to prove our address first
+	if packet.Header.Type == PING_RETRY {
+		node.handlePingRetry(packet.Body, addr)
+		return
+	}
+
+	// Check if Got Assigned a new Conversation ID
+	if packet.Header.Type == PING_RES {
+		node.handlePingResponse(packet.Header.ConvID, packet.Body)
+
+		return // Drop packet, to not accidentally create a conversation with yourself
+	}
+
+	// Block incoming if haven't got a Conversation ID
+	if node.ConversationID() == 0 {
+		return
+	}
+
+	node.conversations_lock.Lock()
+
+	conversationRef, exists := node.conversations[packet.Header.ConvID]
+	if !exists && packet.Header.Type == RESET {
+		// Nothing to close, or a copy of a RESET whose conversation is already gone
+		node.conversations_lock.Unlock()
+		return
+	}
+	if !exists {
+		// Only IDs the server handed out (or packets from our server, as a client) get a conversation
+		if !node.mayOpenConversation(packet.Header.ConvID, addr) || !node.authorizePacket(nil, conn, packet, addr) {
+			node.conversations_lock.Unlock()
+			node.transport_log.Debug("handleIncomingPackets: not opening a conversation", "conversation", packet.Header.ConvID, "addr", addr)
+			return
+		}
+
+		// A client only has the one server, one that comes back under another ID has started over
+		if !node.i_am_server {
+			for stale_id, stale := range node.conversations {
+				stale.stop()
+				delete(node.conversations, stale_id)
+				node.transport_log.Info("Dropping the server's old conversation", "conversation", stale_id, "addr", addr)
+			}
+		}
+
+		conversationRef = newConversation(node, packet.Header.ConvID, conn, addr)
+		node.conversations[packet.Header.ConvID] = conversationRef
+		conversationRef.startUp()
+
+		// Print New Connection Credentials
+		node.transport_log.Info("New Conversation started", "conversation", packet.Header.ConvID, "addr", addr)
+	} else if !node.authorizePacket(conversationRef, conn, packet, addr) {
+		node.conversations_lock.Unlock()
+		return
+	}
+	node.conversations_lock.Unlock()
+
+	conversationRef.ARQ_Receive(conn, addr, *packet)
+}
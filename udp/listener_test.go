@@ -0,0 +1,128 @@
+package core
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// testNode is a server that hasn't started anything, for poking at its parts directly
+func testNode(t *testing.T) *Node {
+	t.Helper()
+
+	settings := DefaultSettings()
+	settings.Log.Output = io.Discard
+	return newNode(settings, true)
+}
+
+// datagramFor fills a pooled buffer with a packet for a ConvID, numbered so the order can be checked
+func datagramFor(t *testing.T, conversation_id uint32, number uint32) (*[]byte, int) {
+	t.Helper()
+
+	raw, err := SerializePacket(&Pckt{Header: PcktHeader{Magic: MAGIC_CONST, ConvID: conversation_id, PacketNum: number, Type: DATA, IsFinal: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := buffer_pool.Get().(*[]byte)
+	return buffer, copy(*buffer, raw)
+}
+
+// Every datagram for a conversation lands on the same worker, in the order it arrived, while different
+// conversations (and Pings from different addresses) spread over the workers
+func TestDispatchOrdering(t *testing.T) {
+	const workers, conversations, rounds = 4, 16, 20
+
+	node := testNode(t)
+	node.worker_queues = make([]chan incoming_datagram, workers)
+	for i := range node.worker_queues {
+		node.worker_queues[i] = make(chan incoming_datagram, conversations*rounds)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	for round := uint32(0); round < rounds; round++ {
+		for id := uint32(1); id <= conversations; id++ {
+			buffer, n := datagramFor(t, id, round)
+			node.dispatch(nil, addr, buffer, n)
+		}
+	}
+
+	worker_of := map[uint32]int{}
+	next := map[uint32]uint32{}
+	used := 0
+	for i, queue := range node.worker_queues {
+		if len(queue) > 0 {
+			used++
+		}
+		for len(queue) > 0 {
+			datagram := <-queue
+			raw := (*datagram.buffer)[:datagram.length]
+			id, number := binary.BigEndian.Uint32(raw[8:12]), binary.BigEndian.Uint32(raw[12:16])
+
+			if w, seen := worker_of[id]; seen && w != i {
+				t.Fatalf("conversation %d's datagrams went to workers %d and %d", id, w, i)
+			}
+			worker_of[id] = i
+
+			if number != next[id] {
+				t.Fatalf("conversation %d: got datagram %d, expected %d", id, number, next[id])
+			}
+			next[id]++
+		}
+	}
+
+	for id := uint32(1); id <= conversations; id++ {
+		if next[id] != rounds {
+			t.Errorf("conversation %d: %d datagrams handed out, expected %d", id, next[id], rounds)
+		}
+	}
+	if used < 2 {
+		t.Errorf("%d conversations all went to one worker", conversations)
+	}
+	if dropped := node.dropped_datagrams.Load(); dropped != 0 {
+		t.Errorf("%d datagrams dropped with room in every queue", dropped)
+	}
+
+	// Pings carry no ConvID yet, they're kept together by address
+	ping, _ := datagramFor(t, 0, 0)
+	defer buffer_pool.Put(ping)
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	if node.workerFor(*ping, addr) != node.workerFor(*ping, addr) {
+		t.Error("Pings from one address went to different workers")
+	}
+	spread := false
+	for port := 2; port < 100 && !spread; port++ {
+		other.Port = port
+		spread = node.workerFor(*ping, other) != node.workerFor(*ping, addr)
+	}
+	if !spread {
+		t.Error("Pings from every address went to the same worker")
+	}
+}
+
+// A worker that falls behind has new datagrams dropped and counted, not queued without limit
+func TestDispatchOverflow(t *testing.T) {
+	const room, sent = 3, 10
+
+	node := testNode(t)
+	node.worker_queues = []chan incoming_datagram{make(chan incoming_datagram, room)}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	for i := uint32(0); i < sent; i++ {
+		buffer, n := datagramFor(t, 1, i)
+		node.dispatch(nil, addr, buffer, n)
+	}
+
+	if dropped := node.dropped_datagrams.Load(); dropped != sent-room {
+		t.Errorf("%d datagrams dropped, expected %d", dropped, sent-room)
+	}
+
+	// The ones that made it are the first ones, still in order
+	for i := uint32(0); i < room; i++ {
+		datagram := <-node.worker_queues[0]
+		if number := binary.BigEndian.Uint32((*datagram.buffer)[12:16]); number != i {
+			t.Errorf("queued datagram %d, expected %d", number, i)
+		}
+	}
+}
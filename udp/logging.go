@@ -0,0 +1,137 @@
+// Leveled, structured logging, one logger per subsystem
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Every record carries the subsystem it came from, and where it applies the conversation, vote_id and packet
+// it's about, so a log pipeline can filter and correlate them. Each subsystem has its own level (changeable
+// while the node runs with SetLogLevel), and they all share one handler writing text or JSON.
+
+const (
+	LOG_TRANSPORT = "transport" // Sockets, conversations, retransmissions, FEC, Path MTU, tokens and tickets
+	LOG_VOTE      = "vote"      // Referendums
+	LOG_CLI       = "cli"       // The client's command line
+)
+
+var log_subsystems = []string{LOG_TRANSPORT, LOG_VOTE, LOG_CLI}
+
+// Filters records by their subsystem's level before the shared handler sees them
+type subsystem_handler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (handler subsystem_handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= handler.level.Level()
+}
+
+func (handler subsystem_handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return subsystem_handler{handler.Handler.WithAttrs(attrs), handler.level}
+}
+
+func (handler subsystem_handler) WithGroup(name string) slog.Handler {
+	return subsystem_handler{handler.Handler.WithGroup(name), handler.level}
+}
+
+// parseLogLevel reads "debug", "info", "warn" or "error" (or an offset like "debug-4")
+func parseLogLevel(text string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(text)); err != nil {
+		return 0, fmt.Errorf("%q isn't a log level (debug, info, warn or error)", text)
+	}
+	return level, nil
+}
+
+// levelFor is a subsystem's level, falling back on the shared one
+func (settings LogSettings) levelFor(subsystem string) string {
+	var level string
+	switch subsystem {
+	case LOG_TRANSPORT:
+		level = settings.Transport
+	case LOG_VOTE:
+		level = settings.Vote
+	case LOG_CLI:
+		level = settings.CLI
+	}
+
+	if level == "" {
+		return settings.Level
+	}
+	return level
+}
+
+// newHandler is the handler every subsystem writes through
+func (settings LogSettings) newHandler() slog.Handler {
+	var out io.Writer = os.Stderr
+	if settings.Output != nil {
+		out = settings.Output
+	}
+
+	// Levels are checked per subsystem, the shared handler takes whatever gets through
+	options := &slog.HandlerOptions{Level: slog.Level(-1 << 10)}
+
+	if strings.EqualFold(settings.Format, "json") {
+		return slog.NewJSONHandler(out, options)
+	}
+	return slog.NewTextHandler(out, options)
+}
+
+// setupLogging creates the node's subsystem loggers, the settings have been validated already
+func (node *Node) setupLogging(settings LogSettings) {
+	handler := settings.newHandler()
+
+	node.log_levels = make(map[string]*slog.LevelVar)
+	node.loggers = make(map[string]*slog.Logger)
+
+	for _, subsystem := range log_subsystems {
+		level := new(slog.LevelVar)
+		parsed, _ := parseLogLevel(settings.levelFor(subsystem))
+		level.Set(parsed)
+
+		node.log_levels[subsystem] = level
+		node.loggers[subsystem] = slog.New(subsystem_handler{handler, level}).With("subsystem", subsystem)
+	}
+
+	node.transport_log = node.loggers[LOG_TRANSPORT]
+	node.vote_log = node.loggers[LOG_VOTE]
+}
+
+// Logger returns a subsystem's logger (LOG_TRANSPORT, LOG_VOTE or LOG_CLI), for commands and embedders
+func (node *Node) Logger(subsystem string) *slog.Logger {
+	if logger, exists := node.loggers[subsystem]; exists {
+		return logger
+	}
+	return node.loggers[LOG_CLI]
+}
+
+// SetLogLevel changes a subsystem's level while the node runs
+func (node *Node) SetLogLevel(subsystem string, level string) error {
+	level_var, exists := node.log_levels[subsystem]
+	if !exists {
+		return fmt.Errorf("SetLogLevel: no subsystem called %q", subsystem)
+	}
+
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		return fmt.Errorf("SetLogLevel: %v", err)
+	}
+
+	level_var.Set(parsed)
+	return nil
+}
+
+// LogLevels lists every subsystem's current level
+func (node *Node) LogLevels() map[string]string {
+	levels := make(map[string]string, len(node.log_levels))
+	for subsystem, level := range node.log_levels {
+		levels[subsystem] = level.Level().String()
+	}
+	return levels
+}
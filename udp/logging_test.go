@@ -0,0 +1,90 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Each subsystem only writes records at or above its level, its own if it has one and the shared one if not,
+// and SetLogLevel moves that line while the node runs
+func TestLogLevels(t *testing.T) {
+	var out bytes.Buffer
+	settings := DefaultSettings()
+	settings.Log.Output = &out
+	settings.Log.Format = "json"
+	settings.Log.Level = "warn"
+	settings.Log.Vote = "debug"
+	node := newNode(settings, true)
+
+	// logged writes one record at every level to each subsystem, and reads back which got through
+	logged := func() map[string]bool {
+		t.Helper()
+
+		out.Reset()
+		for _, subsystem := range log_subsystems {
+			logger := node.Logger(subsystem)
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+			logger.Error("error")
+		}
+
+		through := make(map[string]bool)
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var record struct {
+				Subsystem string `json:"subsystem"`
+				Msg       string `json:"msg"`
+			}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("record %q: %v", line, err)
+			}
+			through[record.Subsystem+" "+record.Msg] = true
+		}
+		return through
+	}
+
+	expect := func(levels map[string]string) {
+		t.Helper()
+
+		through := logged()
+		order := []string{"debug", "info", "warn", "error"}
+		for _, subsystem := range log_subsystems {
+			lowest := 0
+			for i, level := range order {
+				if level == levels[subsystem] {
+					lowest = i
+				}
+			}
+			for i, level := range order {
+				if want := i >= lowest; through[subsystem+" "+level] != want {
+					t.Errorf("%s at %s: written %v, expected %v", subsystem, level, !want, want)
+				}
+			}
+		}
+	}
+
+	expect(map[string]string{LOG_TRANSPORT: "warn", LOG_VOTE: "debug", LOG_CLI: "warn"})
+
+	if err := node.SetLogLevel(LOG_TRANSPORT, "error"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.SetLogLevel(LOG_CLI, "info"); err != nil {
+		t.Fatal(err)
+	}
+	expect(map[string]string{LOG_TRANSPORT: "error", LOG_VOTE: "debug", LOG_CLI: "info"})
+
+	if err := node.SetLogLevel(LOG_VOTE, "loud"); err == nil {
+		t.Error("SetLogLevel took a level that doesn't exist")
+	}
+	if err := node.SetLogLevel("disk", "info"); err == nil {
+		t.Error("SetLogLevel took a subsystem that doesn't exist")
+	}
+	if levels := node.LogLevels(); levels[LOG_VOTE] != "DEBUG" || levels[LOG_TRANSPORT] != "ERROR" {
+		t.Errorf("levels now %v", levels)
+	}
+}
@@ -0,0 +1,231 @@
+// Prometheus metrics, served at /metrics in the text exposition format (without pulling in a client library)
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters and histograms are updated where things happen, gauges are worked out from the conversations,
+// their sliding windows and the referendum manager when /metrics is scraped. Settings.MetricsAddr turns the
+// endpoint on, embedders can also mount MetricsHandler on a server of their own.
+
+const METRICS_PREFIX = "consensus_"
+
+// Names for the packet type label
+var packet_type_names = map[uint16]string{
+	DATA:       "data",
+	ACK:        "ack",
+	NAK:        "nak",
+	SYN:        "syn",
+	SYN_ACK:    "syn_ack",
+	RESET:      "reset",
+	DATAGRAM:   "datagram",
+	PROBE:      "probe",
+	PROBE_ACK:  "probe_ack",
+	FEC_PARITY: "fec_parity",
+	PING_RETRY: "ping_retry",
+	PING_REQ:   "ping_req",
+	PING_RES:   "ping_res",
+}
+
+// Counts packets by type, the map is filled in up front so it's only ever read
+type packet_counter struct {
+	counts map[uint16]*atomic.Uint64
+	other  atomic.Uint64
+}
+
+func newPacketCounter() *packet_counter {
+	counter := &packet_counter{counts: make(map[uint16]*atomic.Uint64)}
+	for packet_type := range packet_type_names {
+		counter.counts[packet_type] = new(atomic.Uint64)
+	}
+	return counter
+}
+
+func (counter *packet_counter) add(packet_type uint16) {
+	if count, exists := counter.counts[packet_type]; exists {
+		count.Add(1)
+	} else {
+		counter.other.Add(1)
+	}
+}
+
+// A histogram with fixed buckets, bounds are upper bounds and counts aren't cumulative until written out
+type histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64 // One per bound, plus +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	bucket := sort.SearchFloat64s(h.bounds, value)
+	h.counts[bucket]++
+	h.sum += value
+	h.count++
+}
+
+// write prints the histogram's buckets, sum and count
+func (h *histogram) write(out io.Writer, name string, help string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(out, "# HELP %s%s %s\n# TYPE %s%s histogram\n", METRICS_PREFIX, name, help, METRICS_PREFIX, name)
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(out, "%s%s_bucket{le=\"%g\"} %d\n", METRICS_PREFIX, name, bound, cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)]
+	fmt.Fprintf(out, "%s%s_bucket{le=\"+Inf\"} %d\n", METRICS_PREFIX, name, cumulative)
+	fmt.Fprintf(out, "%s%s_sum %g\n%s%s_count %d\n", METRICS_PREFIX, name, h.sum, METRICS_PREFIX, name, h.count)
+}
+
+// Everything a node counts
+type node_metrics struct {
+	packets_sent      *packet_counter
+	packets_received  *packet_counter
+	retransmits_rto   atomic.Uint64 // Retransmission timeout ran out
+	retransmits_nak   atomic.Uint64 // The other node asked
+	checksum_failures atomic.Uint64
+	magic_failures    atomic.Uint64
+	dropped_fragments atomic.Uint64 // Multi fragment packets, which nothing sends yet
+
+	referendums_timed_out atomic.Uint64 // Still going at their deadline
+
+	rtt             *histogram // Seconds, from ACKs of packets sent once (Karn's algorithm)
+	time_to_verdict *histogram // Seconds from a referendum being created to its result being called
+}
+
+func newNodeMetrics() *node_metrics {
+	return &node_metrics{
+		packets_sent:     newPacketCounter(),
+		packets_received: newPacketCounter(),
+		rtt:              newHistogram(0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5),
+		time_to_verdict:  newHistogram(0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60),
+	}
+}
+
+// MetricsHandler serves the node's metrics to Prometheus
+func (node *Node) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		node.writeMetrics(writer)
+	})
+}
+
+// metricsMux routes /metrics, for Settings.MetricsAddr
+func (node *Node) metricsMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", node.MetricsHandler())
+	return mux
+}
+
+// writeMetrics prints every metric in the text exposition format
+func (node *Node) writeMetrics(out io.Writer) {
+	metrics := node.metrics
+
+	// Counters
+	fmt.Fprintf(out, "# HELP %spackets_total Packets sent and received, by type.\n# TYPE %spackets_total counter\n", METRICS_PREFIX, METRICS_PREFIX)
+	for _, direction := range []struct {
+		name    string
+		counter *packet_counter
+	}{{"sent", metrics.packets_sent}, {"received", metrics.packets_received}} {
+		types := make([]uint16, 0, len(direction.counter.counts))
+		for packet_type := range direction.counter.counts {
+			types = append(types, packet_type)
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+		for _, packet_type := range types {
+			fmt.Fprintf(out, "%spackets_total{direction=\"%s\",type=\"%s\"} %d\n", METRICS_PREFIX, direction.name, packet_type_names[packet_type], direction.counter.counts[packet_type].Load())
+		}
+		fmt.Fprintf(out, "%spackets_total{direction=\"%s\",type=\"other\"} %d\n", METRICS_PREFIX, direction.name, direction.counter.other.Load())
+	}
+
+	fmt.Fprintf(out, "# HELP %sretransmits_total Packets sent again, by what caused it.\n# TYPE %sretransmits_total counter\n", METRICS_PREFIX, METRICS_PREFIX)
+	fmt.Fprintf(out, "%sretransmits_total{reason=\"timeout\"} %d\n", METRICS_PREFIX, metrics.retransmits_rto.Load())
+	fmt.Fprintf(out, "%sretransmits_total{reason=\"nak\"} %d\n", METRICS_PREFIX, metrics.retransmits_nak.Load())
+
+	writeCounter(out, "checksum_failures_total", "Incoming packets dropped for a bad checksum.", metrics.checksum_failures.Load())
+	writeCounter(out, "magic_failures_total", "Incoming packets dropped for a bad Magic field.", metrics.magic_failures.Load())
+	writeCounter(out, "dropped_fragments_total", "Incoming multi fragment packets dropped.", metrics.dropped_fragments.Load())
+	writeCounter(out, "dropped_datagrams_total", "Incoming datagrams dropped because their worker's queue was full.", node.dropped_datagrams.Load())
+	writeCounter(out, "referendums_timed_out_total", "Referendums closed at their deadline by the timeout policy.", metrics.referendums_timed_out.Load())
+
+	// Gauges
+	var online, offline, queued int
+	node.conversations_lock.Lock()
+	for _, conv := range node.conversations {
+		if conv.isOnline() {
+			online++
+		} else {
+			offline++
+		}
+		queued += conv.outgoingDepth()
+	}
+	node.conversations_lock.Unlock()
+
+	fmt.Fprintf(out, "# HELP %sconversations Conversations, by state.\n# TYPE %sconversations gauge\n", METRICS_PREFIX, METRICS_PREFIX)
+	fmt.Fprintf(out, "%sconversations{state=\"online\"} %d\n", METRICS_PREFIX, online)
+	fmt.Fprintf(out, "%sconversations{state=\"offline\"} %d\n", METRICS_PREFIX, offline)
+
+	writeGauge(out, "outgoing_queue_depth", "Reliable packets waiting to be sent or Acked, across every conversation.", queued)
+	writeGauge(out, "referendums_ongoing", "Referendums hosted whose result hasn't been called yet.", node.ref_manager.ongoingCount())
+
+	// Histograms
+	metrics.rtt.write(out, "rtt_seconds", "Round trip times measured from ACKs.")
+	metrics.time_to_verdict.write(out, "referendum_time_to_verdict_seconds", "Time from a referendum being created to its result being called.")
+}
+
+func writeCounter(out io.Writer, name string, help string, value uint64) {
+	fmt.Fprintf(out, "# HELP %s%s %s\n# TYPE %s%s counter\n%s%s %d\n", METRICS_PREFIX, name, help, METRICS_PREFIX, name, METRICS_PREFIX, name, value)
+}
+
+func writeGauge(out io.Writer, name string, help string, value int) {
+	fmt.Fprintf(out, "# HELP %s%s %s\n# TYPE %s%s gauge\n%s%s %d\n", METRICS_PREFIX, name, help, METRICS_PREFIX, name, METRICS_PREFIX, name, value)
+}
+
+// outgoingDepth counts the packets in the sliding window's outgoing map that haven't been Acked
+func (conv *conversation) outgoingDepth() int {
+	conv.sender.outgoing_lock.Lock()
+	defer conv.sender.outgoing_lock.Unlock()
+
+	depth := 0
+	for _, pckt := range conv.sender.outgoing {
+		if pckt != nil && !pckt.AckReceived {
+			depth++
+		}
+	}
+	return depth
+}
+
+// ongoingCount counts the hosted referendums whose result hasn't been called
+func (manager *referendum_manager) ongoingCount() int {
+	manager.h_referendums_lock.Lock()
+	defer manager.h_referendums_lock.Unlock()
+
+	ongoing := 0
+	for _, h_ref := range manager.h_referendums {
+		h_ref.referendum_lock.Lock()
+		if h_ref.ongoing {
+			ongoing++
+		}
+		h_ref.referendum_lock.Unlock()
+	}
+	return ongoing
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics reads /metrics into samples by name and labels, checking every sample follows its family's
+// HELP and TYPE lines and that no sample is written twice
+func scrapeMetrics(t *testing.T, node *Node) map[string]float64 {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	node.metricsMux().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("got status %d", recorder.Code)
+	}
+	if content_type := recorder.Header().Get("Content-Type"); !strings.HasPrefix(content_type, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", content_type)
+	}
+
+	helped := make(map[string]bool)
+	typed := make(map[string]string)
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSuffix(recorder.Body.String(), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if strings.HasPrefix(line, "# HELP ") {
+			helped[fields[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			if !helped[fields[2]] {
+				t.Errorf("%s typed before its help", fields[2])
+			}
+			typed[fields[2]] = fields[3]
+			continue
+		}
+
+		if len(fields) != 2 {
+			t.Errorf("malformed sample %q", line)
+			continue
+		}
+		name, _, _ := strings.Cut(fields[0], "{")
+		if !strings.HasPrefix(name, METRICS_PREFIX) {
+			t.Errorf("%s isn't prefixed with %s", name, METRICS_PREFIX)
+		}
+		family := name
+		if typed[family] == "" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if trimmed := strings.TrimSuffix(name, suffix); typed[trimmed] == "histogram" {
+					family = trimmed
+				}
+			}
+		}
+		if typed[family] == "" {
+			t.Errorf("%s sampled without a TYPE line", name)
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Errorf("sample %q: %v", line, err)
+		}
+		if _, exists := samples[fields[0]]; exists {
+			t.Errorf("%s written twice", fields[0])
+		}
+		samples[fields[0]] = value
+	}
+	return samples
+}
+
+// Counters and gauges come out under their labels, and histograms as cumulative buckets
+func TestWriteMetrics(t *testing.T) {
+	node := testNode(t)
+	metrics := node.metrics
+
+	metrics.packets_sent.add(DATA)
+	metrics.packets_sent.add(DATA)
+	metrics.packets_sent.add(SYN_ACK)
+	metrics.packets_received.add(ACK)
+	metrics.packets_received.add(0x1234) // No such type
+	metrics.retransmits_rto.Add(3)
+	metrics.retransmits_nak.Add(1)
+	metrics.checksum_failures.Add(4)
+	metrics.magic_failures.Add(5)
+	metrics.dropped_fragments.Add(6)
+	node.dropped_datagrams.Add(7)
+	metrics.referendums_timed_out.Add(8)
+
+	for _, rtt := range []float64{0.0005, 0.001, 0.02, 0.02, 5} {
+		metrics.rtt.observe(rtt)
+	}
+
+	// Two online conversations with unacked packets, one offline one
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	for id := uint32(1); id <= 3; id++ {
+		conv := newConversation(node, id, nil, addr)
+		conv.sender.outgoing[1] = &Pckt{}
+		conv.sender.outgoing[2] = &Pckt{AckReceived: true}
+		if id == 3 {
+			conv.setOffline()
+		}
+		node.conversations[id] = conv
+	}
+
+	samples := scrapeMetrics(t, node)
+	for sample, want := range map[string]float64{
+		`consensus_packets_total{direction="sent",type="data"}`:          2,
+		`consensus_packets_total{direction="sent",type="syn_ack"}`:       1,
+		`consensus_packets_total{direction="sent",type="nak"}`:           0,
+		`consensus_packets_total{direction="sent",type="other"}`:         0,
+		`consensus_packets_total{direction="received",type="ack"}`:       1,
+		`consensus_packets_total{direction="received",type="data"}`:      0,
+		`consensus_packets_total{direction="received",type="other"}`:     1,
+		`consensus_retransmits_total{reason="timeout"}`:                  3,
+		`consensus_retransmits_total{reason="nak"}`:                      1,
+		`consensus_checksum_failures_total`:                              4,
+		`consensus_magic_failures_total`:                                 5,
+		`consensus_dropped_fragments_total`:                              6,
+		`consensus_dropped_datagrams_total`:                              7,
+		`consensus_referendums_timed_out_total`:                          8,
+		`consensus_conversations{state="online"}`:                        2,
+		`consensus_conversations{state="offline"}`:                       1,
+		`consensus_outgoing_queue_depth`:                                 3,
+		`consensus_referendums_ongoing`:                                  0,
+		`consensus_rtt_seconds_bucket{le="0.001"}`:                       2,
+		`consensus_rtt_seconds_bucket{le="0.01"}`:                        2,
+		`consensus_rtt_seconds_bucket{le="0.025"}`:                       4,
+		`consensus_rtt_seconds_bucket{le="2.5"}`:                         4,
+		`consensus_rtt_seconds_bucket{le="+Inf"}`:                        5,
+		`consensus_rtt_seconds_sum`:                                      5.0415,
+		`consensus_rtt_seconds_count`:                                    5,
+		`consensus_referendum_time_to_verdict_seconds_bucket{le="+Inf"}`: 0,
+		`consensus_referendum_time_to_verdict_seconds_count`:             0,
+	} {
+		got, exists := samples[sample]
+		if !exists {
+			t.Errorf("%s missing", sample)
+		} else if got != want {
+			t.Errorf("%s is %g, want %g", sample, got, want)
+		}
+	}
+
+	// Every packet type has its label in both directions
+	for _, name := range packet_type_names {
+		for _, direction := range []string{"sent", "received"} {
+			if _, exists := samples[`consensus_packets_total{direction="`+direction+`",type="`+name+`"}`]; !exists {
+				t.Errorf("no %s sample for %s", direction, name)
+			}
+		}
+	}
+}
+
+// A histogram's buckets never go down and end at its count
+func TestHistogram(t *testing.T) {
+	h := newHistogram(1, 2, 4)
+	for _, value := range []float64{0, 1, 1.5, 2, 3, 4, 4.5, 100} {
+		h.observe(value)
+	}
+
+	want := []uint64{2, 2, 2, 2} // Upper bounds are inclusive: 0 and 1, 1.5 and 2, 3 and 4, then the rest
+	for i := range want {
+		if h.counts[i] != want[i] {
+			t.Errorf("bucket %d has %d, want %d", i, h.counts[i], want[i])
+		}
+	}
+	if h.count != 8 || h.sum != 116 {
+		t.Errorf("count %d, sum %g", h.count, h.sum)
+	}
+
+	var out strings.Builder
+	h.write(&out, "test", "A test.")
+	expected := `# HELP consensus_test A test.
+# TYPE consensus_test histogram
+consensus_test_bucket{le="1"} 2
+consensus_test_bucket{le="2"} 4
+consensus_test_bucket{le="4"} 6
+consensus_test_bucket{le="+Inf"} 8
+consensus_test_sum 116
+consensus_test_count 8
+`
+	if out.String() != expected {
+		t.Errorf("wrote\n%s\nwant\n%s", out.String(), expected)
+	}
+}
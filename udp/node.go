@@ -0,0 +1,469 @@
+// The Node, one end of the protocol, owns its sockets, conversations and referendums
+package core
+
+import (
+	"crypto/ecdh"
+	crypto_rand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Everything a node knows lives in its Node rather than in package globals, so any number of nodes can share
+// a process (a server and its clients in a test, or a service embedding the protocol). cmd/server and
+// cmd/client are thin commands around a single Node each.
+
+// A server or client node
+type Node struct {
+	// Settings
+	i_am_server       bool
+	defect_constant   atomic.Uint64 // Bits of the float64 chance, SetDefectChance changes it while workers answer
+	fec_group_size    uint16        // DATA packets per parity packet, 0 turns FEC off
+	pacing_rate       float64       // DATA packets per second per conversation, 0 paces by congestion window and RTT
+	node_pacing_rate  float64       // DATA packets per second for the whole node, 0 for no limit
+	batch_io          bool          // Read and write sockets a batch of datagrams at a time (recvmmsg/sendmmsg on Linux)
+	my_features       []uint16
+	vote_deadline     time.Duration // How long a referendum stays open unless its proposer asks otherwise
+	max_vote_deadline time.Duration // The longest a proposer may ask for
+	timeout_policy    string        // How a referendum still open at its deadline is closed (TIMEOUT_POLICY_*)
+	port              string        // Port for addresses given without one
+
+	// Subsystem loggers and their levels (logging.go)
+	log_levels    map[string]*slog.LevelVar
+	loggers       map[string]*slog.Logger
+	transport_log *slog.Logger
+	vote_log      *slog.Logger
+
+	// Windows and timers (see TransportSettings)
+	window_size        uint32
+	initial_cwnd       float64
+	loop_interval      time.Duration
+	initial_rto        time.Duration
+	min_rto            time.Duration
+	max_rto            time.Duration
+	keepalive_after    time.Duration
+	offline_after_syns uint64
+	ping_interval      time.Duration
+
+	// Sockets
+	conn         transport // A client's socket, connected to its server
+	serverAddr   *net.UDPAddr
+	listen_addrs []string    // Addresses a server listens at, IPv4 or IPv6, with or without a port
+	listen_conns []transport // Every transport the listener reads from
+	impairments  *impairment_table
+
+	// Conversations
+	conversation_id_self  uint32 // Read it with ConversationID, a client only gets it once Run is going
+	conversations_lock    sync.Mutex
+	conversations         map[uint32]*conversation
+	generatedConvIDs_lock sync.Mutex
+	generatedConvIDs      map[uint32]bool
+	ref_manager           *referendum_manager
+
+	// Incoming datagrams and pacing
+	worker_queues     []chan incoming_datagram
+	dropped_datagrams atomic.Uint64
+	node_pacer        *pacer // Shared by every conversation on this node
+	ping_limiter      *ip_limiter
+
+	// Prometheus metrics (metrics.go)
+	metrics      *node_metrics
+	metrics_addr string // Where /metrics is served, empty for nowhere
+
+	// Local admin API (admin.go)
+	admin_addr           string // Where the admin API is served, empty for nowhere
+	admin_token          string // Bearer token admin requests need, empty for none
+	bans_lock            sync.Mutex
+	banned_conversations map[uint32]bool
+	banned_addrs         map[string]bool // IPs
+
+	// Live dashboard (dashboard.go)
+	dashboard_addr string // Where the dashboard is served, empty for nowhere
+	dashboard      *dashboard_hub
+	dashboard_once sync.Once
+
+	// Shutting down (shutdown.go)
+	state_path    string // Where a server keeps its state across restarts, empty for nowhere
+	shutting_down atomic.Bool
+	closed        chan struct{} // Closed by Close
+	close_once    sync.Once
+
+	// Clock and randomness, simulated ones in a Simulation (simulation.go)
+	sim     *sim_node
+	rng     *rand.Rand // Conversation IDs, defecting, impairments
+	entropy io.Reader  // Keys and secrets
+
+	// HTTP servers for metrics, the admin API and the dashboard, closed with the node (http.go)
+	http_servers []*http.Server
+	http_lock    sync.Mutex
+
+	// Server secret, tickets and cookies (session.go, cookie.go)
+	server_secret       []byte
+	session_ticket_path string
+	ping_cookie         []byte // Latest cookie a client got from its server
+	ping_cookie_lock    sync.Mutex
+
+	// The client's key exchange, and the conversation key and token it got with its Conversation ID (token.go)
+	key_exchange       *ecdh.PrivateKey
+	client_key         []byte
+	conversation_token []byte
+	conversation_lock  sync.Mutex
+}
+
+// newNode creates a node with no transports yet
+func newNode(settings Settings, i_am_server bool) *Node {
+	node := &Node{
+		i_am_server:          i_am_server,
+		fec_group_size:       settings.Transport.FECGroupSize,
+		pacing_rate:          settings.Transport.PacingRate,
+		node_pacing_rate:     settings.Transport.NodePacingRate,
+		batch_io:             settings.Transport.BatchIO,
+		vote_deadline:        time.Duration(settings.Vote.Deadline),
+		max_vote_deadline:    time.Duration(settings.Vote.MaxDeadline),
+		timeout_policy:       settings.Vote.TimeoutPolicy,
+		port:                 settings.Port,
+		window_size:          settings.Transport.WindowSize,
+		initial_cwnd:         settings.Transport.InitialCwnd,
+		loop_interval:        time.Duration(settings.Transport.LoopInterval),
+		initial_rto:          time.Duration(settings.Transport.InitialRTO),
+		min_rto:              time.Duration(settings.Transport.MinRTO),
+		max_rto:              time.Duration(settings.Transport.MaxRTO),
+		keepalive_after:      time.Duration(settings.Transport.KeepaliveAfter),
+		offline_after_syns:   settings.Transport.OfflineAfterSYNs,
+		ping_interval:        time.Duration(settings.Transport.PingInterval),
+		impairments:          &impairment_table{profiles: make(map[string]impairment_profile)},
+		conversations:        make(map[uint32]*conversation),
+		generatedConvIDs:     make(map[uint32]bool),
+		node_pacer:           &pacer{},
+		ping_limiter:         &ip_limiter{buckets: make(map[string]*ip_bucket)},
+		metrics:              newNodeMetrics(),
+		metrics_addr:         settings.MetricsAddr,
+		admin_addr:           settings.AdminAddr,
+		admin_token:          settings.AdminToken,
+		dashboard_addr:       settings.DashboardAddr,
+		state_path:           settings.StatePath,
+		closed:               make(chan struct{}),
+		rng:                  rand.New(newLockedSource(time.Now().UnixNano())),
+		entropy:              crypto_rand.Reader,
+		banned_conversations: make(map[uint32]bool),
+		banned_addrs:         make(map[string]bool),
+		session_ticket_path:  settings.TicketPath,
+	}
+	node.defect_constant.Store(math.Float64bits(settings.Vote.DefectChance))
+	node.setupLogging(settings.Log)
+	node.ref_manager = newReferendumManager(node)
+
+	// Emulated network towards every peer, already validated
+	node.SetImpairment("", settings.Impairment)
+
+	node.my_features = make([]uint16, 3)
+	node.my_features[0] = simple_eval // Simple Math (boolean expression) Evaluation
+	node.my_features[1] = none        // SMT (Z3) Evaluation (not included in this project, planned for the future)
+	node.my_features[2] = none        // AI Image classification (not included in this project, planned for the future)
+
+	// Advertise Forward Error Correction if it's on
+	if node.fec_group_size > 0 {
+		node.my_features = append(node.my_features, fec_xor)
+	}
+
+	return node
+}
+
+// NewServer creates a server node listening at each of settings.Listen (IPv4 or IPv6, with or without a port),
+// addresses it can't listen at are skipped, it fails if there are none left
+func NewServer(settings Settings) (*Node, error) {
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	node := newNode(settings, true)
+
+	// Pick up the secret, handed out IDs and bans from before a restart
+	restored := false
+	if node.state_path != "" {
+		var err error
+		if restored, err = node.loadState(); err != nil {
+			return nil, err
+		}
+		if restored {
+			node.transport_log.Info("State restored", "path", node.state_path)
+		}
+	}
+
+	// Generate a Conversation ID for self, unless the state had one, its clients' conversations are under it
+	if node.conversation_id_self == 0 {
+		node.generatedConvIDs_lock.Lock()
+		node.conversation_id_self = node.generateConversationID()
+		node.generatedConvIDs_lock.Unlock()
+	}
+
+	// Key for signing Resumption Tickets
+	if !restored {
+		if err := node.generateServerSecret(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Set up a socket for each address
+	node.listen_addrs = settings.Listen
+	for _, listen_addr := range node.listen_addrs {
+		listen_conn, err := node.listenAt(listen_addr)
+		if err != nil {
+			node.transport_log.Error("Couldn't listen", "addr", listen_addr, "err", err)
+			continue
+		}
+
+		node.listen_conns = append(node.listen_conns, listen_conn)
+		node.transport_log.Info("UDP server listening", "addr", listen_conn.localAddr().String())
+	}
+
+	if len(node.listen_conns) == 0 {
+		return nil, errors.New("NewServer: no address to listen at")
+	}
+
+	return node, nil
+}
+
+// NewClient creates a client node for the server at settings.Server ("host", "host:port", "IPv6" or "[IPv6]:port")
+func NewClient(settings Settings) (*Node, error) {
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	node := newNode(settings, false)
+
+	// Resolve UDP Server Address to contact, the port is optional and IPv6 addresses may be bracketed
+	serverAddr, err := net.ResolveUDPAddr("udp", withDefaultPort(settings.Server, node.port))
+	if err != nil {
+		return nil, err
+	}
+	node.serverAddr = serverAddr
+
+	// Key pair our conversation key will be agreed with
+	if err := node.generateKeyExchange(); err != nil {
+		return nil, err
+	}
+
+	// Set up connection
+	udpConn, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let Path MTU Discovery see the real path
+	if err := setDontFragment(udpConn); err != nil {
+		node.transport_log.Warn("Couldn't disable fragmentation, Path MTU Discovery may overestimate", "err", err)
+	}
+
+	node.conn = newImpairedTransport(newUDPTransport(udpConn, node.batch_io), node)
+	node.listen_conns = []transport{node.conn}
+
+	return node, nil
+}
+
+// listenAt opens a socket at an address, IPv6 sockets only take IPv6 so they can share a port with an IPv4 one
+func (node *Node) listenAt(listen_addr string) (transport, error) {
+	addr, err := net.ResolveUDPAddr("udp", withDefaultPort(listen_addr, node.port))
+	if err != nil {
+		return nil, err
+	}
+
+	network := "udp6"
+	if addr.IP == nil || addr.IP.To4() != nil {
+		network = "udp4"
+	}
+
+	listen_conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let Path MTU Discovery see the real path
+	if err := setDontFragment(listen_conn); err != nil {
+		node.transport_log.Warn("Couldn't disable fragmentation, Path MTU Discovery may overestimate", "err", err)
+	}
+
+	return newImpairedTransport(newUDPTransport(listen_conn, node.batch_io), node), nil
+}
+
+// Run handles incoming packets until the node is closed, servers also mark quiet conversations offline
+func (node *Node) Run() {
+	if node.i_am_server {
+		go node.cleaner()
+	}
+
+	if node.metrics_addr != "" {
+		node.startHTTP("metrics", node.metrics_addr, node.metricsMux())
+	}
+	if node.admin_addr != "" {
+		// Without a token, it's up to the address to keep strangers out
+		if node.admin_token == "" && !isLoopback(node.admin_addr) {
+			node.transport_log.Warn("Serving the admin API beyond loopback", "addr", node.admin_addr)
+		}
+		node.startHTTP("admin API", node.admin_addr, node.AdminHandler())
+	}
+	if node.dashboard_addr != "" {
+		if node.admin_token == "" && !isLoopback(node.dashboard_addr) {
+			node.transport_log.Warn("Serving the dashboard beyond loopback", "addr", node.dashboard_addr)
+		}
+		node.startHTTP("dashboard", node.dashboard_addr, node.DashboardHandler())
+	}
+
+	node.listener()
+}
+
+// Connect gets a client a Conversation ID and a conversation with its server, it blocks until it has both
+// (Run has to be going for the answers to arrive), or until the node is closed
+func (node *Node) Connect() error {
+	for !node.connectStep() {
+		if !node.sleep(node.ping_interval) {
+			return net.ErrClosed
+		}
+	}
+
+	return nil
+}
+
+// connectStep sends whatever Connect needs next, returns true once the client has its conversation
+func (node *Node) connectStep() bool {
+	// Ping server for a Conversation ID if necessary
+	if node.ConversationID() == 0 {
+		// Send PING to server to obtain
+		node.sendPing(node.serverAddr)
+		return false
+	}
+
+	if node.server() != nil {
+		return true
+	}
+
+	// Send SYN until made contact with server
+	synPckt := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      node.ConversationID(),
+			PacketNum:   0,
+			SequenceNum: 0,
+			Type:        SYN,
+			IsFinal:     1,
+		},
+		Body: node.ownershipProof(),
+	}
+
+	// Send SYN to server to try make converstion
+	node.sendUDP(node.conn, node.serverAddr, &synPckt)
+	return false
+}
+
+// sleep waits for d, returns false straight away if the node is closed
+func (node *Node) sleep(d time.Duration) bool {
+	select {
+	case <-node.closed:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Close closes every transport, which stops Run, Shutdown is the graceful way
+func (node *Node) Close() error {
+	node.close_once.Do(func() {
+		close(node.closed)
+	})
+
+	// Conversations stop sending
+	for _, conv := range node.conversationsSnapshot() {
+		conv.stop()
+	}
+
+	var err error
+	node.closeHTTP()
+	for _, listen_conn := range node.listen_conns {
+		if closeErr := listen_conn.close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ConversationID returns the node's own Conversation ID, 0 while a client is still waiting for one
+func (node *Node) ConversationID() uint32 {
+	node.conversation_lock.Lock()
+	defer node.conversation_lock.Unlock()
+
+	return node.conversation_id_self
+}
+
+// server returns a client's conversation with its server, nil if there isn't one yet
+func (node *Node) server() *conversation {
+	node.conversations_lock.Lock()
+	defer node.conversations_lock.Unlock()
+
+	for _, server := range node.conversations {
+		return server
+	}
+	return nil
+}
+
+// SendHello sends the server another hello
+func (node *Node) SendHello() error {
+	server := node.server()
+	if server == nil {
+		return errors.New("SendHello: not connected to a server")
+	}
+
+	server.sendHello()
+	return nil
+}
+
+// SetDefectChance sets the chance (0-1) of this node answering a question wrong on purpose
+func (node *Node) SetDefectChance(chance float64) error {
+	if chance < 0 || chance > 1 {
+		return fmt.Errorf("SetDefectChance: %g isn't between 0 and 1", chance)
+	}
+
+	node.defect_constant.Store(math.Float64bits(chance))
+	return nil
+}
+
+// defectChance is the chance set with SetDefectChance
+func (node *Node) defectChance() float64 {
+	return math.Float64frombits(node.defect_constant.Load())
+}
+
+// Impairments lists the emulated network conditions towards each peer
+func (node *Node) Impairments() string {
+	return node.impairments.String()
+}
+
+// SetImpairment changes the emulated network conditions towards a peer (IP or IP:port, "" for the default),
+// settings look like "loss=0.2 latency=50ms jitter=10ms" (see applyImpairment)
+func (node *Node) SetImpairment(peer string, settings string) error {
+	var parseErr error
+	node.impairments.update(peer, func(profile *impairment_profile) {
+		changed := *profile
+		if parseErr = applyImpairment(&changed, settings, node.now()); parseErr == nil {
+			*profile = changed
+		}
+	})
+	return parseErr
+}
+
+// ResetImpairment drops a peer's impairments so the default applies to it again, resetting the default
+// itself leaves the network unimpaired
+func (node *Node) ResetImpairment(peer string) {
+	if peer == "" {
+		node.impairments.set("", impairment_profile{})
+	} else {
+		node.impairments.remove(peer)
+	}
+}
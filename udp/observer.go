@@ -0,0 +1,111 @@
+// Referendum lifecycle hooks, for embedders that want to persist, alert on or forward what a server's votes do
+package core
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Observers are called synchronously from the goroutine handling the packet that caused the event, often with
+// the referendum's locks held, so they must return quickly and mustn't call back into the Node. Anything slow
+// (writing to disk, talking to other systems) belongs on a goroutine or queue of the observer's own.
+
+// Told about every referendum a server hosts
+type ReferendumObserver interface {
+	// A client asked for a vote and the server started hosting it, proposer is its Conversation ID
+	ReferendumCreated(vote_id uuid.UUID, question string, proposer uint32)
+
+	// The online conversations able to vote were copied into the referendum, they're the only ones counted
+	ParticipantsSnapshot(vote_id uuid.UUID, participants []uint32)
+
+	// A participant's ballot was counted, duplicates and ballots from non-participants never get here
+	BallotReceived(vote_id uuid.UUID, voter uint32, response uint16)
+
+	// A response leads the runner up by more than the ballots left to cast (so a tie is never called, even
+	// with every ballot in), or the deadline passed and the timeout policy settled it (see
+	// Settings.Vote.TimeoutPolicy), early if some participants haven't voted yet
+	WinnerCalled(vote_id uuid.UUID, result uint16, early bool, tallies map[uint16]uint64)
+
+	// The result went out to recipients participants (and the verdict to the proposer)
+	ResultBroadcast(vote_id uuid.UUID, result uint16, recipients int)
+
+	// A conversation was set offline for inactivity, ongoing lists the undecided
+	// referendums it was still expected to vote in
+	ParticipantOffline(conversation_id uint32, ongoing []uuid.UUID)
+}
+
+// Does nothing, embed it to only implement the events you care about
+type NopReferendumObserver struct{}
+
+func (NopReferendumObserver) ReferendumCreated(uuid.UUID, string, uint32)             {}
+func (NopReferendumObserver) ParticipantsSnapshot(uuid.UUID, []uint32)                {}
+func (NopReferendumObserver) BallotReceived(uuid.UUID, uint32, uint16)                {}
+func (NopReferendumObserver) WinnerCalled(uuid.UUID, uint16, bool, map[uint16]uint64) {}
+func (NopReferendumObserver) ResultBroadcast(uuid.UUID, uint16, int)                  {}
+func (NopReferendumObserver) ParticipantOffline(uint32, []uuid.UUID)                  {}
+
+// Observe adds an observer for the referendums this node hosts
+func (node *Node) Observe(observer ReferendumObserver) {
+	manager := node.ref_manager
+
+	manager.observers_lock.Lock()
+	defer manager.observers_lock.Unlock()
+
+	manager.observers = append(manager.observers, observer)
+}
+
+// notify calls event on every observer
+func (manager *referendum_manager) notify(event func(observer ReferendumObserver)) {
+	manager.observers_lock.Lock()
+	observers := manager.observers
+	manager.observers_lock.Unlock()
+
+	for _, observer := range observers {
+		event(observer)
+	}
+}
+
+// participantIDs lists a referendum's participants in order (the caller must hold the referendum lock)
+func (h_referendum *host_referendum) participantIDs() []uint32 {
+	ids := make([]uint32, 0, len(h_referendum.participants))
+	for id := range h_referendum.participants {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// tallyCopy copies a referendum's counters, so observers can keep them (the caller must hold the referendum lock)
+func (h_referendum *host_referendum) tallyCopy() map[uint16]uint64 {
+	tallies := make(map[uint16]uint64, len(h_referendum.votes))
+	for response, count := range h_referendum.votes {
+		tallies[response] = count
+	}
+	return tallies
+}
+
+// Used by the cleaner when it sets a conversation offline
+func (manager *referendum_manager) participant_offline(participant *conversation) {
+	manager.h_referendums_lock.Lock()
+
+	var ongoing []uuid.UUID
+	for _, h_ref := range manager.h_referendums {
+		h_ref.referendum_lock.Lock()
+
+		_, isParticipant := h_ref.participants[participant.conversation_id]
+		_, hasVoted := h_ref.who[participant.conversation_id]
+
+		if h_ref.ongoing && isParticipant && !hasVoted {
+			ongoing = append(ongoing, h_ref.VoteID)
+		}
+
+		h_ref.referendum_lock.Unlock()
+	}
+
+	manager.h_referendums_lock.Unlock()
+
+	manager.notify(func(observer ReferendumObserver) {
+		observer.ParticipantOffline(participant.conversation_id, ongoing)
+	})
+}
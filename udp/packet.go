@@ -1,5 +1,5 @@
 // Defines the packet structure and provides functions for packet serialization and deserialization
-package main
+package core
 
 import (
 	"bytes"
@@ -30,6 +30,7 @@ type Pckt struct {
 	// Used with Selective Repeat, not actually sent
 	AckReceived bool      // Indicates if ACK has been received for the packet
 	LastSent    time.Time // The last time the packet was sent
+	TimesSent   uint32    // How many times the packet was sent, RTT is only sampled from packets sent once
 
 	// 24 + N <= 256 Bytes ideally
 }
@@ -52,7 +53,11 @@ func DeserializePacket(data []byte) (*Pckt, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Pckt{Header: *header, Body: data[24:]}, nil
+	// Copy the body out, the buffer it arrived in gets reused
+	body := make([]byte, len(data)-24)
+	copy(body, data[24:])
+
+	return &Pckt{Header: *header, Body: body}, nil
 }
 
 // SerializeHeader serializes the packet header into bytes.
@@ -1,11 +1,12 @@
 // Packet inside Packet, Communication and Consensus Packet Structures
 
 // Version 1.3
-package main
+package core
 
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 
 	"github.com/google/uuid"
 )
@@ -16,6 +17,9 @@ type PcktHello struct {
 	Version     uint32   // 4 bytes
 	NumFeatures uint16   // 2 bytes
 	Features    []uint16 // num_features*2 bytes
+
+	// Optional, older nodes don't send it
+	FECGroupSize uint16 // 2 bytes, DATA packets per parity packet this node would like, 0 if it doesn't care
 }
 
 type PcktHelloResponse PcktHello
@@ -28,6 +32,9 @@ type PcktVoteRequest struct {
 	VoteID         uuid.UUID // 16 bytes
 	QuestionLength uint32    // 4 bytes
 	Question       string    // QuestionLength bytes long
+
+	// Optional, older nodes don't send it
+	Deadline uint32 // 4 bytes, milliseconds the proposer wants the vote open for, 0 for the server's default
 }
 
 // /// Vote Broadcast,
@@ -43,6 +50,60 @@ type PcktVoteResponse struct {
 // /// Result Broadcast, once the server has received a satisfactory amount of votes, it calculates the winner and broadcasts the winning result
 type PcktVoteResultBroadcast PcktVoteResponse
 
+// /// Tally Update, sent unreliably by the server while a referendum is ongoing, a lost update is simply superseded by the next one
+type PcktVoteTally struct {
+	DataID       uint16           // 2 bytes
+	VoteID       uuid.UUID        // 16 bytes
+	Participants uint32           // 4 bytes
+	NumTallies   uint16           // 2 bytes
+	Tallies      []PcktTallyEntry // NumTallies*6 bytes
+}
+
+// /// Verdict, sent reliably by the server to the client that proposed a referendum once its result is called
+type PcktVoteVerdict struct {
+	DataID       uint16           // 2 bytes
+	VoteID       uuid.UUID        // 16 bytes
+	Result       uint16           // 2 bytes
+	Participants uint32           // 4 bytes
+	NumTallies   uint16           // 2 bytes
+	Tallies      []PcktTallyEntry // NumTallies*6 bytes
+}
+
+// One counter per response option
+type PcktTallyEntry struct {
+	Response uint16 // 2 bytes
+	Count    uint32 // 4 bytes
+}
+
+// /// Resumption Ticket, opaque to the client, handed back in a Ping Request after a restart
+type PcktResumptionTicket struct {
+	DataID       uint16 // 2 bytes
+	TicketLength uint16 // 2 bytes
+	Ticket       []byte // TicketLength bytes
+}
+
+// /// Ping Request body, not DATA so there's no Data ID, padded out to PING_MIN_BODY bytes
+type PcktPing struct {
+	TicketLength uint16 // 2 bytes
+	Ticket       []byte // TicketLength bytes, empty unless the client has a ticket to resume with
+	CookieLength uint16 // 2 bytes
+	Cookie       []byte // CookieLength bytes, empty until the server has sent a PING_RETRY
+	KeyLength    uint16 // 2 bytes
+	ClientKey    []byte // KeyLength bytes, the client's X25519 public key, the Conversation Token's key is agreed with it
+	ProofLength  uint16 // 2 bytes
+	Ownership    []byte // ProofLength bytes, empty unless there's a ticket, an Ownership Proof made with the key it was issued with
+}
+
+// /// Proof of owning a Conversation ID, the body of a client's SYN and SYN_ACK, not DATA so there's no Data ID
+type PcktOwnership struct {
+	CookieLength uint16 // 2 bytes
+	Cookie       []byte // CookieLength bytes, the newest cookie the server sent to this address
+	TokenLength  uint16 // 2 bytes
+	Token        []byte // TokenLength bytes, as handed out in the Ping Response
+	ProofLength  uint16 // 2 bytes
+	Proof        []byte // ProofLength bytes, MAC over the Conversation ID and cookie, keyed with the client key
+}
+
 // Used to check which Deserializer to use
 func DeserializeDataID(raw_data []byte) (uint16, error) {
 	var DataID uint16
@@ -81,6 +142,13 @@ func DeserializeHello(raw_data []byte) (*PcktHello, error) {
 		return nil, err
 	}
 
+	// Optional trailing fields, left at zero if missing
+	if buf.Len() >= 2 {
+		if err := binary.Read(buf, binary.BigEndian, &pckthello.FECGroupSize); err != nil {
+			return nil, err
+		}
+	}
+
 	return &pckthello, nil
 }
 
@@ -108,6 +176,11 @@ func SerializeHello(pckthello *PcktHello) ([]byte, error) {
 		return nil, err
 	}
 
+	// Store the FEC Group Size
+	if err := binary.Write(buf, binary.BigEndian, pckthello.FECGroupSize); err != nil {
+		return nil, err
+	}
+
 	return buf.Bytes(), nil
 }
 
@@ -143,6 +216,13 @@ func DeserializeVoteRequest(raw_data []byte) (*PcktVoteRequest, error) {
 	// Convert question_bytes to a string and store to the Question attribute in the struct
 	pcktvoterequest.Question = string(question_bytes)
 
+	// Optional trailing fields, left at zero if missing
+	if buf.Len() >= 4 {
+		if err := binary.Read(buf, binary.BigEndian, &pcktvoterequest.Deadline); err != nil {
+			return nil, err
+		}
+	}
+
 	return &pcktvoterequest, nil
 }
 
@@ -171,6 +251,11 @@ func SerializeVoteRequest(pcktvoterequest *PcktVoteRequest) ([]byte, error) {
 		return nil, err
 	}
 
+	// Store the Deadline
+	if err := binary.Write(buf, binary.BigEndian, pcktvoterequest.Deadline); err != nil {
+		return nil, err
+	}
+
 	return buf.Bytes(), nil
 }
 
@@ -217,3 +302,390 @@ func SerializeVoteResponse(pcktvoteresponse *PcktVoteResponse) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+// Deserialize Tally Update Packet
+func DeserializeVoteTally(raw_data []byte) (*PcktVoteTally, error) {
+	var pcktvotetally PcktVoteTally
+
+	buf := bytes.NewReader(raw_data)
+
+	// Extract the Data ID
+	if err := binary.Read(buf, binary.BigEndian, &pcktvotetally.DataID); err != nil {
+		return nil, err
+	}
+
+	// Extract the Vote ID
+	if err := binary.Read(buf, binary.BigEndian, &pcktvotetally.VoteID); err != nil {
+		return nil, err
+	}
+
+	// Extract the Number of Participants
+	if err := binary.Read(buf, binary.BigEndian, &pcktvotetally.Participants); err != nil {
+		return nil, err
+	}
+
+	// Extract the Number of Tallies to create a slice for them
+	if err := binary.Read(buf, binary.BigEndian, &pcktvotetally.NumTallies); err != nil {
+		return nil, err
+	}
+
+	// Don't trust the count further than the bytes that are actually there
+	if int(pcktvotetally.NumTallies)*binary.Size(PcktTallyEntry{}) > buf.Len() {
+		return nil, errors.New("DeserializeVoteTally: more tallies than the packet holds")
+	}
+
+	pcktvotetally.Tallies = make([]PcktTallyEntry, pcktvotetally.NumTallies)
+
+	// Extract the Tallies
+	if err := binary.Read(buf, binary.BigEndian, &pcktvotetally.Tallies); err != nil {
+		return nil, err
+	}
+
+	return &pcktvotetally, nil
+}
+
+// Serialize Tally Update Packet
+func SerializeVoteTally(pcktvotetally *PcktVoteTally) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvotetally.DataID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvotetally.VoteID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvotetally.Participants); err != nil {
+		return nil, err
+	}
+
+	// Store the actual number of tallies by checking the Tallies slice again
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktvotetally.Tallies))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvotetally.Tallies); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Deserialize Verdict Packet
+func DeserializeVoteVerdict(raw_data []byte) (*PcktVoteVerdict, error) {
+	var pcktvoteverdict PcktVoteVerdict
+
+	buf := bytes.NewReader(raw_data)
+
+	// Extract the Data ID
+	if err := binary.Read(buf, binary.BigEndian, &pcktvoteverdict.DataID); err != nil {
+		return nil, err
+	}
+
+	// Extract the Vote ID
+	if err := binary.Read(buf, binary.BigEndian, &pcktvoteverdict.VoteID); err != nil {
+		return nil, err
+	}
+
+	// Extract the Result
+	if err := binary.Read(buf, binary.BigEndian, &pcktvoteverdict.Result); err != nil {
+		return nil, err
+	}
+
+	// Extract the Number of Participants
+	if err := binary.Read(buf, binary.BigEndian, &pcktvoteverdict.Participants); err != nil {
+		return nil, err
+	}
+
+	// Extract the Number of Tallies to create a slice for them
+	if err := binary.Read(buf, binary.BigEndian, &pcktvoteverdict.NumTallies); err != nil {
+		return nil, err
+	}
+
+	// Don't trust the count further than the bytes that are actually there
+	if int(pcktvoteverdict.NumTallies)*binary.Size(PcktTallyEntry{}) > buf.Len() {
+		return nil, errors.New("DeserializeVoteVerdict: more tallies than the packet holds")
+	}
+
+	pcktvoteverdict.Tallies = make([]PcktTallyEntry, pcktvoteverdict.NumTallies)
+
+	// Extract the Tallies
+	if err := binary.Read(buf, binary.BigEndian, &pcktvoteverdict.Tallies); err != nil {
+		return nil, err
+	}
+
+	return &pcktvoteverdict, nil
+}
+
+// Serialize Verdict Packet
+func SerializeVoteVerdict(pcktvoteverdict *PcktVoteVerdict) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvoteverdict.DataID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvoteverdict.VoteID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvoteverdict.Result); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvoteverdict.Participants); err != nil {
+		return nil, err
+	}
+
+	// Store the actual number of tallies by checking the Tallies slice again
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktvoteverdict.Tallies))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktvoteverdict.Tallies); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Deserialize Resumption Ticket Packet
+func DeserializeResumptionTicket(raw_data []byte) (*PcktResumptionTicket, error) {
+	var pckticket PcktResumptionTicket
+
+	buf := bytes.NewReader(raw_data)
+
+	if err := binary.Read(buf, binary.BigEndian, &pckticket.DataID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &pckticket.TicketLength); err != nil {
+		return nil, err
+	}
+
+	pckticket.Ticket = make([]byte, pckticket.TicketLength)
+
+	if err := binary.Read(buf, binary.BigEndian, pckticket.Ticket); err != nil {
+		return nil, err
+	}
+
+	return &pckticket, nil
+}
+
+// Serialize Resumption Ticket Packet
+func SerializeResumptionTicket(pckticket *PcktResumptionTicket) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.BigEndian, pckticket.DataID); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pckticket.Ticket))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pckticket.Ticket); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Deserialize Ping Request body, fields missing from the end (older clients) are left empty
+func DeserializePing(raw_data []byte) (*PcktPing, error) {
+	var pcktping PcktPing
+
+	buf := bytes.NewReader(raw_data)
+
+	if buf.Len() < 2 {
+		return &pcktping, nil
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &pcktping.TicketLength); err != nil {
+		return nil, err
+	}
+
+	pcktping.Ticket = make([]byte, pcktping.TicketLength)
+
+	if err := binary.Read(buf, binary.BigEndian, pcktping.Ticket); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() < 2 {
+		return &pcktping, nil
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &pcktping.CookieLength); err != nil {
+		return nil, err
+	}
+
+	pcktping.Cookie = make([]byte, pcktping.CookieLength)
+
+	if err := binary.Read(buf, binary.BigEndian, pcktping.Cookie); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() < 2 {
+		return &pcktping, nil
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &pcktping.KeyLength); err != nil {
+		return nil, err
+	}
+
+	pcktping.ClientKey = make([]byte, pcktping.KeyLength)
+
+	if err := binary.Read(buf, binary.BigEndian, pcktping.ClientKey); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() < 2 {
+		return &pcktping, nil
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &pcktping.ProofLength); err != nil {
+		return nil, err
+	}
+
+	if int(pcktping.ProofLength) > buf.Len() {
+		return nil, errors.New("DeserializePing: ownership proof longer than the packet")
+	}
+
+	pcktping.Ownership = make([]byte, pcktping.ProofLength)
+
+	if err := binary.Read(buf, binary.BigEndian, pcktping.Ownership); err != nil {
+		return nil, err
+	}
+
+	// Anything left is padding
+	return &pcktping, nil
+}
+
+// Serialize Ping Request body
+func SerializePing(pcktping *PcktPing) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktping.Ticket))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktping.Ticket); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktping.Cookie))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktping.Cookie); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktping.ClientKey))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktping.ClientKey); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktping.Ownership))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktping.Ownership); err != nil {
+		return nil, err
+	}
+
+	// Pad it out, the server won't answer small Pings
+	if buf.Len() < PING_MIN_BODY {
+		buf.Write(make([]byte, PING_MIN_BODY-buf.Len()))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Deserialize Ownership Proof
+func DeserializeOwnership(raw_data []byte) (*PcktOwnership, error) {
+	var pcktownership PcktOwnership
+
+	buf := bytes.NewReader(raw_data)
+
+	if err := binary.Read(buf, binary.BigEndian, &pcktownership.CookieLength); err != nil {
+		return nil, err
+	}
+
+	if int(pcktownership.CookieLength) > buf.Len() {
+		return nil, errors.New("DeserializeOwnership: cookie longer than the packet")
+	}
+
+	pcktownership.Cookie = make([]byte, pcktownership.CookieLength)
+
+	if err := binary.Read(buf, binary.BigEndian, pcktownership.Cookie); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &pcktownership.TokenLength); err != nil {
+		return nil, err
+	}
+
+	if int(pcktownership.TokenLength) > buf.Len() {
+		return nil, errors.New("DeserializeOwnership: token longer than the packet")
+	}
+
+	pcktownership.Token = make([]byte, pcktownership.TokenLength)
+
+	if err := binary.Read(buf, binary.BigEndian, pcktownership.Token); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &pcktownership.ProofLength); err != nil {
+		return nil, err
+	}
+
+	if int(pcktownership.ProofLength) > buf.Len() {
+		return nil, errors.New("DeserializeOwnership: proof longer than the packet")
+	}
+
+	pcktownership.Proof = make([]byte, pcktownership.ProofLength)
+
+	if err := binary.Read(buf, binary.BigEndian, pcktownership.Proof); err != nil {
+		return nil, err
+	}
+
+	return &pcktownership, nil
+}
+
+// Serialize Ownership Proof
+func SerializeOwnership(pcktownership *PcktOwnership) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktownership.Cookie))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktownership.Cookie); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktownership.Token))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktownership.Token); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(pcktownership.Proof))); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, pcktownership.Proof); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
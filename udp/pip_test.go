@@ -0,0 +1,72 @@
+package core
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Tallies and verdicts read back as they were written, and one cut short, or claiming more tallies than it
+// holds, is refused rather than read past its end or used to allocate the count it claims
+func TestDeserializeTallies(t *testing.T) {
+	tallies := []PcktTallyEntry{{Response: 1, Count: 3}, {Response: 2, Count: 1}}
+
+	tally, err := SerializeVoteTally(&PcktVoteTally{DataID: vote_s2c_tally_update, VoteID: uuid.New(), Participants: 4, NumTallies: 2, Tallies: tallies})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verdict, err := SerializeVoteVerdict(&PcktVoteVerdict{DataID: vote_s2c_verdict, VoteID: uuid.New(), Result: 1, Participants: 4, NumTallies: 2, Tallies: tallies})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		body        []byte
+		deserialize func([]byte) ([]PcktTallyEntry, error)
+	}{
+		{"tally", tally, func(raw []byte) ([]PcktTallyEntry, error) {
+			pckt, err := DeserializeVoteTally(raw)
+			if err != nil {
+				return nil, err
+			}
+			return pckt.Tallies, nil
+		}},
+		{"verdict", verdict, func(raw []byte) ([]PcktTallyEntry, error) {
+			pckt, err := DeserializeVoteVerdict(raw)
+			if err != nil {
+				return nil, err
+			}
+			return pckt.Tallies, nil
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.deserialize(test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tallies) || got[0] != tallies[0] || got[1] != tallies[1] {
+				t.Errorf("read back %v, expected %v", got, tallies)
+			}
+
+			// Every truncation, down to the header
+			for length := 0; length < len(test.body); length++ {
+				if got, err := test.deserialize(test.body[:length]); err == nil {
+					t.Errorf("%d of %d bytes accepted as %v", length, len(test.body), got)
+				}
+			}
+
+			// The count is the last thing before the tallies, claim the most there can be with none following
+			header := len(test.body) - len(tallies)*binary.Size(PcktTallyEntry{})
+			lying := append([]byte{}, test.body[:header]...)
+			binary.BigEndian.PutUint16(lying[header-2:], 0xffff)
+			if got, err := test.deserialize(lying); err == nil {
+				t.Errorf("%d tallies claimed with none there, accepted as %d", 0xffff, len(got))
+			} else if !strings.Contains(err.Error(), "more tallies than the packet holds") {
+				t.Errorf("%d tallies claimed with none there, refused only when reading them: %v", 0xffff, err)
+			}
+		})
+	}
+}
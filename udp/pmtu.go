@@ -0,0 +1,221 @@
+// Path MTU Discovery, probes for the largest datagram that gets through to the other node
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Each conversation runs its own search (in the style of RFC 8899, Packetization Layer PMTUD),
+// sending PROBE packets padded out to a candidate size, the other node answers with a PROBE_ACK
+// carrying the size it received, and the largest acknowledged size becomes the conversation's
+// packet size limit. Probes that go unanswered are taken to be too big for the path.
+//
+// The path can shrink under us too (a route change), and then nothing bigger than the new limit
+// arrives and nothing tells us why. When DATA packets bigger than the base size time out too many
+// times in a row, without one of them getting through in between, the limit drops back to the base
+// size and the search starts over.
+
+const (
+	PMTU_BASE_SIZE      = PCKT_HEADER_SIZE + MAX_PCKT_SIZE // Always assumed to get through
+	PMTU_MAX_SIZE       = LISTEN_BUFFER_SIZE               // Nothing bigger fits in the listener's buffer
+	PMTU_MAX_PROBES     = 3                                // Unanswered probes before a size is taken to be too big
+	PMTU_GRANULARITY    = 16                               // Stop searching once the range is this narrow
+	PMTU_PROBE_TIMEOUT  = 1000 * time.Millisecond
+	PMTU_RAISE_INTERVAL = 10 * time.Minute // How long to wait before searching for a bigger size again
+	PMTU_BLACK_HOLE_RTO = 3                // Timeouts in a row on packets above the base size before the path is taken to have shrunk
+	PMTU_NO_PROBE       = 0
+)
+
+type pmtu_state struct {
+	lock sync.Mutex
+
+	// Largest confirmed datagram size (header included)
+	size uint32
+
+	// Search range, low is always confirmed, high is the largest size not yet ruled out
+	low  uint32
+	high uint32
+
+	// Size of the probe in flight (0 if none) and how many times it was sent
+	probing    uint32
+	probeCount int
+	lastProbe  time.Time
+
+	// When the last search finished (zero while searching)
+	searchDone time.Time
+
+	// Retransmission timeouts in a row on packets bigger than the base size
+	bigTimeouts int
+}
+
+func newPMTUState() *pmtu_state {
+	return &pmtu_state{
+		size: PMTU_BASE_SIZE,
+		low:  PMTU_BASE_SIZE,
+		high: PMTU_MAX_SIZE,
+	}
+}
+
+// maxBodySize returns the largest body that fits in one packet for this conversation
+func (conv *conversation) maxBodySize() int {
+	conv.pmtu.lock.Lock()
+	defer conv.pmtu.lock.Unlock()
+
+	return int(conv.pmtu.size) - PCKT_HEADER_SIZE
+}
+
+// probePMTU moves the search along, called on every loop of the conversation
+func (conv *conversation) probePMTU() {
+	// Don't waste probes on a node that isn't there
+	if !conv.isOnline() {
+		return
+	}
+
+	conv.pmtu.lock.Lock()
+	defer conv.pmtu.lock.Unlock()
+
+	state := conv.pmtu
+
+	// Search finished, start again from the current size once in a while in case the path got bigger
+	if !state.searchDone.IsZero() {
+		if conv.node.since(state.searchDone) < PMTU_RAISE_INTERVAL {
+			return
+		}
+		state.low = state.size
+		state.high = PMTU_MAX_SIZE
+		state.searchDone = time.Time{}
+	}
+
+	// Probe in flight
+	if state.probing != PMTU_NO_PROBE {
+		if conv.node.since(state.lastProbe) < PMTU_PROBE_TIMEOUT {
+			return
+		}
+
+		// Too many unanswered probes, this size doesn't make it through
+		if state.probeCount >= PMTU_MAX_PROBES {
+			state.high = state.probing - 1
+			state.probing = PMTU_NO_PROBE
+		} else {
+			conv.sendProbe(state.probing)
+			return
+		}
+	}
+
+	// Range is narrow enough, settle on what we have
+	if state.high-state.low < PMTU_GRANULARITY {
+		state.searchDone = conv.node.now()
+		conv.transport_log.Debug("Path MTU settled", "bytes", state.size)
+		return
+	}
+
+	// Binary search for the next size to try
+	state.probing = state.low + (state.high-state.low+1)/2
+	state.probeCount = 0
+	conv.sendProbe(state.probing)
+}
+
+// pmtuTimedOut counts a retransmission timeout on a packet of size bytes, and falls back to the base size
+// if too many big ones have in a row
+func (conv *conversation) pmtuTimedOut(size int) {
+	if size <= PMTU_BASE_SIZE {
+		return
+	}
+
+	conv.pmtu.lock.Lock()
+	defer conv.pmtu.lock.Unlock()
+
+	// Already there, a packet queued while the limit was bigger can't be made to fit by falling back further
+	state := conv.pmtu
+	if state.size <= PMTU_BASE_SIZE {
+		return
+	}
+
+	state.bigTimeouts += 1
+	if state.bigTimeouts < PMTU_BLACK_HOLE_RTO {
+		return
+	}
+
+	conv.transport_log.Info("Path MTU black hole, back to the base size", "bytes", state.size, "timeouts", state.bigTimeouts)
+
+	// Search below the size that stopped working, the raise interval looks above it again later
+	state.high = state.size - 1
+	state.size = PMTU_BASE_SIZE
+	state.low = PMTU_BASE_SIZE
+	state.probing = PMTU_NO_PROBE
+	state.searchDone = time.Time{}
+	state.bigTimeouts = 0
+}
+
+// pmtuAcked notes a packet of size bytes got through, so the path isn't a black hole for it
+func (conv *conversation) pmtuAcked(size int) {
+	if size <= PMTU_BASE_SIZE {
+		return
+	}
+
+	conv.pmtu.lock.Lock()
+	defer conv.pmtu.lock.Unlock()
+
+	conv.pmtu.bigTimeouts = 0
+}
+
+// sendProbe sends a PROBE padded out to size bytes (the caller must hold the pmtu lock)
+func (conv *conversation) sendProbe(size uint32) {
+	conv.pmtu.probeCount += 1
+	conv.pmtu.lastProbe = conv.node.now()
+
+	probePacket := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      conv.node.ConversationID(),
+			PacketNum:   size,
+			SequenceNum: 0,
+			Type:        PROBE,
+			IsFinal:     1,
+		},
+		Body: make([]byte, size-PCKT_HEADER_SIZE),
+	}
+
+	// The kernel refuses datagrams bigger than the local interface allows, no need to wait for a timeout
+	if err := conv.sendPacket(&probePacket); err != nil {
+		conv.pmtu.probeCount = PMTU_MAX_PROBES
+		conv.pmtu.lastProbe = time.Time{}
+	}
+}
+
+// sendProbeACK tells the other node how big the probe it sent us was
+func (conv *conversation) sendProbeACK(size uint32) {
+	probeAckPacket := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      conv.node.ConversationID(),
+			PacketNum:   size,
+			SequenceNum: 0,
+			Type:        PROBE_ACK,
+			IsFinal:     1,
+		},
+		Body: []byte{},
+	}
+
+	conv.sendPacket(&probeAckPacket)
+}
+
+// handleProbeACK raises the packet size limit when the probe in flight made it through
+func (conv *conversation) handleProbeACK(size uint32) {
+	conv.pmtu.lock.Lock()
+	defer conv.pmtu.lock.Unlock()
+
+	// Only the probe in flight counts, anything else is a late duplicate
+	if size != conv.pmtu.probing {
+		return
+	}
+
+	conv.pmtu.low = size
+	conv.pmtu.probing = PMTU_NO_PROBE
+	if size > conv.pmtu.size {
+		conv.pmtu.size = size
+	}
+}
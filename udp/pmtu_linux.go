@@ -0,0 +1,32 @@
+//go:build linux
+
+package core
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment stops the kernel from fragmenting (or shrinking) our datagrams on its own,
+// so a probe too big for the path gets dropped instead of quietly getting through in pieces
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// Only one of these applies to an IPv4 socket, IPv6 sockets may carry IPv4 traffic too
+		errV4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		errV6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		if errV4 != nil && errV6 != nil {
+			sockErr = errV4
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package core
+
+import "net"
+
+// setDontFragment is only implemented on Linux, elsewhere probes rely on the platform's defaults
+func setDontFragment(conn *net.UDPConn) error {
+	return nil
+}
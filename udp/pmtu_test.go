@@ -0,0 +1,116 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// Big packets timing out in a row drop the limit back to the base size and restart the search below the
+// old limit, one of them getting through in between, or small ones timing out, doesn't
+func TestPMTUBlackHole(t *testing.T) {
+	conv := testConversation(t)
+	node := conv.node
+
+	const settled = 1400
+	conv.pmtu.size, conv.pmtu.low, conv.pmtu.searchDone = settled, settled, node.now()
+
+	for i := 0; i < 2*PMTU_BLACK_HOLE_RTO; i++ {
+		conv.pmtuTimedOut(PMTU_BASE_SIZE)
+	}
+	for i := 0; i < PMTU_BLACK_HOLE_RTO-1; i++ {
+		conv.pmtuTimedOut(settled)
+	}
+	conv.pmtuAcked(settled)
+	for i := 0; i < PMTU_BLACK_HOLE_RTO-1; i++ {
+		conv.pmtuTimedOut(settled)
+	}
+	if conv.maxBodySize() != settled-PCKT_HEADER_SIZE {
+		t.Fatalf("limit dropped to %d without %d big timeouts in a row", conv.maxBodySize()+PCKT_HEADER_SIZE, PMTU_BLACK_HOLE_RTO)
+	}
+
+	conv.pmtuTimedOut(settled)
+	if conv.maxBodySize() != MAX_PCKT_SIZE {
+		t.Fatalf("limit %d after a black hole, expected the base size %d", conv.maxBodySize()+PCKT_HEADER_SIZE, PMTU_BASE_SIZE)
+	}
+	if conv.pmtu.low != PMTU_BASE_SIZE || conv.pmtu.high != settled-1 || !conv.pmtu.searchDone.IsZero() {
+		t.Errorf("search range %d-%d (done %v), expected a new search from %d to %d", conv.pmtu.low, conv.pmtu.high, !conv.pmtu.searchDone.IsZero(), PMTU_BASE_SIZE, settled-1)
+	}
+
+	// A packet still queued at the old size timing out again doesn't break the new search
+	for i := 0; i < PMTU_BLACK_HOLE_RTO; i++ {
+		conv.pmtuTimedOut(settled)
+	}
+	if conv.pmtu.high != settled-1 {
+		t.Errorf("search range up to %d, expected %d", conv.pmtu.high, settled-1)
+	}
+}
+
+// A verdict with more tallies than fit in the path's packets goes out anyway, with the biggest tallies, and
+// follows the limit up and down
+func TestVerdictFitsPacket(t *testing.T) {
+	conv := testConversation(t)
+
+	h_ref := &host_referendum{participants: map[uint32]*conversation{}, votes: map[uint16]uint64{}}
+	for response := uint16(0); response < 200; response++ {
+		h_ref.votes[response] = uint64(response) + 1
+	}
+
+	verdictAt := func(size uint32) *PcktVoteVerdict {
+		t.Helper()
+
+		conv.pmtu.size = size
+		conv.sender.outgoing_lock.Lock()
+		sent := conv.sender.outgoing[conv.sender.nextPcktNum-1]
+		conv.sender.outgoing_lock.Unlock()
+
+		h_ref.referendum_lock.Lock()
+		conv.sendVerdictToClient(h_ref)
+		h_ref.referendum_lock.Unlock()
+
+		conv.sender.outgoing_lock.Lock()
+		defer conv.sender.outgoing_lock.Unlock()
+		pckt := conv.sender.outgoing[conv.sender.nextPcktNum-1]
+		if pckt == nil || pckt == sent {
+			t.Fatalf("no verdict queued at %d bytes", size)
+		}
+		if len(pckt.Body) > conv.maxBodySize() {
+			t.Fatalf("%d byte verdict queued with a %d byte limit", len(pckt.Body), conv.maxBodySize())
+		}
+
+		verdict, err := DeserializeVoteVerdict(pckt.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verdict
+	}
+
+	small := verdictAt(PMTU_BASE_SIZE)
+	if len(small.Tallies) == 0 || len(small.Tallies) >= len(h_ref.votes) {
+		t.Fatalf("%d tallies at the base size", len(small.Tallies))
+	}
+	for i, tally := range small.Tallies {
+		if want := uint16(len(h_ref.votes) - 1 - i); tally.Response != want {
+			t.Fatalf("tally %d is for %d, expected the biggest ones first (%d)", i, tally.Response, want)
+		}
+	}
+
+	if big := verdictAt(PMTU_MAX_SIZE); len(big.Tallies) != len(h_ref.votes) {
+		t.Errorf("%d of %d tallies with room for all of them", len(big.Tallies), len(h_ref.votes))
+	}
+}
+
+// A question that wouldn't fit in the smallest packet is refused before it goes anywhere
+func TestQuestionTooLong(t *testing.T) {
+	node := testNode(t)
+	if _, _, err := node.propose(strings.Repeat("1", MAX_QUESTION_SIZE+1), 0); err == nil || !strings.Contains(err.Error(), "fit") {
+		t.Errorf("got %v", err)
+	}
+
+	request, err := SerializeVoteRequest(&PcktVoteRequest{DataID: vote_c2s_request_vote, Question: strings.Repeat("1", MAX_QUESTION_SIZE)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request) != MAX_PCKT_SIZE {
+		t.Errorf("longest question makes a %d byte request, expected exactly %d", len(request), MAX_PCKT_SIZE)
+	}
+}
@@ -0,0 +1,134 @@
+// Proposing referendums from code, and waiting for their verdict
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Propose makes up the VoteID itself and registers it before the request goes out, so the verdict can't
+// arrive before anyone is waiting for it. The server remembers which conversation asked for each referendum,
+// and once the result is called sends that client a vote_s2c_verdict (reliably, unlike tally updates) with
+// the result and the final tally, whether or not the proposer was a participant itself.
+//
+// The server closes a referendum at its deadline if it's still open by then (see Settings.Vote.TimeoutPolicy),
+// the proposer may ask for a deadline of its own in the request, otherwise the server's default applies.
+
+// The outcome of a referendum, as the server called it
+type Verdict struct {
+	VoteID       uuid.UUID
+	Question     string
+	Result       uint16            // SAT, UNSAT, SYNTAX_ERROR, or TIMEOUT when the server's timeout policy says so or Propose gave up waiting
+	Participants uint32            // Nodes asked to vote
+	Tallies      map[uint16]uint32 // Ballots cast for each response, the rarest are left out if they don't all fit in a packet
+}
+
+// Propose asks the server to hold a referendum on a question (of at most MAX_QUESTION_SIZE bytes), and waits
+// for the verdict or for ctx to be done, in which case the returned Verdict still carries the VoteID (with a
+// TIMEOUT result) along with ctx's error
+func (node *Node) Propose(ctx context.Context, question string) (Verdict, error) {
+	return node.ProposeWithDeadline(ctx, question, 0)
+}
+
+// ProposeWithDeadline is Propose asking the server to close the referendum after deadline rather than its
+// default (0), a server refuses deadlines past its Settings.Vote.MaxDeadline with a TIMEOUT verdict
+func (node *Node) ProposeWithDeadline(ctx context.Context, question string, deadline time.Duration) (Verdict, error) {
+	voteid, waiting, err := node.propose(question, deadline)
+	if err != nil {
+		return Verdict{VoteID: voteid, Question: question, Result: TIMEOUT}, err
+	}
+	defer node.ref_manager.forgetProposal(voteid)
+
+	verdict := Verdict{
+		VoteID:   voteid,
+		Question: question,
+		Result:   TIMEOUT,
+	}
+
+	select {
+	case decided := <-waiting:
+		decided.Question = question
+		return decided, nil
+	case <-ctx.Done():
+		return verdict, ctx.Err()
+	}
+}
+
+// propose sends the request for a referendum, the verdict turns up on the returned channel, which is
+// registered before the request goes out in case the verdict comes back quickly. It's forgotten once the
+// verdict is delivered, or by forgetProposal for a caller that gives up waiting.
+func (node *Node) propose(question string, deadline time.Duration) (uuid.UUID, chan Verdict, error) {
+	if deadline != 0 && (deadline < time.Millisecond || deadline.Milliseconds() > math.MaxUint32) {
+		return uuid.UUID{}, nil, fmt.Errorf("Propose: deadline %s isn't between 1ms and %s", deadline, time.Duration(math.MaxUint32)*time.Millisecond)
+	}
+
+	if len(question) > MAX_QUESTION_SIZE {
+		return uuid.UUID{}, nil, fmt.Errorf("Propose: question is %d bytes, no more than %d fit in a packet", len(question), MAX_QUESTION_SIZE)
+	}
+
+	if node.ShuttingDown() {
+		return uuid.UUID{}, nil, ErrShuttingDown
+	}
+
+	server := node.server()
+	if server == nil {
+		return uuid.UUID{}, nil, errors.New("Propose: not connected to a server")
+	}
+
+	voteid, err := uuid.NewRandomFromReader(node.entropy)
+	if err != nil {
+		return uuid.UUID{}, nil, err
+	}
+
+	waiting := make(chan Verdict, 1)
+	manager := node.ref_manager
+
+	manager.proposals_lock.Lock()
+	manager.proposals[voteid] = waiting
+	manager.proposals_lock.Unlock()
+
+	if err := server.sendVoteRequestToServer(voteid, question, deadline); err != nil {
+		manager.forgetProposal(voteid)
+		return voteid, nil, err
+	}
+
+	return voteid, waiting, nil
+}
+
+// forgetProposal stops waiting for a verdict
+func (manager *referendum_manager) forgetProposal(vote_id uuid.UUID) {
+	manager.proposals_lock.Lock()
+	delete(manager.proposals, vote_id)
+	manager.proposals_lock.Unlock()
+}
+
+// Used by the Packet Processor when the PcktVoteVerdict packet comes in on a client
+func (manager *referendum_manager) handle_verdict_from_server(pckt *PcktVoteVerdict) {
+	manager.proposals_lock.Lock()
+	defer manager.proposals_lock.Unlock()
+
+	// Nobody waiting, Propose gave up already (or a retransmitted verdict)
+	waiting, exists := manager.proposals[pckt.VoteID]
+	if !exists {
+		manager.node.vote_log.Debug("Nobody is waiting for the verdict", "vote_id", pckt.VoteID)
+		return
+	}
+	delete(manager.proposals, pckt.VoteID)
+
+	verdict := Verdict{
+		VoteID:       pckt.VoteID,
+		Result:       pckt.Result,
+		Participants: pckt.Participants,
+		Tallies:      make(map[uint16]uint32),
+	}
+	for _, tally := range pckt.Tallies {
+		verdict.Tallies[tally.Response] = tally.Count
+	}
+
+	waiting <- verdict
+}
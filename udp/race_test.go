@@ -0,0 +1,177 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Race tests, everything the API lets another goroutine do to a node while votes run, only meaningful
+// with go test -race
+
+// hammer calls each of work in a loop on its own goroutine until the returned stop is called
+func hammer(work ...func()) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for _, w := range work {
+		wg.Add(1)
+		go func(w func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w()
+				time.Sleep(time.Millisecond)
+			}
+		}(w)
+	}
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// get requests path from handler, throwing the answer away
+func get(handler http.Handler, path string) {
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+// Every client proposes at once, every referendum is decided and reaches everyone
+func TestRaceConcurrentProposals(t *testing.T) {
+	network := startLoopback(t, LOOPBACK_CLIENTS, "loss=0.1 duplicates=1")
+
+	verdicts := make([]Verdict, len(network.clients))
+	errs := make([]error, len(network.clients))
+	var wg sync.WaitGroup
+
+	for i, client := range network.clients {
+		wg.Add(1)
+		go func(i int, client *Node) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), LOOPBACK_TIMEOUT)
+			defer cancel()
+			verdicts[i], errs[i] = client.Propose(ctx, fmt.Sprintf("%d + 1 > %d", i, i))
+		}(i, client)
+	}
+	wg.Wait()
+
+	for i, verdict := range verdicts {
+		if errs[i] != nil {
+			t.Fatalf("client %d: %v", i, errs[i])
+		}
+		if verdict.Result != SAT {
+			t.Errorf("client %d: result %d, expected SAT", i, verdict.Result)
+		}
+		network.allHold(t, verdict, SAT)
+	}
+
+	if hosted := len(network.server.Referendums()); hosted != len(network.clients) {
+		t.Errorf("server hosted %d referendums, expected %d", hosted, len(network.clients))
+	}
+}
+
+// The admin API, metrics, dashboard and runtime settings are read and changed while votes go on
+func TestRaceObservers(t *testing.T) {
+	network := startLoopback(t, LOOPBACK_CLIENTS, "loss=0.1")
+	server := network.server
+	server.Observe(NopReferendumObserver{})
+
+	admin, metrics, dashboard := server.AdminHandler(), server.MetricsHandler(), server.DashboardHandler()
+	work := []func(){
+		func() { get(admin, "/conversations") },
+		func() { get(admin, "/referendums") },
+		func() { get(admin, "/impairments") },
+		func() { get(metrics, "/metrics") },
+		func() { get(dashboard, "/api/referendums") },
+		func() { server.SetImpairment("", "loss=0.1") },
+		func() { server.SetLogLevel(LOG_VOTE, "debug") },
+	}
+	for _, client := range network.clients {
+		client := client
+		work = append(work,
+			func() { client.writeMetrics(io.Discard) },
+			func() { client.Conversations() },
+			func() { client.SetDefectChance(0) },
+			func() { client.ConversationID() },
+		)
+	}
+
+	stop := hammer(work...)
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		verdict := network.propose(t, "2 * 2 == 4")
+		if verdict.Result != SAT {
+			t.Errorf("result %d, expected SAT", verdict.Result)
+		}
+		network.allHold(t, verdict, SAT)
+	}
+}
+
+// A kicked client's conversation is torn down while the rest keep voting
+func TestRaceKick(t *testing.T) {
+	network := startLoopback(t, LOOPBACK_CLIENTS, "")
+
+	kicked := network.clients[LOOPBACK_CLIENTS-1].ConversationID()
+
+	proposed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), LOOPBACK_TIMEOUT)
+		defer cancel()
+		_, err := network.clients[0].Propose(ctx, "1 < 2")
+		proposed <- err
+	}()
+
+	if err := network.server.Kick(kicked); err != nil {
+		t.Fatal(err)
+	}
+	network.server.clean()
+
+	if err := <-proposed; err != nil {
+		t.Fatal(err)
+	}
+	for _, conv := range network.server.conversationsSnapshot() {
+		if conv.conversation_id == kicked && conv.isOnline() {
+			t.Errorf("kicked conversation %d is still online", kicked)
+		}
+	}
+
+	verdict := network.propose(t, "1 < 2")
+	if verdict.Result != SAT {
+		t.Errorf("result %d, expected SAT", verdict.Result)
+	}
+}
+
+// The server shuts down while a vote is on, the proposer hears back either way
+func TestRaceShutdown(t *testing.T) {
+	network := startLoopback(t, LOOPBACK_CLIENTS, "loss=0.1")
+
+	proposed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), LOOPBACK_TIMEOUT)
+		defer cancel()
+		_, err := network.clients[0].Propose(ctx, "2 > 1")
+		proposed <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), LOOPBACK_TIMEOUT)
+	defer cancel()
+	network.server.Shutdown(ctx)
+
+	select {
+	case <-proposed:
+	case <-time.After(2 * LOOPBACK_TIMEOUT):
+		t.Fatal("Propose never returned")
+	}
+}
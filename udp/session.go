@@ -0,0 +1,246 @@
+// Session Resumption, lets a restarted client reclaim its previous Conversation ID
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// A ticket alone is worth nothing, the client also proves it still holds the conversation key (see token.go).
+
+const (
+	TICKET_LIFETIME = 24 * time.Hour
+	TICKET_MAC_SIZE = sha256.Size
+	TICKET_SIZE     = 4 + 8 + TICKET_MAC_SIZE // ConvID + IssuedAt + MAC
+)
+
+// What the client writes to its session_ticket_path
+type saved_ticket struct {
+	Server       string `json:"server"`
+	Conversation uint32 `json:"conversation"`
+	Ticket       []byte `json:"ticket"`
+	Token        []byte `json:"token"` // Conversation Token we had when the ticket came
+	Key          []byte `json:"key"`   // Client key the token was issued to
+}
+
+// generateServerSecret creates the key tickets are signed with, a server with Settings.StatePath keeps it
+// across restarts (see saveState), so its tickets stay valid
+func (node *Node) generateServerSecret() error {
+	node.server_secret = make([]byte, 32)
+	_, err := io.ReadFull(node.entropy, node.server_secret)
+	return err
+}
+
+// ticketMAC signs a Conversation ID and issue time
+func (node *Node) ticketMAC(conversation_id uint32, issuedAt int64) []byte {
+	mac := hmac.New(sha256.New, node.server_secret)
+	binary.Write(mac, binary.BigEndian, conversation_id)
+	binary.Write(mac, binary.BigEndian, issuedAt)
+	return mac.Sum(nil)
+}
+
+// issueTicket creates a resumption ticket for a Conversation ID, a MAC over it and the issue time keyed with
+// the server secret
+func (node *Node) issueTicket(conversation_id uint32) []byte {
+	issuedAt := node.now().Unix()
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, conversation_id)
+	binary.Write(buf, binary.BigEndian, issuedAt)
+	buf.Write(node.ticketMAC(conversation_id, issuedAt))
+
+	return buf.Bytes()
+}
+
+// verifyTicket returns the Conversation ID a ticket was issued for, if it's genuine and hasn't expired
+func (node *Node) verifyTicket(ticket []byte) (uint32, error) {
+	if len(node.server_secret) == 0 {
+		return 0, errors.New("verifyTicket: this node doesn't issue tickets")
+	}
+
+	if len(ticket) != TICKET_SIZE {
+		return 0, errors.New("verifyTicket: wrong ticket size")
+	}
+
+	conversation_id := binary.BigEndian.Uint32(ticket[0:4])
+	issuedAt := int64(binary.BigEndian.Uint64(ticket[4:12]))
+
+	if !hmac.Equal(node.ticketMAC(conversation_id, issuedAt), ticket[12:]) {
+		return 0, errors.New("verifyTicket: bad MAC")
+	}
+
+	if node.since(time.Unix(issuedAt, 0)) > TICKET_LIFETIME {
+		return 0, errors.New("verifyTicket: ticket expired")
+	}
+
+	return conversation_id, nil
+}
+
+// saveTicket keeps the newest ticket from a server on disk, with what we need to prove it's ours
+func (node *Node) saveTicket(server string, ticket []byte) error {
+	node.conversation_lock.Lock()
+	saved := saved_ticket{
+		Server:       server,
+		Conversation: node.conversation_id_self,
+		Ticket:       ticket,
+		Token:        node.conversation_token,
+		Key:          node.client_key,
+	}
+	node.conversation_lock.Unlock()
+
+	raw, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// Simulated clients keep it in memory, so runs don't see each other's tickets
+	if node.sim != nil {
+		node.sim.ticket = raw
+		return nil
+	}
+
+	return os.WriteFile(node.session_ticket_path, raw, 0600)
+}
+
+// loadTicket returns the saved ticket for a server, nil if there isn't one
+func (node *Node) loadTicket(server string) *saved_ticket {
+	var raw []byte
+	if node.sim != nil {
+		raw = node.sim.ticket
+	} else {
+		var err error
+		if raw, err = os.ReadFile(node.session_ticket_path); err != nil {
+			return nil
+		}
+	}
+
+	var saved saved_ticket
+	if err := json.Unmarshal(raw, &saved); err != nil || saved.Server != server {
+		return nil
+	}
+
+	return &saved
+}
+
+// resumptionProof is the ticket and ownership proof a restarted client pings with, nothing until the server
+// has sent us a cookie for the proof to be made over, so a copy of the Ping is no use from anywhere else
+func (node *Node) resumptionProof(server string, cookie []byte) ([]byte, []byte) {
+	saved := node.loadTicket(server)
+	if saved == nil || len(cookie) == 0 {
+		return nil, nil
+	}
+
+	proof, err := SerializeOwnership(&PcktOwnership{
+		Cookie: cookie,
+		Token:  saved.Token,
+		Proof:  ownershipMAC(saved.Key, saved.Conversation, cookie),
+	})
+	if err != nil {
+		return nil, nil
+	}
+
+	return saved.Ticket, proof
+}
+
+// resumeConversation hands a returning client its old conversation back, returns false if there's nothing to resume
+// (the Ping's cookie has already been checked), it keeps its features and its place in any referendum it was in
+func (node *Node) resumeConversation(ping *PcktPing, conn transport, addr *net.UDPAddr) (uint32, bool) {
+	if len(ping.Ticket) == 0 {
+		return 0, false
+	}
+
+	conversation_id, err := node.verifyTicket(ping.Ticket)
+	if err != nil {
+		node.transport_log.Debug("Couldn't resume from ticket", "addr", addr, "err", err)
+		return 0, false
+	}
+
+	// Whoever sent the ticket has to hold the key it was issued with, and be at this address
+	provedAt, err := node.verifyOwnership(conversation_id, ping.Ownership, addr)
+	if err != nil {
+		node.transport_log.Debug("Couldn't resume, ticket without a valid proof", "conversation", conversation_id, "addr", addr, "err", err)
+		return 0, false
+	}
+
+	node.conversations_lock.Lock()
+	conv, exists := node.conversations[conversation_id]
+	node.conversations_lock.Unlock()
+
+	if !exists {
+		return 0, false
+	}
+
+	// A repeated Ping from a client we already resumed, just answer it again
+	if conv.isOnline() && conv.address().String() == addr.String() {
+		return conversation_id, true
+	}
+
+	if !conv.claim(provedAt) {
+		node.transport_log.Debug("Couldn't resume, proof is no newer than the one the conversation last moved on", "conversation", conversation_id, "addr", addr)
+		return 0, false
+	}
+
+	conv.resetSequences()
+	conv.heardFrom(conn, addr)
+
+	node.transport_log.Info("Resuming Conversation from ticket", "conversation", conversation_id, "addr", addr)
+
+	// Ask again about anything it hasn't voted on yet, its earlier answers may have died with it
+	node.ref_manager.resume_participant(conv)
+
+	return conversation_id, true
+}
+
+// resetSequences starts packet numbering over in both directions, for a restarted client that does the same
+// as it can't know where we had got to, anything we hadn't got across is gone (resume_participant asks its
+// questions again)
+func (conv *conversation) resetSequences() {
+	conv.receiver.incoming_lock.Lock()
+	conv.receiver.incoming = make(map[uint32]*Pckt)
+	conv.receiver.fecCache = make(map[uint32][]byte)
+	conv.receiver.parityCache = make(map[uint32]Pckt)
+	conv.receiver.lastPcktReceived = 0
+	conv.receiver.incoming_lock.Unlock()
+
+	// The path may have changed too, so congestion control starts over as well
+	conv.sender.outgoing_lock.Lock()
+	conv.sender.outgoing = make(map[uint32]*Pckt)
+	conv.sender.windowStart = 0
+	conv.sender.nextPcktNum = 0
+	conv.sender.fecGroup = &fec_group{}
+	conv.sender.cwnd = conv.node.initial_cwnd
+	conv.sender.ssthresh = float64(conv.sender.windowSize)
+	conv.sender.srtt = 0
+	conv.sender.rttvar = 0
+	conv.sender.rto = conv.node.initial_rto
+	conv.sender.pacingWait = 0
+	conv.sender.outgoing_lock.Unlock()
+}
+
+// sendResumptionTicket gives a client a fresh ticket for its conversation
+func (conv *conversation) sendResumptionTicket() {
+	ticket := conv.node.issueTicket(conv.conversation_id)
+
+	ticketBody := PcktResumptionTicket{
+		DataID:       resumption_ticket_s2c,
+		TicketLength: uint16(len(ticket)),
+		Ticket:       ticket,
+	}
+
+	ticketBody_bytes, err := SerializeResumptionTicket(&ticketBody)
+	if err != nil {
+		return
+	}
+
+	if err := conv.sendData(ticketBody_bytes, true); err != nil {
+		conv.transport_log.Warn("Couldn't send the resumption ticket", "err", err)
+	}
+}
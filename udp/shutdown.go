@@ -0,0 +1,249 @@
+// Graceful shutdown, and the state a server keeps across restarts
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Shutdown goes through the steps in order, each bounded by ctx:
+//  1. no new referendums (a server answers requests with a TIMEOUT verdict, Propose fails with ErrShuttingDown)
+//  2. a server waits for its ongoing referendums to be decided
+//  3. unacked DATA to online conversations is given the chance to get through
+//  4. every conversation gets a RESET, the close notification, sent RESET_COPIES times since nothing Acks it
+//  5. a server with Settings.StatePath writes its state there
+//  6. the node is closed, which makes Run return
+// If ctx runs out, the remaining waits are skipped but the notifications, state and close still happen,
+// and the returned error says what was left undone.
+//
+// A server receiving a RESET marks the conversation offline but keeps it, so the client can resume it with
+// its ticket when it's back (the cleaner forgets it once its tickets have expired). A client receiving one
+// marks its server offline, starts its numbering over and keeps sending SYNs, with the state (the secret its
+// token and ticket are signed with, and the server's own Conversation ID) kept, a restarted server takes it
+// straight back.
+
+const RESET_COPIES = 3
+
+var ErrShuttingDown = errors.New("node is shutting down")
+
+// What a server writes to its StatePath
+type node_state struct {
+	ServerSecret        []byte   `json:"server_secret"`
+	ConversationID      uint32   `json:"conversation_id"`  // The server's own, which its clients' conversations are under
+	ConversationIDs     []uint32 `json:"conversation_ids"` // Every ID handed out, so none gets reused
+	BannedConversations []uint32 `json:"banned_conversations"`
+	BannedAddresses     []string `json:"banned_addresses"`
+}
+
+// Shutdown stops the node gracefully, see above
+func (node *Node) Shutdown(ctx context.Context) error {
+	if !node.shutting_down.CompareAndSwap(false, true) {
+		return ErrShuttingDown
+	}
+	node.transport_log.Info("Shutting down")
+
+	var problems []error
+
+	// Let ongoing referendums be decided
+	if node.i_am_server {
+		if err := node.waitFor(ctx, func() bool { return node.ref_manager.ongoingCount() == 0 }); err != nil {
+			problems = append(problems, fmt.Errorf("%d referendums still ongoing: %w", node.ref_manager.ongoingCount(), err))
+		}
+	}
+
+	// Flush what's waiting to be Acked
+	if err := node.waitFor(ctx, func() bool { return node.unackedDepth() == 0 }); err != nil {
+		problems = append(problems, fmt.Errorf("%d packets never Acked: %w", node.unackedDepth(), err))
+	}
+
+	// Tell everyone we're going
+	for _, conv := range node.conversationsSnapshot() {
+		conv.stop()
+		for i := 0; i < RESET_COPIES; i++ {
+			conv.sendReset()
+		}
+	}
+
+	if node.i_am_server && node.state_path != "" {
+		if err := node.saveState(); err != nil {
+			problems = append(problems, fmt.Errorf("couldn't save state: %w", err))
+		} else {
+			node.transport_log.Info("State saved", "path", node.state_path)
+		}
+	}
+
+	if err := node.Close(); err != nil {
+		problems = append(problems, err)
+	}
+
+	return errors.Join(problems...)
+}
+
+// ShuttingDown reports whether Shutdown has been called
+func (node *Node) ShuttingDown() bool {
+	return node.shutting_down.Load()
+}
+
+// waitFor checks done every loop interval until it's true or ctx is done
+func (node *Node) waitFor(ctx context.Context, done func() bool) error {
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(node.loop_interval):
+		}
+	}
+	return nil
+}
+
+// unackedDepth counts the packets online conversations are still waiting on an ACK for
+func (node *Node) unackedDepth() int {
+	depth := 0
+	for _, conv := range node.conversationsSnapshot() {
+		if conv.isOnline() {
+			depth += conv.outgoingDepth()
+		}
+	}
+	return depth
+}
+
+// conversationsSnapshot copies the conversations in ID order, for going through them without holding the lock
+func (node *Node) conversationsSnapshot() []*conversation {
+	node.conversations_lock.Lock()
+	defer node.conversations_lock.Unlock()
+
+	conversations := make([]*conversation, 0, len(node.conversations))
+	for _, conv := range node.conversations {
+		conversations = append(conversations, conv)
+	}
+	sort.Slice(conversations, func(i, j int) bool { return conversations[i].conversation_id < conversations[j].conversation_id })
+	return conversations
+}
+
+// sendReset sends the close notification
+func (conv *conversation) sendReset() {
+	resetPacket := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      conv.node.ConversationID(),
+			PacketNum:   0,
+			SequenceNum: 0,
+			Type:        RESET,
+			IsFinal:     1,
+		},
+	}
+
+	conn, addr := conv.peer()
+	conv.node.sendUDP(conn, addr, &resetPacket)
+}
+
+// handleReset deals with the other node going away
+func (conv *conversation) handleReset() {
+	if !conv.setOffline() {
+		return // One of the copies already got here
+	}
+
+	if conv.node.i_am_server {
+		// Kept for its ticket, see resumeConversation
+		conv.transport_log.Info("Client closed the conversation", "addr", conv.address())
+		conv.node.ref_manager.participant_offline(conv)
+		return
+	}
+
+	// Keep SYNing, the server may well be back, numbering from 0 like it will, so say hello again first
+	conv.transport_log.Info("Server closed the conversation", "addr", conv.address())
+	conv.resetSequences()
+	conv.sendHello()
+}
+
+// saveState writes the server's secret, handed out IDs and bans to StatePath
+func (node *Node) saveState() error {
+	state := node_state{ServerSecret: node.server_secret, ConversationID: node.ConversationID()}
+
+	node.generatedConvIDs_lock.Lock()
+	for id := range node.generatedConvIDs {
+		state.ConversationIDs = append(state.ConversationIDs, id)
+	}
+	node.generatedConvIDs_lock.Unlock()
+
+	node.bans_lock.Lock()
+	for id := range node.banned_conversations {
+		state.BannedConversations = append(state.BannedConversations, id)
+	}
+	for ip := range node.banned_addrs {
+		state.BannedAddresses = append(state.BannedAddresses, ip)
+	}
+	node.bans_lock.Unlock()
+
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write it next to the old one and swap, a crash halfway leaves the old state
+	temp, err := os.CreateTemp(filepath.Dir(node.state_path), filepath.Base(node.state_path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := temp.Chmod(0600); err != nil {
+		temp.Close()
+		return err
+	}
+	if _, err := temp.Write(raw); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), node.state_path)
+}
+
+// loadState picks up what saveState wrote, returns false if there's no state yet
+func (node *Node) loadState() (bool, error) {
+	raw, err := os.ReadFile(node.state_path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var state node_state
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return false, fmt.Errorf("%s: %v", node.state_path, err)
+	}
+	if len(state.ServerSecret) != 32 {
+		return false, fmt.Errorf("%s: server_secret isn't 32 bytes", node.state_path)
+	}
+
+	node.server_secret = state.ServerSecret
+	node.conversation_id_self = state.ConversationID
+
+	node.generatedConvIDs_lock.Lock()
+	for _, id := range state.ConversationIDs {
+		node.generatedConvIDs[id] = true
+	}
+	node.generatedConvIDs_lock.Unlock()
+
+	node.bans_lock.Lock()
+	for _, id := range state.BannedConversations {
+		node.banned_conversations[id] = true
+	}
+	for _, ip := range state.BannedAddresses {
+		node.banned_addrs[ip] = true
+	}
+	node.bans_lock.Unlock()
+
+	return true, nil
+}
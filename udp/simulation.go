@@ -0,0 +1,468 @@
+// Deterministic simulation, a server and its clients in one process on a virtual clock
+package core
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Virtual time starts here in every simulation
+var SIMULATION_EPOCH = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const SIMULATION_LATENCY = time.Millisecond // Default one way delay of the simulated network
+
+// What to simulate
+type SimulationSettings struct {
+	Seed    int64
+	Clients int
+	Server  Settings      // Port and Impairment are used, addresses are made up
+	Client  Settings      // Every client's
+	Latency time.Duration // One way delay of the network, impairments add to it, 0 for SIMULATION_LATENCY
+}
+
+// A server and its clients, driven by Run and RunUntil, on one goroutine and a memory_network, where loopers,
+// the cleaner, Connect, impairment delays and deliveries are events on a virtual clock, so a seed always
+// plays out the same way, down to every datagram lost
+type Simulation struct {
+	Server  *Node
+	Clients []*Node
+
+	sim       *simulation
+	questions map[uuid.UUID]string
+	waiting   map[uuid.UUID]chan Verdict
+	verdicts  map[uuid.UUID]Verdict
+}
+
+// An event on the virtual clock
+type sim_event struct {
+	at    time.Time
+	owner string // Address of the node it runs on
+	lane  string
+	seq   uint64
+	run   func()
+}
+
+// Events in the order they run (container/heap), by time, then the node they run on, then their lane (a
+// conversation, datagrams from one peer, ...), then the order their lane scheduled them in, never in map order
+// or whichever goroutine got there first
+type sim_queue []*sim_event
+
+func (queue sim_queue) Len() int { return len(queue) }
+
+func (queue sim_queue) Less(i, j int) bool {
+	a, b := queue[i], queue[j]
+	if !a.at.Equal(b.at) {
+		return a.at.Before(b.at)
+	}
+	if a.owner != b.owner {
+		return a.owner < b.owner
+	}
+	if a.lane != b.lane {
+		return a.lane < b.lane
+	}
+	return a.seq < b.seq
+}
+
+func (queue sim_queue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *sim_queue) Push(event any) { *queue = append(*queue, event.(*sim_event)) }
+
+func (queue *sim_queue) Pop() any {
+	old := *queue
+	event := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return event
+}
+
+// The clock and event queue under a Simulation
+type simulation struct {
+	seed    int64
+	now     time.Time
+	latency time.Duration
+	queue   sim_queue
+	lanes   map[string]uint64 // Events scheduled so far, by owner and lane
+	trace   hash.Hash64
+	events  uint64
+}
+
+// A node's place in a simulation
+type sim_node struct {
+	*simulation
+	name    string                // The node's address, its events are ordered by it
+	streams map[string]*rand.Rand // Impairments by peer
+	ticket  []byte                // Resumption Ticket (saved_ticket JSON), kept in memory rather than on disk
+}
+
+// schedule runs an event on owner after delay
+func (sim *simulation) schedule(owner string, lane string, delay time.Duration, run func()) {
+	key := owner + " " + lane
+	sim.lanes[key] += 1
+
+	heap.Push(&sim.queue, &sim_event{at: sim.now.Add(delay), owner: owner, lane: lane, seq: sim.lanes[key], run: run})
+}
+
+// step runs the next event, returns false if there isn't one due by deadline
+func (sim *simulation) step(deadline time.Time) bool {
+	if len(sim.queue) == 0 || sim.queue[0].at.After(deadline) {
+		return false
+	}
+
+	event := heap.Pop(&sim.queue).(*sim_event)
+	sim.now = event.at
+	sim.events += 1
+	fmt.Fprintf(sim.trace, "%d %s %s %d\n", event.at.UnixNano(), event.owner, event.lane, event.seq)
+
+	event.run()
+	return true
+}
+
+// stream returns random numbers seeded from the simulation's seed and name
+func (sim *simulation) stream(name string) *rand.Rand {
+	hash := fnv.New64a()
+	binary.Write(hash, binary.BigEndian, sim.seed)
+	hash.Write([]byte(name))
+	return rand.New(rand.NewSource(int64(hash.Sum64())))
+}
+
+// deliver hands a datagram to a transport after the network's latency
+func (sim *simulation) deliver(to *memory_transport, data []byte, from *net.UDPAddr) {
+	sim.schedule(to.addr.String(), "from "+from.String(), sim.latency, func() {
+		select {
+		case <-to.closed:
+			return
+		default:
+		}
+
+		if to.receive != nil {
+			to.receive(data, from)
+		}
+	})
+}
+
+// attach puts a node on the simulated network at addr, with the simulation's clock and randomness
+func (sim *simulation) attach(node *Node, network *memory_network, addr *net.UDPAddr, impairment string) (transport, error) {
+	node.sim = &sim_node{simulation: sim, name: addr.String(), streams: make(map[string]*rand.Rand)}
+	node.rng = sim.stream(addr.String())
+	node.entropy = node.rng
+
+	// Partitions count from virtual time
+	node.impairments.set("", impairment_profile{})
+	if err := node.SetImpairment("", impairment); err != nil {
+		return nil, err
+	}
+
+	memory, err := network.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newImpairedTransport(memory, node)
+	memory.receive = func(data []byte, from *net.UDPAddr) {
+		if conn.admit(data, from) {
+			node.handleIncomingPackets(conn, from, data)
+		}
+	}
+
+	return conn, nil
+}
+
+// every runs step straight away, then every interval for as long as it returns true
+func (node_sim *sim_node) every(lane string, interval time.Duration, step func() bool) {
+	var run func()
+	run = func() {
+		if step() {
+			node_sim.schedule(node_sim.name, lane, interval, run)
+		}
+	}
+	node_sim.schedule(node_sim.name, lane, 0, run)
+}
+
+// startConversation runs a conversation's looper as events
+func (node_sim *sim_node) startConversation(conv *conversation) {
+	conv.sendHello()
+
+	lane := "conversation " + strconv.FormatUint(uint64(conv.conversation_id), 10)
+	var run func()
+	run = func() {
+		select {
+		case <-conv.done:
+			return
+		default:
+		}
+
+		conv.step()
+		node_sim.schedule(node_sim.name, lane, conv.loopDelay(), run)
+	}
+	node_sim.schedule(node_sim.name, lane, 0, run)
+}
+
+// now is the node's idea of the time, virtual in a simulation
+func (node *Node) now() time.Time {
+	if node.sim != nil {
+		return node.sim.now
+	}
+	return time.Now()
+}
+
+// since is time.Since on the node's clock
+func (node *Node) since(t time.Time) time.Duration {
+	return node.now().Sub(t)
+}
+
+// after runs run after delay, in a simulation as an event in lane
+func (node *Node) after(delay time.Duration, lane string, run func()) {
+	if node.sim != nil {
+		node.sim.schedule(node.sim.name, lane, delay, run)
+		return
+	}
+	time.AfterFunc(delay, run)
+}
+
+// randFor returns the random numbers for impairing traffic to and from a peer, in a simulation a stream per
+// peer, so sending to A first doesn't change what happens to B
+func (node *Node) randFor(peer *net.UDPAddr) *rand.Rand {
+	if node.sim == nil {
+		return node.rng
+	}
+
+	name := ""
+	if peer != nil {
+		name = peer.String()
+	}
+	if _, exists := node.sim.streams[name]; !exists {
+		node.sim.streams[name] = node.sim.stream(node.sim.name + " to " + name)
+	}
+	return node.sim.streams[name]
+}
+
+// A rand.Source safe to share between goroutines, like the one behind math/rand's functions
+type locked_source struct {
+	lock   sync.Mutex
+	source rand.Source64
+}
+
+func newLockedSource(seed int64) *locked_source {
+	return &locked_source{source: rand.NewSource(seed).(rand.Source64)}
+}
+
+func (locked *locked_source) Int63() int64 {
+	locked.lock.Lock()
+	defer locked.lock.Unlock()
+	return locked.source.Int63()
+}
+
+func (locked *locked_source) Uint64() uint64 {
+	locked.lock.Lock()
+	defer locked.lock.Unlock()
+	return locked.source.Uint64()
+}
+
+func (locked *locked_source) Seed(seed int64) {
+	locked.lock.Lock()
+	defer locked.lock.Unlock()
+	locked.source.Seed(seed)
+}
+
+// NewSimulation sets up a server and its clients, the clients start connecting once it runs
+func NewSimulation(settings SimulationSettings) (*Simulation, error) {
+	if settings.Clients < 1 {
+		return nil, errors.New("NewSimulation: need at least one client")
+	}
+	if err := settings.Server.Validate(); err != nil {
+		return nil, err
+	}
+	if err := settings.Client.Validate(); err != nil {
+		return nil, err
+	}
+
+	latency := settings.Latency
+	if latency == 0 {
+		latency = SIMULATION_LATENCY
+	}
+
+	sim := &simulation{
+		seed:    settings.Seed,
+		now:     SIMULATION_EPOCH,
+		latency: latency,
+		lanes:   make(map[string]uint64),
+		trace:   fnv.New64a(),
+	}
+	network := newMemoryNetwork()
+	network.sim = sim
+
+	simulation := &Simulation{
+		sim:       sim,
+		questions: make(map[uuid.UUID]string),
+		waiting:   make(map[uuid.UUID]chan Verdict),
+		verdicts:  make(map[uuid.UUID]Verdict),
+	}
+
+	// The server
+	port, err := strconv.Atoi(settings.Server.Port)
+	if err != nil {
+		return nil, fmt.Errorf("NewSimulation: bad port %q", settings.Server.Port)
+	}
+	serverAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}
+
+	server := newNode(settings.Server, true)
+	conn, err := sim.attach(server, network, serverAddr, settings.Server.Impairment)
+	if err != nil {
+		return nil, err
+	}
+	server.listen_addrs = []string{serverAddr.String()}
+	server.listen_conns = []transport{conn}
+
+	server.generatedConvIDs_lock.Lock()
+	server.conversation_id_self = server.generateConversationID()
+	server.generatedConvIDs_lock.Unlock()
+
+	if err := server.generateServerSecret(); err != nil {
+		return nil, err
+	}
+
+	server.sim.every("cleaner", CLEAN_INTERVAL, func() bool {
+		server.clean()
+		return true
+	})
+	simulation.Server = server
+
+	// Its clients, each on an IP of its own
+	for i := 0; i < settings.Clients; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 1, byte(i/250), byte(i%250+1)), Port: 40000}
+
+		client := newNode(settings.Client, false)
+		conn, err := sim.attach(client, network, addr, settings.Client.Impairment)
+		if err != nil {
+			return nil, err
+		}
+		client.serverAddr = serverAddr
+		client.conn = conn
+		client.listen_conns = []transport{conn}
+
+		if err := client.generateKeyExchange(); err != nil {
+			return nil, err
+		}
+
+		client.sim.every("connect", client.ping_interval, func() bool {
+			return !client.connectStep()
+		})
+		simulation.Clients = append(simulation.Clients, client)
+	}
+
+	return simulation, nil
+}
+
+// Now is the virtual time
+func (simulation *Simulation) Now() time.Time {
+	return simulation.sim.now
+}
+
+// Run runs everything due in the next d of virtual time
+func (simulation *Simulation) Run(d time.Duration) {
+	deadline := simulation.sim.now.Add(d)
+	for simulation.sim.step(deadline) {
+	}
+	simulation.sim.now = deadline
+}
+
+// RunUntil runs events until done (checked after each one) returns true, or limit of virtual time has gone by,
+// returns whether done did
+func (simulation *Simulation) RunUntil(done func() bool, limit time.Duration) bool {
+	deadline := simulation.sim.now.Add(limit)
+	for !done() {
+		if !simulation.sim.step(deadline) {
+			simulation.sim.now = deadline
+			return false
+		}
+	}
+	return true
+}
+
+// Connected reports whether every client has its conversation with the server, and the server has
+// heard every client's hello, so each of them is asked in the next referendum
+func (simulation *Simulation) Connected() bool {
+	for _, client := range simulation.Clients {
+		if client.server() == nil {
+			return false
+		}
+	}
+
+	voters := 0
+	for _, conv := range simulation.Server.conversationsSnapshot() {
+		if conv.isOnline() && conv.hasFeature(simple_eval) {
+			voters++
+		}
+	}
+	return voters == len(simulation.Clients)
+}
+
+// Propose has a client ask for a referendum without waiting for it, the verdict turns up in Verdict
+func (simulation *Simulation) Propose(client int, question string) (uuid.UUID, error) {
+	return simulation.ProposeWithDeadline(client, question, 0)
+}
+
+// ProposeWithDeadline is Propose asking the server to close the referendum after deadline (0 for its default)
+func (simulation *Simulation) ProposeWithDeadline(client int, question string, deadline time.Duration) (uuid.UUID, error) {
+	vote_id, waiting, err := simulation.Clients[client].propose(question, deadline)
+	if err != nil {
+		return vote_id, err
+	}
+
+	simulation.questions[vote_id] = question
+	simulation.waiting[vote_id] = waiting
+	return vote_id, nil
+}
+
+// Verdict returns the verdict the proposer of a referendum got, false if it hasn't got one yet
+func (simulation *Simulation) Verdict(vote_id uuid.UUID) (Verdict, bool) {
+	if verdict, decided := simulation.verdicts[vote_id]; decided {
+		return verdict, true
+	}
+
+	select {
+	case verdict := <-simulation.waiting[vote_id]:
+		verdict.Question = simulation.questions[vote_id]
+		simulation.verdicts[vote_id] = verdict
+		delete(simulation.waiting, vote_id)
+		delete(simulation.questions, vote_id)
+		return verdict, true
+	default:
+		return Verdict{}, false
+	}
+}
+
+// Result returns what a client holds as a referendum's result (its own ballot until the server's result
+// overwrites it), final once the server's result has arrived
+func (simulation *Simulation) Result(client int, vote_id uuid.UUID) (result uint16, final bool, exists bool) {
+	return simulation.Clients[client].ref_manager.clientResult(vote_id)
+}
+
+// PacketsSent counts the packets of a type every node sent, lost ones and duplicates included
+func (simulation *Simulation) PacketsSent(packet_type uint16) uint64 {
+	sent := simulation.Server.metrics.packets_sent.counts[packet_type].Load()
+	for _, client := range simulation.Clients {
+		sent += client.metrics.packets_sent.counts[packet_type].Load()
+	}
+	return sent
+}
+
+// Events counts the events run so far
+func (simulation *Simulation) Events() uint64 {
+	return simulation.sim.events
+}
+
+// Trace fingerprints every event run so far, the same seed and settings always give the same trace
+func (simulation *Simulation) Trace() uint64 {
+	return simulation.sim.trace.Sum64()
+}
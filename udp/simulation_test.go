@@ -0,0 +1,363 @@
+package core
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scenarios run as a subtest per seed, over a few fixed seeds each, a failing seed replays exactly with
+// go test -run <Test> -seed <seed>
+
+var sim_seed = flag.Int64("seed", 0, "run the simulation scenarios with this seed only")
+
+const SIM_CLIENTS = 5
+
+// forEachSeed runs a scenario with each seed (or just -seed)
+func forEachSeed(t *testing.T, scenario func(t *testing.T, seed int64), defaults ...int64) {
+	if *sim_seed != 0 {
+		defaults = []int64{*sim_seed}
+	}
+
+	for _, seed := range defaults {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			scenario(t, seed)
+		})
+	}
+}
+
+// newTestSimulation sets up a quiet simulation, with the same impairments on every node and any settings
+// configure changes
+func newTestSimulation(t *testing.T, seed int64, impairment string, configure ...func(settings *Settings)) *Simulation {
+	t.Helper()
+
+	settings := DefaultSettings()
+	settings.Log.Output = io.Discard
+	settings.Impairment = impairment
+	for _, change := range configure {
+		change(&settings)
+	}
+
+	simulation, err := NewSimulation(SimulationSettings{Seed: seed, Clients: SIM_CLIENTS, Server: settings, Client: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("replay with -run '%s' -seed %d", t.Name(), seed)
+		}
+	})
+
+	return simulation
+}
+
+// vote connects every client, has the first propose question and runs until the verdict is in
+func vote(t *testing.T, simulation *Simulation, question string) (uuid.UUID, Verdict) {
+	t.Helper()
+
+	if !simulation.RunUntil(simulation.Connected, time.Minute) {
+		t.Fatal("clients didn't connect")
+	}
+
+	vote_id, err := simulation.Propose(0, question)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var verdict Verdict
+	decided := simulation.RunUntil(func() bool {
+		var done bool
+		verdict, done = simulation.Verdict(vote_id)
+		return done
+	}, 2*time.Minute)
+	if !decided {
+		t.Fatal("no verdict")
+	}
+
+	return vote_id, verdict
+}
+
+// allHaveResult runs until every client holds result as the final result, on a clean network the result
+// can't overtake its question
+func allHaveResult(t *testing.T, simulation *Simulation, vote_id uuid.UUID, result uint16) {
+	t.Helper()
+
+	agreed := func() bool {
+		for i := range simulation.Clients {
+			if held, final, _ := simulation.Result(i, vote_id); !final || held != result {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !simulation.RunUntil(agreed, 2*time.Minute) {
+		for i := range simulation.Clients {
+			held, final, exists := simulation.Result(i, vote_id)
+			t.Errorf("client %d: result %d final %t (asked %t)", i, held, final, exists)
+		}
+	}
+}
+
+// allAgree runs until every client in voters holds result, and checks no client holds another final result,
+// on a lossy network a client whose question was overtaken by the result only has its own ballot
+func allAgree(t *testing.T, simulation *Simulation, vote_id uuid.UUID, result uint16, voters ...int) {
+	t.Helper()
+
+	agreed := func() bool {
+		for _, i := range voters {
+			if held, _, _ := simulation.Result(i, vote_id); held != result {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !simulation.RunUntil(agreed, 2*time.Minute) {
+		t.Errorf("not every client holds result %d", result)
+	}
+	for i := range simulation.Clients {
+		if held, final, _ := simulation.Result(i, vote_id); final && held != result {
+			t.Errorf("client %d: final result %d, expected %d", i, held, result)
+		}
+	}
+}
+
+// The same seed plays out the same way, event for event
+func TestSimulationReplay(t *testing.T) {
+	forEachSeed(t, func(t *testing.T, seed int64) {
+		run := func() (uint64, uint64, Verdict) {
+			simulation := newTestSimulation(t, seed, "loss=0.3 duplicates=1 latency=10ms jitter=5ms reorder=0.1")
+			_, verdict := vote(t, simulation, "1 + 1 == 2")
+			return simulation.Trace(), simulation.Events(), verdict
+		}
+
+		trace, events, verdict := run()
+		replayTrace, replayEvents, replayVerdict := run()
+
+		if trace != replayTrace || events != replayEvents {
+			t.Errorf("trace %x after %d events, replayed as %x after %d", trace, events, replayTrace, replayEvents)
+		}
+		if verdict.Result != replayVerdict.Result || verdict.VoteID != replayVerdict.VoteID {
+			t.Errorf("verdict %+v, replayed as %+v", verdict, replayVerdict)
+		}
+	}, 1, 2, 3)
+}
+
+// On a clean network the vote is called early and nothing is sent twice
+func TestSimulationCleanVote(t *testing.T) {
+	forEachSeed(t, func(t *testing.T, seed int64) {
+		simulation := newTestSimulation(t, seed, "")
+		vote_id, verdict := vote(t, simulation, "2 * 2 == 4")
+
+		if verdict.Result != SAT {
+			t.Errorf("result %d, expected SAT", verdict.Result)
+		}
+		if verdict.Participants != SIM_CLIENTS {
+			t.Errorf("%d participants, expected %d", verdict.Participants, SIM_CLIENTS)
+		}
+		if cast := verdict.Tallies[SAT] + verdict.Tallies[UNSAT]; cast >= SIM_CLIENTS {
+			t.Errorf("verdict after all %d ballots, expected it called early", cast)
+		}
+
+		// Each client pings once without a cookie and once with, then SYNs once
+		counts := map[uint16]uint64{PING_REQ: 2 * SIM_CLIENTS, PING_RETRY: SIM_CLIENTS, PING_RES: SIM_CLIENTS, SYN: SIM_CLIENTS, NAK: 0}
+		for packet_type, expected := range counts {
+			if sent := simulation.PacketsSent(packet_type); sent != expected {
+				t.Errorf("%d %s packets sent, expected %d", sent, packet_type_names[packet_type], expected)
+			}
+		}
+		if retransmits := simulation.Server.metrics.retransmits_rto.Load(); retransmits != 0 {
+			t.Errorf("server retransmitted %d packets", retransmits)
+		}
+		if waiting := len(simulation.waiting) + len(simulation.Clients[0].ref_manager.proposals); waiting != 0 {
+			t.Errorf("%d proposals still waiting after the verdict", waiting)
+		}
+
+		allHaveResult(t, simulation, vote_id, SAT)
+	}, 1, 2, 3)
+}
+
+// Every client agrees on the verdict however bad the network is
+func TestSimulationImpairedVote(t *testing.T) {
+	scenarios := []struct {
+		name       string
+		impairment string
+	}{
+		{"loss", "loss=0.4"},
+		{"duplicates", "duplicates=2"},
+		{"reordering", "latency=20ms jitter=10ms reorder=0.3"},
+		{"corruption", "corrupt=0.1 corrupt_in=0.05"},
+		{"everything", "loss=0.2 loss_in=0.1 duplicates=1 latency=5ms jitter=5ms reorder=0.2 corrupt=0.05"},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			forEachSeed(t, func(t *testing.T, seed int64) {
+				simulation := newTestSimulation(t, seed, scenario.impairment)
+				vote_id, verdict := vote(t, simulation, "10 > 3 && 2 + 2 == 4")
+
+				if verdict.Result != SAT {
+					t.Errorf("result %d, expected SAT", verdict.Result)
+				}
+				allAgree(t, simulation, vote_id, SAT, 0, 1, 2, 3, 4)
+			}, 1, 2, 3, 4)
+		})
+	}
+}
+
+// A defector is outvoted, and the server's result never disagrees with the honest ballots
+func TestSimulationDefectors(t *testing.T) {
+	forEachSeed(t, func(t *testing.T, seed int64) {
+		simulation := newTestSimulation(t, seed, "loss=0.1")
+
+		// One of five always flips its answer
+		simulation.Clients[1].SetDefectChance(1)
+
+		vote_id, verdict := vote(t, simulation, "3 < 1")
+
+		if verdict.Result != UNSAT {
+			t.Errorf("result %d, expected UNSAT", verdict.Result)
+		}
+		if verdict.Tallies[UNSAT] <= verdict.Tallies[SAT] {
+			t.Errorf("tallies %v, expected UNSAT ahead", verdict.Tallies)
+		}
+		allAgree(t, simulation, vote_id, UNSAT, 0, 2, 3, 4)
+	}, 1, 2, 3)
+}
+
+// Silent participants or a tie keep the result from being called, the deadline closes the vote with the
+// timeout policy, and a tie is never settled by it
+func TestSimulationDeadline(t *testing.T) {
+	scenarios := []struct {
+		name      string
+		policy    string
+		deadline  time.Duration // Asked for by the proposer, 0 for the server's
+		defectors []int
+		silent    []int // Never answer
+		kicked    []int // Gone before the vote, so the rest can tie with every ballot in
+		sat       uint32
+		unsat     uint32
+		result    uint16
+	}{
+		{"plurality", TIMEOUT_POLICY_PLURALITY, 0, []int{1}, []int{3, 4}, nil, 2, 1, SAT},
+		{"timeout", TIMEOUT_POLICY_TIMEOUT, 10 * time.Second, []int{1}, []int{3, 4}, nil, 2, 1, TIMEOUT},
+		{"tie with ballots missing", TIMEOUT_POLICY_PLURALITY, 0, []int{1, 2}, []int{4}, nil, 2, 2, TIMEOUT},
+		{"tie with every ballot in", TIMEOUT_POLICY_PLURALITY, 10 * time.Second, []int{1, 2}, nil, []int{4}, 2, 2, TIMEOUT},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			forEachSeed(t, func(t *testing.T, seed int64) {
+				simulation := newTestSimulation(t, seed, "", func(settings *Settings) {
+					settings.Vote.Deadline = Duration(20 * time.Second)
+					settings.Vote.TimeoutPolicy = scenario.policy
+				})
+				if !simulation.RunUntil(simulation.Connected, time.Minute) {
+					t.Fatal("clients didn't connect")
+				}
+
+				listening := map[int]bool{0: true, 1: true, 2: true, 3: true, 4: true}
+				for _, i := range scenario.defectors {
+					simulation.Clients[i].SetDefectChance(1)
+				}
+				for _, i := range scenario.silent {
+					simulation.Clients[i].SetImpairment("", "loss=1")
+					delete(listening, i)
+				}
+				for _, i := range scenario.kicked {
+					if err := simulation.Server.Kick(simulation.Clients[i].ConversationID()); err != nil {
+						t.Fatal(err)
+					}
+					delete(listening, i)
+				}
+
+				open_for := scenario.deadline
+				if open_for == 0 {
+					open_for = 20 * time.Second
+				}
+
+				started := simulation.Now()
+				vote_id, err := simulation.ProposeWithDeadline(0, "2 * 2 == 4", scenario.deadline)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var verdict Verdict
+				decided := simulation.RunUntil(func() bool {
+					var done bool
+					verdict, done = simulation.Verdict(vote_id)
+					return done
+				}, 2*time.Minute)
+				if !decided {
+					t.Fatal("no verdict")
+				}
+
+				if took := simulation.Now().Sub(started); took < open_for || took > open_for+5*time.Second {
+					t.Errorf("verdict after %s, expected just after the %s deadline", took, open_for)
+				}
+				if verdict.Result != scenario.result {
+					t.Errorf("result %d, expected %d", verdict.Result, scenario.result)
+				}
+				if verdict.Tallies[SAT] != scenario.sat || verdict.Tallies[UNSAT] != scenario.unsat {
+					t.Errorf("tallies %v, expected %d SAT and %d UNSAT", verdict.Tallies, scenario.sat, scenario.unsat)
+				}
+				if info, _ := simulation.Server.Referendum(vote_id); !info.TimedOut {
+					t.Error("referendum not marked as timed out")
+				}
+
+				// Those still listening hear the outcome
+				heard := func() bool {
+					for i := range listening {
+						if held, final, _ := simulation.Result(i, vote_id); !final || held != scenario.result {
+							return false
+						}
+					}
+					return true
+				}
+				if !simulation.RunUntil(heard, time.Minute) {
+					t.Error("the outcome didn't reach every client still listening")
+				}
+			}, 1, 2, 3)
+		})
+	}
+}
+
+// A proposer asking for a deadline past the server's maximum is refused straight away
+func TestSimulationDeadlineTooFar(t *testing.T) {
+	forEachSeed(t, func(t *testing.T, seed int64) {
+		simulation := newTestSimulation(t, seed, "", func(settings *Settings) {
+			settings.Vote.MaxDeadline = Duration(time.Minute)
+		})
+		if !simulation.RunUntil(simulation.Connected, time.Minute) {
+			t.Fatal("clients didn't connect")
+		}
+
+		vote_id, err := simulation.ProposeWithDeadline(0, "2 * 2 == 4", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var verdict Verdict
+		decided := simulation.RunUntil(func() bool {
+			var done bool
+			verdict, done = simulation.Verdict(vote_id)
+			return done
+		}, 10*time.Second)
+		if !decided {
+			t.Fatal("no verdict")
+		}
+
+		if verdict.Result != TIMEOUT || verdict.Participants != 0 {
+			t.Errorf("result %d with %d participants, expected a TIMEOUT refusal", verdict.Result, verdict.Participants)
+		}
+		if _, hosted := simulation.Server.Referendum(vote_id); hosted {
+			t.Error("refused referendum is hosted anyway")
+		}
+	}, 1, 2)
+}
@@ -0,0 +1,306 @@
+// Conversation Tokens, proof that a node owns the Conversation ID it puts in its headers
+package core
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// The conversation key is agreed with X25519 in the PING_REQ and PING_RES, so watching the handshake doesn't
+// give it away, though nothing authenticates the server's public key against someone rewriting both in flight.
+
+const (
+	KEY_EXCHANGE_SIZE   = 32 // X25519 public keys
+	CLIENT_KEY_SIZE     = 16 // Conversation keys, derived from the key exchange
+	CONV_TOKEN_MAC_SIZE = sha256.Size
+	CONV_TOKEN_SIZE     = 8 + CLIENT_KEY_SIZE + CONV_TOKEN_MAC_SIZE // IssuedAt + Sealed Client Key + MAC
+	CONV_TOKEN_LIFETIME = TICKET_LIFETIME
+	OWNERSHIP_MAC_SIZE  = sha256.Size
+)
+
+// generateKeyExchange creates the X25519 key pair this client agrees its conversation key with, read straight
+// from the node's entropy so simulations stay deterministic
+func (node *Node) generateKeyExchange() error {
+	seed := make([]byte, KEY_EXCHANGE_SIZE)
+	if _, err := io.ReadFull(node.entropy, seed); err != nil {
+		return err
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(seed)
+	if err != nil {
+		return err
+	}
+
+	node.key_exchange = key
+	return nil
+}
+
+// serverKeyExchange is the server's X25519 key, made from its secret so it lasts as long as the secret does
+func (node *Node) serverKeyExchange() (*ecdh.PrivateKey, error) {
+	mac := hmac.New(sha256.New, node.server_secret)
+	mac.Write([]byte("key exchange"))
+	return ecdh.X25519().NewPrivateKey(mac.Sum(nil))
+}
+
+// conversationKey derives a conversation's key from the key exchange's shared secret
+func conversationKey(shared []byte, conversation_id uint32) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte("conversation key"))
+	binary.Write(mac, binary.BigEndian, conversation_id)
+	return mac.Sum(nil)[:CLIENT_KEY_SIZE]
+}
+
+// pingResponse is the body of a PING_RES, the Conversation Token followed by the server's public key, empty if
+// the client's public key is unusable, the conversation key itself never goes over the wire
+func (node *Node) pingResponse(conversation_id uint32, clientPublic []byte) []byte {
+	serverKey, err := node.serverKeyExchange()
+	if err != nil {
+		return []byte{}
+	}
+	public, err := ecdh.X25519().NewPublicKey(clientPublic)
+	if err != nil {
+		return []byte{}
+	}
+	shared, err := serverKey.ECDH(public)
+	if err != nil {
+		return []byte{}
+	}
+
+	token := node.issueConversationToken(conversation_id, conversationKey(shared, conversation_id))
+	return append(token, serverKey.PublicKey().Bytes()...)
+}
+
+// conversationTokenMAC signs a Conversation ID, issue time and client key
+func (node *Node) conversationTokenMAC(conversation_id uint32, issuedAt int64, clientKey []byte) []byte {
+	mac := hmac.New(sha256.New, node.server_secret)
+	mac.Write([]byte("conversation"))
+	binary.Write(mac, binary.BigEndian, conversation_id)
+	binary.Write(mac, binary.BigEndian, issuedAt)
+	mac.Write(clientKey)
+	return mac.Sum(nil)
+}
+
+// sealClientKey XORs a client key with a pad made from the server secret, Conversation ID and issue time,
+// sealing and unsealing are the same thing
+func (node *Node) sealClientKey(conversation_id uint32, issuedAt int64, clientKey []byte) []byte {
+	mac := hmac.New(sha256.New, node.server_secret)
+	mac.Write([]byte("seal"))
+	binary.Write(mac, binary.BigEndian, conversation_id)
+	binary.Write(mac, binary.BigEndian, issuedAt)
+	pad := mac.Sum(nil)
+
+	sealed := make([]byte, CLIENT_KEY_SIZE)
+	for i := range sealed {
+		sealed[i] = clientKey[i] ^ pad[i]
+	}
+	return sealed
+}
+
+// issueConversationToken creates the token handed out with a Conversation ID, empty if the client key is unusable,
+// it holds the issue time, the sealed key and a MAC over the three, so the server keeps nothing and unseals
+// the key from the token when it needs it
+func (node *Node) issueConversationToken(conversation_id uint32, clientKey []byte) []byte {
+	if len(clientKey) != CLIENT_KEY_SIZE {
+		return []byte{}
+	}
+
+	issuedAt := node.now().Unix()
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, issuedAt)
+	buf.Write(node.sealClientKey(conversation_id, issuedAt, clientKey))
+	buf.Write(node.conversationTokenMAC(conversation_id, issuedAt, clientKey))
+
+	return buf.Bytes()
+}
+
+// ownershipMAC is what a client proves it holds its key with, a MAC over the Conversation ID and a server cookie
+func ownershipMAC(clientKey []byte, conversation_id uint32, cookie []byte) []byte {
+	mac := hmac.New(sha256.New, clientKey)
+	mac.Write([]byte("ownership"))
+	binary.Write(mac, binary.BigEndian, conversation_id)
+	mac.Write(cookie)
+	return mac.Sum(nil)
+}
+
+// verifyOwnership checks the proof in a SYN or SYN_ACK body from addr was made for this Conversation ID with the
+// key its token was issued to, returns when the proof's cookie was issued
+func (node *Node) verifyOwnership(conversation_id uint32, body []byte, addr *net.UDPAddr) (int64, error) {
+	if len(node.server_secret) == 0 {
+		return 0, errors.New("verifyOwnership: this node doesn't issue tokens")
+	}
+
+	proof, err := DeserializeOwnership(body)
+	if err != nil {
+		return 0, errors.New("verifyOwnership: no proof")
+	}
+
+	// A cookie sent to some other address means the proof was made over there
+	if err := node.verifyCookie(proof.Cookie, addr); err != nil {
+		return 0, err
+	}
+
+	if len(proof.Token) != CONV_TOKEN_SIZE {
+		return 0, errors.New("verifyOwnership: wrong token size")
+	}
+
+	issuedAt := int64(binary.BigEndian.Uint64(proof.Token[0:8]))
+	clientKey := node.sealClientKey(conversation_id, issuedAt, proof.Token[8:8+CLIENT_KEY_SIZE])
+
+	if !hmac.Equal(node.conversationTokenMAC(conversation_id, issuedAt, clientKey), proof.Token[8+CLIENT_KEY_SIZE:]) {
+		return 0, errors.New("verifyOwnership: bad token MAC")
+	}
+
+	if node.since(time.Unix(issuedAt, 0)) > CONV_TOKEN_LIFETIME {
+		return 0, errors.New("verifyOwnership: token expired")
+	}
+
+	if !hmac.Equal(ownershipMAC(clientKey, conversation_id, proof.Cookie), proof.Proof) {
+		return 0, errors.New("verifyOwnership: bad proof MAC")
+	}
+
+	return int64(binary.BigEndian.Uint64(proof.Cookie[0:8])), nil
+}
+
+// ownershipProof is the body a client puts in its SYNs and SYN_ACKs, empty for servers and before we have a token,
+// its token, the newest cookie the server sent it (bound to the address it was sent to) and an ownershipMAC over it
+func (node *Node) ownershipProof() []byte {
+	if node.i_am_server {
+		return []byte{}
+	}
+
+	conversation_id := node.ConversationID()
+
+	node.conversation_lock.Lock()
+	token := node.conversation_token
+	key := node.client_key
+	node.conversation_lock.Unlock()
+
+	node.ping_cookie_lock.Lock()
+	cookie := node.ping_cookie
+	node.ping_cookie_lock.Unlock()
+
+	if len(token) == 0 || len(cookie) == 0 {
+		return []byte{}
+	}
+
+	proof, err := SerializeOwnership(&PcktOwnership{
+		Cookie: cookie,
+		Token:  token,
+		Proof:  ownershipMAC(key, conversation_id, cookie),
+	})
+	if err != nil {
+		return []byte{}
+	}
+
+	return proof
+}
+
+// handlePingResponse takes the Conversation ID and token the server handed out, and works out the conversation
+// key from the server's public key
+func (node *Node) handlePingResponse(conversation_id uint32, body []byte) {
+	if node.key_exchange == nil || len(body) != CONV_TOKEN_SIZE+KEY_EXCHANGE_SIZE {
+		return
+	}
+
+	serverPublic, err := ecdh.X25519().NewPublicKey(body[CONV_TOKEN_SIZE:])
+	if err != nil {
+		return
+	}
+	shared, err := node.key_exchange.ECDH(serverPublic)
+	if err != nil {
+		return
+	}
+
+	node.conversation_lock.Lock()
+	defer node.conversation_lock.Unlock()
+
+	if node.conversation_id_self == 0 {
+		node.conversation_token = body[:CONV_TOKEN_SIZE]
+		node.client_key = conversationKey(shared, conversation_id)
+		node.conversation_id_self = conversation_id
+	}
+}
+
+// handleOwnershipChallenge keeps the cookie in a SYN from our server, so our next proof is made for the
+// address the server sees us at
+func (node *Node) handleOwnershipChallenge(body []byte, addr *net.UDPAddr) {
+	if node.i_am_server || len(body) != COOKIE_SIZE || node.serverAddr == nil || !addr.IP.Equal(node.serverAddr.IP) || addr.Port != node.serverAddr.Port {
+		return
+	}
+
+	node.ping_cookie_lock.Lock()
+	node.ping_cookie = body
+	node.ping_cookie_lock.Unlock()
+}
+
+// authorizePacket decides whether a packet may be handled by the conversation for its ConvID (nil if there
+// isn't one yet), servers only take packets from the address that proved ownership, or carrying a fresh proof
+// (the caller must hold the conversations lock). A captured proof is no use from anywhere else, its cookie
+// only holds for the address it was sent to, and a conversation only moves on a proof newer than the one that
+// last moved it, so the owner's old address can't take it back either
+func (node *Node) authorizePacket(conv *conversation, conn transport, packet *Pckt, addr *net.UDPAddr) bool {
+	if !node.i_am_server {
+		return true
+	}
+
+	// Bound address, nothing to prove
+	if conv != nil && conv.address().IP.Equal(addr.IP) && conv.address().Port == addr.Port {
+		return true
+	}
+
+	proving := packet.Header.Type == SYN || packet.Header.Type == SYN_ACK
+	if proving {
+		provedAt, err := node.verifyOwnership(packet.Header.ConvID, packet.Body, addr)
+		if err == nil && conv == nil {
+			return true
+		}
+		if err == nil && conv.claim(provedAt) {
+			conv.transport_log.Info("Conversation proved ownership from new address", "addr", addr)
+			return true
+		}
+		if err == nil {
+			err = errors.New("authorizePacket: proof is no newer than the one the conversation last moved on")
+		}
+
+		node.transport_log.Debug("Ownership proof rejected", "conversation", packet.Header.ConvID, "addr", addr, "err", err)
+	}
+
+	// Ask whoever this is to prove it, in case it's the owner after an address change (or a client whose cookie
+	// ran out trying to open its conversation), never with more than it sent us, so nobody gets to bounce bigger
+	// packets off us at someone else
+	if (conv != nil || proving) && len(packet.Body) >= COOKIE_SIZE && node.ping_limiter.allow(addr.IP, node.now()) {
+		node.sendOwnershipChallenge(conn, addr)
+	}
+
+	node.transport_log.Debug("authorizePacket: dropping packet from unproven address", "conversation", packet.Header.ConvID, "packet", packet.Header.PacketNum, "addr", addr)
+
+	return false
+}
+
+// sendOwnershipChallenge sends a SYN to an address claiming a conversation, carrying a cookie for that address,
+// the owner answers with a proof over it in its SYN_ACK, so a client whose address really changed can move
+// its conversation
+func (node *Node) sendOwnershipChallenge(conn transport, addr *net.UDPAddr) {
+	synPacket := Pckt{
+		Header: PcktHeader{
+			Magic:       MAGIC_CONST,
+			Checksum:    0,
+			ConvID:      node.ConversationID(),
+			PacketNum:   0,
+			SequenceNum: 0,
+			Type:        SYN,
+			IsFinal:     1,
+		},
+		Body: node.issueCookie(addr),
+	}
+
+	node.sendUDP(conn, addr, &synPacket)
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"io"
+	"net"
+	"testing"
+)
+
+// The client and server agree a conversation key that's in neither the PING_REQ nor the PING_RES, proofs made
+// with it pass, and someone who saw both packets can't make one
+func TestKeyExchange(t *testing.T) {
+	server := testNode(t)
+	if err := server.generateServerSecret(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := DefaultSettings()
+	settings.Log.Output = io.Discard
+	client := newNode(settings, false)
+	if err := client.generateKeyExchange(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	const id = 1234
+
+	ping, err := SerializePing(&PcktPing{ClientKey: client.key_exchange.PublicKey().Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := DeserializePing(ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := server.pingResponse(id, request.ClientKey)
+	if len(response) != CONV_TOKEN_SIZE+KEY_EXCHANGE_SIZE {
+		t.Fatalf("PING_RES body is %d bytes", len(response))
+	}
+
+	client.handlePingResponse(id, response)
+	if client.ConversationID() != id || len(client.client_key) != CLIENT_KEY_SIZE {
+		t.Fatalf("client took Conversation ID %d with a %d byte key", client.ConversationID(), len(client.client_key))
+	}
+	if bytes.Contains(ping, client.client_key) || bytes.Contains(response, client.client_key) {
+		t.Error("conversation key went over the wire")
+	}
+
+	client.ping_cookie = server.issueCookie(addr)
+	if _, err := server.verifyOwnership(id, client.ownershipProof(), addr); err != nil {
+		t.Errorf("client's proof refused: %v", err)
+	}
+
+	// An observer with both public keys and a key pair of its own gets some other key
+	observer := newNode(settings, false)
+	if err := observer.generateKeyExchange(); err != nil {
+		t.Fatal(err)
+	}
+	serverPublic, err := ecdh.X25519().NewPublicKey(response[CONV_TOKEN_SIZE:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := observer.key_exchange.ECDH(serverPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guess := conversationKey(shared, id)
+	forged, err := SerializeOwnership(&PcktOwnership{
+		Cookie: client.ping_cookie,
+		Token:  response[:CONV_TOKEN_SIZE],
+		Proof:  ownershipMAC(guess, id, client.ping_cookie),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.verifyOwnership(id, forged, addr); err == nil {
+		t.Error("proof made by an observer accepted")
+	}
+
+	// Unusable public keys get nothing, and a client ignores a response it can't use
+	if body := server.pingResponse(id, []byte("short")); len(body) != 0 {
+		t.Errorf("got a %d byte PING_RES for a bad public key", len(body))
+	}
+	late := newNode(settings, false)
+	if err := late.generateKeyExchange(); err != nil {
+		t.Fatal(err)
+	}
+	late.handlePingResponse(id, response[:CONV_TOKEN_SIZE])
+	if late.ConversationID() != 0 {
+		t.Error("client took a PING_RES without the server's public key")
+	}
+}
@@ -0,0 +1,95 @@
+// Transports, what a node sends and receives datagrams through
+package core
+
+import (
+	"net"
+)
+
+// The node only ever talks to a transport, never to a socket directly. udp_transport is the real thing, a UDP
+// socket read and written a batch at a time. memory_transport (transport_memory.go) passes datagrams around
+// inside the process, so many nodes can run together in one test without opening any sockets.
+
+// A datagram transport, safe to write from many goroutines, read from one
+type transport interface {
+	// readBatch blocks until at least one datagram has arrived, then fills as many of buffers as there are
+	// datagrams waiting, returning how many it filled
+	readBatch(buffers []*[]byte, lengths []int, addrs []*net.UDPAddr) (int, error)
+
+	// writeTo sends one datagram (transports connected to a single peer send there whatever addr is)
+	writeTo(data []byte, addr *net.UDPAddr) error
+
+	localAddr() *net.UDPAddr
+
+	close() error
+}
+
+// A UDP socket
+type udp_transport struct {
+	conn      *net.UDPConn
+	connected bool
+	batched   bool
+	batch     *batch_conn
+	writer    *batch_writer
+}
+
+// newUDPTransport wraps a socket, batching reads and writes if batched
+func newUDPTransport(conn *net.UDPConn, batched bool) *udp_transport {
+	udp := &udp_transport{
+		conn:      conn,
+		connected: conn.RemoteAddr() != nil,
+		batched:   batched,
+		batch:     newBatchConn(conn),
+	}
+
+	if batched {
+		udp.writer = newBatchWriter(udp.batch)
+	}
+
+	return udp
+}
+
+func (udp *udp_transport) readBatch(buffers []*[]byte, lengths []int, addrs []*net.UDPAddr) (int, error) {
+	if udp.batched {
+		return udp.batch.readBatch(buffers, lengths, addrs)
+	}
+
+	n, addr, err := udp.conn.ReadFromUDP(*buffers[0])
+	if err != nil {
+		return 0, err
+	}
+
+	lengths[0] = n
+	addrs[0] = addr
+
+	return 1, nil
+}
+
+func (udp *udp_transport) writeTo(data []byte, addr *net.UDPAddr) error {
+	if udp.writer != nil {
+		return udp.writer.write(data, addr)
+	}
+
+	var err error
+	if udp.connected {
+		_, err = udp.conn.Write(data)
+	} else {
+		_, err = udp.conn.WriteTo(data, addr)
+	}
+	return err
+}
+
+func (udp *udp_transport) localAddr() *net.UDPAddr {
+	addr, _ := udp.conn.LocalAddr().(*net.UDPAddr)
+	return addr
+}
+
+func (udp *udp_transport) close() error {
+	err := udp.conn.Close()
+
+	// Stop the writer too, anyone still waiting on it gets net.ErrClosed
+	if udp.writer != nil {
+		udp.writer.close()
+	}
+
+	return err
+}
@@ -0,0 +1,158 @@
+// In-memory transport, for running many nodes in one process
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const MEMORY_QUEUE_SIZE = 1024 // Datagrams a memory_transport holds before dropping, like a full socket buffer
+
+// A set of memory_transports that can reach each other by address
+type memory_network struct {
+	lock       sync.Mutex
+	transports map[string]*memory_transport
+	nextPort   int
+	sim        *simulation // Set for a Simulation's network, datagrams are delivered as events then
+}
+
+// A datagram in flight on a memory_network
+type memory_datagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// One node's end of a memory_network
+type memory_transport struct {
+	network *memory_network
+	addr    *net.UDPAddr
+	inbox   chan memory_datagram
+	closed  chan struct{}
+	once    sync.Once
+
+	// Handles datagrams as a Simulation delivers them, nothing reads the inbox then
+	receive func(data []byte, from *net.UDPAddr)
+}
+
+func newMemoryNetwork() *memory_network {
+	return &memory_network{
+		transports: make(map[string]*memory_transport),
+		nextPort:   10000,
+	}
+}
+
+// listen attaches a transport at addr, a port of 0 picks a free one
+func (network *memory_network) listen(addr *net.UDPAddr) (*memory_transport, error) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	bound := &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	if bound.Port == 0 {
+		for {
+			network.nextPort += 1
+			bound.Port = network.nextPort
+			if _, taken := network.transports[bound.String()]; !taken {
+				break
+			}
+		}
+	}
+
+	if _, taken := network.transports[bound.String()]; taken {
+		return nil, fmt.Errorf("listen: %s already in use", bound)
+	}
+
+	memory := &memory_transport{
+		network: network,
+		addr:    bound,
+		inbox:   make(chan memory_datagram, MEMORY_QUEUE_SIZE),
+		closed:  make(chan struct{}),
+	}
+	network.transports[bound.String()] = memory
+
+	return memory, nil
+}
+
+// deliver hands a datagram to whoever is at addr, it's dropped if nobody is, or their inbox is full
+func (network *memory_network) deliver(data []byte, from *net.UDPAddr, addr *net.UDPAddr) {
+	network.lock.Lock()
+	to, exists := network.transports[addr.String()]
+	network.lock.Unlock()
+
+	if !exists {
+		return
+	}
+
+	// The sender may reuse its buffer
+	copied := make([]byte, len(data))
+	copy(copied, data)
+
+	if network.sim != nil {
+		network.sim.deliver(to, copied, from)
+		return
+	}
+
+	select {
+	case to.inbox <- memory_datagram{data: copied, from: from}:
+	default:
+	}
+}
+
+func (memory *memory_transport) readBatch(buffers []*[]byte, lengths []int, addrs []*net.UDPAddr) (int, error) {
+	var datagram memory_datagram
+
+	select {
+	case datagram = <-memory.inbox:
+	case <-memory.closed:
+		return 0, net.ErrClosed
+	}
+
+	received := 0
+	for {
+		lengths[received] = copy(*buffers[received], datagram.data)
+		addrs[received] = datagram.from
+		received += 1
+
+		if received == len(buffers) {
+			return received, nil
+		}
+
+		select {
+		case datagram = <-memory.inbox:
+		default:
+			return received, nil
+		}
+	}
+}
+
+func (memory *memory_transport) writeTo(data []byte, addr *net.UDPAddr) error {
+	select {
+	case <-memory.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	if addr == nil {
+		return errors.New("writeTo: no address")
+	}
+
+	memory.network.deliver(data, memory.addr, addr)
+	return nil
+}
+
+func (memory *memory_transport) localAddr() *net.UDPAddr {
+	return memory.addr
+}
+
+func (memory *memory_transport) close() error {
+	memory.once.Do(func() {
+		memory.network.lock.Lock()
+		delete(memory.network.transports, memory.addr.String())
+		memory.network.lock.Unlock()
+
+		close(memory.closed)
+	})
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// readOne reads a single datagram from a transport
+func readOne(t *testing.T, memory *memory_transport) (string, *net.UDPAddr, error) {
+	t.Helper()
+
+	buffer := make([]byte, LISTEN_BUFFER_SIZE)
+	lengths := make([]int, 1)
+	addrs := make([]*net.UDPAddr, 1)
+
+	if _, err := memory.readBatch([]*[]byte{&buffer}, lengths, addrs); err != nil {
+		return "", nil, err
+	}
+	return string(buffer[:lengths[0]]), addrs[0], nil
+}
+
+// Port 0 picks a free port, a taken address is refused, and a closed transport's address is free again
+func TestMemoryTransportPorts(t *testing.T) {
+	network := newMemoryNetwork()
+	ip := net.IPv4(10, 0, 0, 1)
+
+	first, err := network.listen(&net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := network.listen(&net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.localAddr().Port == 0 || first.localAddr().Port == second.localAddr().Port {
+		t.Fatalf("picked ports %d and %d", first.localAddr().Port, second.localAddr().Port)
+	}
+
+	fixed := &net.UDPAddr{IP: ip, Port: network.nextPort + 1}
+	bound, err := network.listen(fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.listen(fixed); err == nil {
+		t.Fatalf("%s bound twice", fixed)
+	}
+
+	// The next free port skips the one taken explicitly
+	third, err := network.listen(&net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.localAddr().Port == fixed.Port {
+		t.Errorf("picked %d, which was already taken", fixed.Port)
+	}
+
+	bound.close()
+	if _, err := network.listen(fixed); err != nil {
+		t.Errorf("closed transport's address still taken: %v", err)
+	}
+}
+
+// Datagrams reach whoever is at the address with the sender's address, copied, and closing stops both
+// reading and writing, while datagrams for nobody just vanish
+func TestMemoryTransportDelivery(t *testing.T) {
+	network := newMemoryNetwork()
+	a, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello")
+	if err := a.writeTo(data, b.localAddr()); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'j' // The sender reusing its buffer doesn't change what's in flight
+
+	got, from, err := readOne(t, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" || from.String() != a.localAddr().String() {
+		t.Errorf("got %q from %s, expected \"hello\" from %s", got, from, a.localAddr())
+	}
+
+	if err := a.writeTo(data, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1}); err != nil {
+		t.Errorf("writing to an empty address: %v", err)
+	}
+	if err := a.writeTo(data, nil); err == nil {
+		t.Error("writing with no address succeeded")
+	}
+
+	// A blocked reader is woken by close
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := readOne(t, b)
+		read <- err
+	}()
+	b.close()
+	if err := <-read; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read on a closed transport returned %v, expected net.ErrClosed", err)
+	}
+	if err := b.writeTo(data, a.localAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write on a closed transport returned %v, expected net.ErrClosed", err)
+	}
+	if err := b.close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+
+	// Nobody's there to take it any more
+	if err := a.writeTo(data, b.localAddr()); err != nil {
+		t.Errorf("writing to a closed transport's address: %v", err)
+	}
+}
+
+// A full inbox drops datagrams, like a full socket buffer
+func TestMemoryTransportFullInbox(t *testing.T) {
+	network := newMemoryNetwork()
+	a, _ := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	b, _ := network.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)})
+
+	for i := 0; i < MEMORY_QUEUE_SIZE+10; i++ {
+		if err := a.writeTo([]byte{byte(i)}, b.localAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queued := len(b.inbox); queued != MEMORY_QUEUE_SIZE {
+		t.Errorf("%d datagrams queued, expected %d", queued, MEMORY_QUEUE_SIZE)
+	}
+}
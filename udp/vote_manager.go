@@ -1,11 +1,9 @@
 // Defines the Vote Manager Structure
-package main
+package core
 
 import (
-	"fmt"
-	"log"
-	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/expr-lang/expr"
 	"github.com/google/uuid"
@@ -14,13 +12,19 @@ import (
 // This is hosted on the server
 type host_referendum struct {
 	// Info
-	VoteID   uuid.UUID
-	Question string
-	ongoing  bool // This tells the program if the Vote is still going
+	VoteID    uuid.UUID
+	Question  string
+	ongoing   bool      // This tells the program if the Vote is still going
+	started   time.Time // When the server started hosting it, for the time to verdict
+	deadline  time.Time // When it's closed if it's still going, see close_at_deadline
+	timed_out bool      // Closed at its deadline rather than called
 
 	// Mutex lock for this referendum
 	referendum_lock sync.Mutex
 
+	// Client that asked for this vote, it gets the verdict even if it isn't a participant
+	proposer *conversation
+
 	// Participants, this is a copy of the conversations map at the time of making the vote,
 	// the index is the conversationID of each participant
 	participants map[uint32]*conversation
@@ -37,34 +41,35 @@ type host_referendum struct {
 
 // This function copies the current conversations we have a connection with into the participants map
 // this way if a new client/conversation arrives, it won't mess with this referendum
-func (h_referendum *host_referendum) copyConversationsMap() {
-	conversations_lock.Lock()
+func (h_referendum *host_referendum) copyConversationsMap(node *Node) {
+	node.conversations_lock.Lock()
 	h_referendum.referendum_lock.Lock()
-	var foundFeature bool
-	for key, conversation_ref := range conversations {
-		foundFeature = false
-		for i := uint32(0); i < uint32(len(conversation_ref.conversation_features)); i++ {
-			if conversation_ref.conversation_features[i] == simple_eval {
-				foundFeature = true
-				break
-			}
-		}
-
-		if foundFeature && conversation_ref.online {
-			log.Printf("\nAdding Conversation ID: %d to Vote ID: %s.\n", conversation_ref.conversation_id, h_referendum.VoteID)
+	for key, conversation_ref := range node.conversations {
+		if conversation_ref.hasFeature(simple_eval) && conversation_ref.isOnline() {
+			node.vote_log.Debug("Adding participant", "vote_id", h_referendum.VoteID, "conversation", conversation_ref.conversation_id)
 			h_referendum.participants[key] = conversation_ref
 		}
 	}
 	h_referendum.referendum_lock.Unlock()
-	conversations_lock.Unlock()
+	node.conversations_lock.Unlock()
 }
 
 // This function is basically a constructor for the host_referendum struct
-func (manager *referendum_manager) newHostReferendum(pckt *PcktVoteRequest) *host_referendum {
+func (manager *referendum_manager) newHostReferendum(pckt *PcktVoteRequest, proposer *conversation) *host_referendum {
+	// The proposer's deadline if it asked for one
+	open_for := manager.node.vote_deadline
+	if pckt.Deadline != 0 {
+		open_for = time.Duration(pckt.Deadline) * time.Millisecond
+	}
+
+	started := manager.node.now()
 	return &host_referendum{
 		VoteID:       pckt.VoteID,
 		Question:     pckt.Question,
 		ongoing:      true,
+		started:      started,
+		deadline:     started.Add(open_for),
+		proposer:     proposer,
 		participants: make(map[uint32]*conversation),
 		who:          make(map[uint32]bool),
 		votes:        make(map[uint16]uint64),
@@ -87,6 +92,10 @@ type client_referendum struct {
 
 	// Received Final Result
 	complete bool
+
+	// Ballots counted in the freshest tally update seen so far,
+	// tally updates are unreliable so older ones arriving late are ignored
+	tallyCast uint64
 }
 
 func (manager *referendum_manager) newClientReferendum(pckt *PcktVoteRequest) *client_referendum {
@@ -98,6 +107,9 @@ func (manager *referendum_manager) newClientReferendum(pckt *PcktVoteRequest) *c
 }
 
 type referendum_manager struct {
+	// Node the referendums are held on
+	node *Node
+
 	// Hosted Referendums
 	h_referendums      map[uuid.UUID]*host_referendum
 	h_referendums_lock sync.Mutex
@@ -105,36 +117,115 @@ type referendum_manager struct {
 	// Participating as a client Referenums
 	c_referendums      map[uuid.UUID]*client_referendum
 	c_referendums_lock sync.Mutex
+
+	// Referendums this node proposed with Propose, waiting for their verdict
+	proposals      map[uuid.UUID]chan Verdict
+	proposals_lock sync.Mutex
+
+	// Told about every hosted referendum's lifecycle (observer.go)
+	observers      []ReferendumObserver
+	observers_lock sync.Mutex
 }
 
-func newReferendumManager() *referendum_manager {
+func newReferendumManager(node *Node) *referendum_manager {
 	return &referendum_manager{
+		node:          node,
 		h_referendums: make(map[uuid.UUID]*host_referendum),
 		c_referendums: make(map[uuid.UUID]*client_referendum),
+		proposals:     make(map[uuid.UUID]chan Verdict),
 	}
 }
 
 // Used by the Packet Processor when the PcktVoteRequest packet comes in
-func (manager *referendum_manager) create_referendum_from_client_request(pckt *PcktVoteRequest) {
+func (manager *referendum_manager) create_referendum_from_client_request(pckt *PcktVoteRequest, proposer *conversation) {
 
 	manager.h_referendums_lock.Lock()
 	defer manager.h_referendums_lock.Unlock()
 
-	// Check for duplicate VoteIDs in host_referendum map
+	// Check for duplicate VoteIDs in host_referendum map, a retransmitted request must not restart the vote
 	if _, exists := manager.h_referendums[pckt.VoteID]; exists {
-		if debug_mode {
-			log.Printf("Duplicate Vote ID detected\n")
+		manager.node.vote_log.Debug("Duplicate Vote ID detected", "vote_id", pckt.VoteID)
+		return
+	}
+
+	// No new referendums while shutting down, nor any asked to stay open longer than the server allows, or
+	// with a question some client's path might not carry, the proposer gets a TIMEOUT verdict rather than
+	// waiting for nothing
+	refusal := ""
+	if manager.node.ShuttingDown() {
+		refusal = "shutting down"
+	} else if time.Duration(pckt.Deadline)*time.Millisecond > manager.node.max_vote_deadline {
+		refusal = "deadline too far off"
+	} else if len(pckt.Question) > MAX_QUESTION_SIZE {
+		refusal = "question too long to get to every client"
+	}
+
+	if refusal != "" {
+		manager.node.vote_log.Info("Refusing referendum, "+refusal, "vote_id", pckt.VoteID)
+		if proposer != nil {
+			refused := manager.newHostReferendum(pckt, proposer)
+			refused.ongoing = false
+			refused.result = TIMEOUT
+
+			refused.referendum_lock.Lock()
+			proposer.sendVerdictToClient(refused)
+			refused.referendum_lock.Unlock()
 		}
+		return
 	}
 
 	// Create a Referendum Object that this Node (server) is hosting
-	manager.h_referendums[pckt.VoteID] = manager.newHostReferendum(pckt)
-	manager.h_referendums[pckt.VoteID].copyConversationsMap()
+	manager.h_referendums[pckt.VoteID] = manager.newHostReferendum(pckt, proposer)
+
+	var proposer_id uint32 = 0
+	if proposer != nil {
+		proposer_id = proposer.conversation_id
+	}
+	manager.notify(func(observer ReferendumObserver) {
+		observer.ReferendumCreated(pckt.VoteID, pckt.Question, proposer_id)
+	})
+
+	manager.h_referendums[pckt.VoteID].copyConversationsMap(manager.node)
+
+	manager.h_referendums[pckt.VoteID].referendum_lock.Lock()
+	participants := manager.h_referendums[pckt.VoteID].participantIDs()
+	manager.h_referendums[pckt.VoteID].referendum_lock.Unlock()
+
+	manager.notify(func(observer ReferendumObserver) {
+		observer.ParticipantsSnapshot(pckt.VoteID, participants)
+	})
 
 	// Broadcast Referendum Question to clients
 	for _, participant := range manager.h_referendums[pckt.VoteID].participants {
 		participant.sendVoteBroadcastToClient(manager.h_referendums[pckt.VoteID])
 	}
+
+	// Silent participants or a tie mustn't keep it open forever
+	vote_id := pckt.VoteID
+	open_for := manager.h_referendums[vote_id].deadline.Sub(manager.h_referendums[vote_id].started)
+	manager.node.after(open_for, "referendum "+vote_id.String(), func() {
+		manager.close_at_deadline(vote_id)
+	})
+}
+
+// Used when a participant's client restarted and resumed its conversation,
+// asks it again about every ongoing referendum it hasn't voted in yet
+func (manager *referendum_manager) resume_participant(participant *conversation) {
+	manager.h_referendums_lock.Lock()
+	defer manager.h_referendums_lock.Unlock()
+
+	for _, h_ref := range manager.h_referendums {
+		h_ref.referendum_lock.Lock()
+
+		_, isParticipant := h_ref.participants[participant.conversation_id]
+		_, hasVoted := h_ref.who[participant.conversation_id]
+
+		if h_ref.ongoing && isParticipant && !hasVoted {
+			participant.sendVoteBroadcastToClient(h_ref)
+		}
+
+		h_ref.referendum_lock.Unlock()
+	}
 }
 
 // Used by the Packet Processor when the PcktVoteBroadcast packet comes in on a client
@@ -144,9 +235,7 @@ func (manager *referendum_manager) handle_new_question_from_server(pckt *PcktVot
 
 	// Check for duplicate VoteIDs in host_referendum map
 	if _, exists := manager.c_referendums[pckt.VoteID]; exists {
-		if debug_mode {
-			log.Printf("Duplicate Vote ID detected\n")
-		}
+		manager.node.vote_log.Debug("Duplicate Vote ID detected", "vote_id", pckt.VoteID)
 		return
 	}
 
@@ -157,11 +246,9 @@ func (manager *referendum_manager) handle_new_question_from_server(pckt *PcktVot
 	manager.c_referendums[pckt.VoteID].referendum_lock.Lock()
 	defer manager.c_referendums[pckt.VoteID].referendum_lock.Unlock()
 
-	log.Printf("\n\nReceived a request to vote on Vote ID: %s, Question: %s.\n\n", pckt.VoteID, manager.c_referendums[pckt.VoteID].Question)
-
 	manager.c_referendums[pckt.VoteID].result = manager.computeQuestion(pckt.Question)
 
-	fmt.Print("\n-----------------------------------------------------------------------------------\n") //83
+	manager.node.vote_log.Info("Received a request to vote", "vote_id", pckt.VoteID, "question", pckt.Question, "response", manager.c_referendums[pckt.VoteID].result)
 
 	// Send Response back to server (asker, conversation who asked)
 	if asker != nil {
@@ -175,18 +262,14 @@ func (manager *referendum_manager) computeQuestion(question string) uint16 {
 	// use evaluate function to return result
 	program, err := expr.Compile(question, expr.AsBool())
 	if err != nil {
-		if debug_mode {
-			log.Println("Error compiling question: ", err)
-		}
+		manager.node.vote_log.Debug("Error compiling question", "question", question, "err", err)
 
 		response = SYNTAX_ERROR
 	}
 
 	compute, err := expr.Run(program, nil)
 	if err != nil {
-		if debug_mode {
-			log.Println("Error running question: ", err)
-		}
+		manager.node.vote_log.Debug("Error running question", "question", question, "err", err)
 		response = SYNTAX_ERROR
 	} else {
 		if compute.(bool) {
@@ -196,7 +279,7 @@ func (manager *referendum_manager) computeQuestion(question string) uint16 {
 		}
 
 		// Flip the value by chance
-		if defect_constant > rand.Float64() {
+		if manager.node.defectChance() > manager.node.rng.Float64() {
 			if response == SAT {
 				response = UNSAT
 			} else if response == UNSAT {
@@ -205,8 +288,6 @@ func (manager *referendum_manager) computeQuestion(question string) uint16 {
 		}
 	}
 
-	fmt.Println("Computed Response: ", response)
-
 	return response
 }
 
@@ -216,9 +297,7 @@ func (manager *referendum_manager) handle_response_from_client(pckt *PcktVoteRes
 
 	// Check if referendum exists
 	if _, exists := manager.h_referendums[pckt.VoteID]; !exists {
-		if debug_mode {
-			log.Printf("Referendum doesn't exist\n")
-		}
+		manager.node.vote_log.Debug("Referendum doesn't exist", "vote_id", pckt.VoteID)
 		return
 	}
 
@@ -228,33 +307,25 @@ func (manager *referendum_manager) handle_response_from_client(pckt *PcktVoteRes
 
 	// Check if referendum is still going
 	if manager.h_referendums[pckt.VoteID].ongoing == false {
-		if debug_mode {
-			log.Printf("Referendum is over\n")
-		}
+		manager.node.vote_log.Debug("Referendum is over", "vote_id", pckt.VoteID)
 		return
 	}
 
 	// check if responder (client voting) is not nil
 	if responder == nil {
-		if debug_mode {
-			log.Printf("Responder doesn't exist\n")
-		}
+		manager.node.vote_log.Debug("Responder doesn't exist", "vote_id", pckt.VoteID)
 		return
 	}
 
 	// Check if the responder can vote here
 	if _, exists := manager.h_referendums[pckt.VoteID].participants[responder.conversation_id]; !exists {
-		if debug_mode {
-			log.Printf("Responder is not a legible participant in this vote\n")
-		}
+		manager.node.vote_log.Debug("Responder is not a legible participant in this vote", "vote_id", pckt.VoteID, "conversation", responder.conversation_id)
 		return
 	}
 
 	// Check if the responder has already voted
 	if _, exists := manager.h_referendums[pckt.VoteID].who[responder.conversation_id]; exists {
-		if debug_mode {
-			log.Printf("Responder has already voted\n")
-		}
+		manager.node.vote_log.Debug("Responder has already voted", "vote_id", pckt.VoteID, "conversation", responder.conversation_id)
 		return
 	}
 
@@ -266,38 +337,116 @@ func (manager *referendum_manager) handle_response_from_client(pckt *PcktVoteRes
 		manager.h_referendums[pckt.VoteID].votes[pckt.Response] = 1
 	}
 
+	manager.notify(func(observer ReferendumObserver) {
+		observer.BallotReceived(pckt.VoteID, responder.conversation_id, pckt.Response)
+	})
+
 	// Check if you can broadcast now
 	manager.broadcast_result_to_clients(manager.h_referendums[pckt.VoteID])
 
+	// Let everyone know how the vote is going if it's still open
+	if manager.h_referendums[pckt.VoteID].ongoing {
+		for _, participant := range manager.h_referendums[pckt.VoteID].participants {
+			participant.sendTallyUpdateToClient(manager.h_referendums[pckt.VoteID])
+		}
+	}
 }
 
 func (manager *referendum_manager) broadcast_result_to_clients(voteRef *host_referendum) {
 	// Check requirements to cast a vote
 	missingVotes := len(voteRef.participants) - len(voteRef.who)
 
-	// Check if any option has more votes than the remaining votes
-	winners := make(map[uint16]bool)
-	for r, v := range voteRef.votes {
-		if v > uint64(missingVotes) {
-			winners[r] = true
-			voteRef.result = r
-		}
+	// The leading option wins once the remaining votes couldn't make the runner up catch it, a tie is never
+	// called, not even with every ballot in, it stays open until its deadline
+	result, leader, runner_up, found := voteRef.leading()
+
+	if !found || leader <= runner_up+uint64(missingVotes) {
+		manager.node.vote_log.Debug("The referendum result cannot be called yet", "vote_id", voteRef.VoteID)
+	} else {
+		manager.node.vote_log.Info("Option has won the referendum", "vote_id", voteRef.VoteID, "result", result, "early", missingVotes > 0)
+		manager.call_result(voteRef, result, missingVotes > 0)
+	}
+}
+
+// Used when a referendum's deadline passes, closes it with the node's timeout policy if it's still going
+func (manager *referendum_manager) close_at_deadline(vote_id uuid.UUID) {
+	manager.h_referendums_lock.Lock()
+	defer manager.h_referendums_lock.Unlock()
+
+	voteRef, exists := manager.h_referendums[vote_id]
+	if !exists {
+		return
 	}
 
-	if len(winners) == 0 {
-		if debug_mode {
-			fmt.Println("The referendum result cannot be called early")
+	voteRef.referendum_lock.Lock()
+	defer voteRef.referendum_lock.Unlock()
+
+	// Called in time
+	if !voteRef.ongoing {
+		return
+	}
+
+	// TIMEOUT unless the policy goes with the ballots cast so far, and one response has the most of them
+	result := TIMEOUT
+	if manager.node.timeout_policy == TIMEOUT_POLICY_PLURALITY {
+		if leading, leader, runner_up, found := voteRef.leading(); found && leader > runner_up {
+			result = leading
 		}
-	} else if len(winners) > 0 {
-		fmt.Printf("\nOption %d has won the referendum\n", winners[0])
-		// Go to each participant's conversation object and send them the Question
-		for _, participant := range voteRef.participants {
-			participant.sendResultBroadcastToClient(voteRef)
+	}
+
+	missingVotes := len(voteRef.participants) - len(voteRef.who)
+	manager.node.vote_log.Warn("Referendum ran past its deadline", "vote_id", vote_id, "result", result, "missing", missingVotes, "policy", manager.node.timeout_policy)
+	manager.node.metrics.referendums_timed_out.Add(1)
+
+	voteRef.timed_out = true
+	manager.call_result(voteRef, result, missingVotes > 0)
+}
+
+// leading returns the response with the most ballots and the ballots it and the runner up have, on a tie
+// they're equal (and the lowest tied response is returned, so the map's order doesn't decide anything),
+// found is false until somebody votes (the caller must hold the referendum's lock)
+func (voteRef *host_referendum) leading() (result uint16, leader uint64, runner_up uint64, found bool) {
+	for r, v := range voteRef.votes {
+		if !found || v > leader || (v == leader && r < result) {
+			runner_up = max(runner_up, leader)
+			leader = v
+			result = r
+			found = true
+		} else {
+			runner_up = max(runner_up, v)
 		}
+	}
+	return result, leader, runner_up, found
+}
+
+// call_result finishes a referendum with result, sending it to the participants and the verdict to the
+// proposer (the caller must hold the referendum's lock)
+func (manager *referendum_manager) call_result(voteRef *host_referendum, result uint16, early bool) {
+	voteRef.result = result
+	manager.node.metrics.time_to_verdict.observe(manager.node.since(voteRef.started).Seconds())
+
+	tallies := voteRef.tallyCopy()
+	manager.notify(func(observer ReferendumObserver) {
+		observer.WinnerCalled(voteRef.VoteID, voteRef.result, early, tallies)
+	})
 
-		// Call finished vote
-		voteRef.ongoing = false
+	// Go to each participant's conversation object and send them the Result
+	for _, participant := range voteRef.participants {
+		participant.sendResultBroadcastToClient(voteRef)
 	}
+
+	// Let the proposer know how it went
+	if voteRef.proposer != nil {
+		voteRef.proposer.sendVerdictToClient(voteRef)
+	}
+
+	recipients := len(voteRef.participants)
+	manager.notify(func(observer ReferendumObserver) {
+		observer.ResultBroadcast(voteRef.VoteID, voteRef.result, recipients)
+	})
+
+	// Call finished vote
+	voteRef.ongoing = false
 }
 
 func (manager *referendum_manager) handle_result_from_server(pckt *PcktVoteResponse) {
@@ -306,9 +455,7 @@ func (manager *referendum_manager) handle_result_from_server(pckt *PcktVoteRespo
 
 	// Check for VoteID in host_referendum map
 	if _, exists := manager.c_referendums[pckt.VoteID]; !exists {
-		if debug_mode {
-			log.Printf("Could not find referendum mentioned\n")
-		}
+		manager.node.vote_log.Debug("Could not find referendum mentioned", "vote_id", pckt.VoteID)
 		return
 	}
 
@@ -323,15 +470,58 @@ func (manager *referendum_manager) handle_result_from_server(pckt *PcktVoteRespo
 
 	// Overwrite if necessary
 	if manager.c_referendums[pckt.VoteID].result != pckt.Response {
-		log.Printf("\n\nConsensus voted against us for Vote ID: %s, Question: %s.\nOur answer was %d, and the consensus answer was %d, overwriting now.\n\n", pckt.VoteID, manager.c_referendums[pckt.VoteID].Question, manager.c_referendums[pckt.VoteID].result, pckt.Response)
+		manager.node.vote_log.Info("Consensus voted against us, overwriting", "vote_id", pckt.VoteID, "question", manager.c_referendums[pckt.VoteID].Question, "ours", manager.c_referendums[pckt.VoteID].result, "consensus", pckt.Response)
 		manager.c_referendums[pckt.VoteID].result = pckt.Response
 	} else {
-		log.Printf("\n\nConsensus agrees with us for Vote ID: %s, Question: %s.\nOur answer was %d, and the consensus answer was %d.\n\n", pckt.VoteID, manager.c_referendums[pckt.VoteID].Question, manager.c_referendums[pckt.VoteID].result, pckt.Response)
+		manager.node.vote_log.Info("Consensus agrees with us", "vote_id", pckt.VoteID, "question", manager.c_referendums[pckt.VoteID].Question, "ours", manager.c_referendums[pckt.VoteID].result, "consensus", pckt.Response)
 	}
 
 	// Mark as complete
 	manager.c_referendums[pckt.VoteID].complete = true
+}
+
+func (manager *referendum_manager) handle_tally_from_server(pckt *PcktVoteTally) {
+	manager.c_referendums_lock.Lock()
+	defer manager.c_referendums_lock.Unlock()
+
+	// Check for VoteID in client_referendum map
+	if _, exists := manager.c_referendums[pckt.VoteID]; !exists {
+		manager.node.vote_log.Debug("Could not find referendum mentioned in tally", "vote_id", pckt.VoteID)
+		return
+	}
+
+	// Lock referendum
+	manager.c_referendums[pckt.VoteID].referendum_lock.Lock()
+	defer manager.c_referendums[pckt.VoteID].referendum_lock.Unlock()
+
+	// Count the ballots in this update
+	var cast uint64 = 0
+	for _, tally := range pckt.Tallies {
+		cast += uint64(tally.Count)
+	}
+
+	// Drop stale or reordered updates
+	if manager.c_referendums[pckt.VoteID].complete || cast <= manager.c_referendums[pckt.VoteID].tallyCast {
+		return
+	}
+	manager.c_referendums[pckt.VoteID].tallyCast = cast
+
+	manager.node.vote_log.Debug("Tally update", "vote_id", pckt.VoteID, "cast", cast, "participants", pckt.Participants, "tallies", pckt.Tallies)
+}
+
+// clientResult returns what a client holds as a referendum's result (its own ballot until the server's
+// result overwrites it), final once the server's result has arrived, exists is false if it was never asked
+func (manager *referendum_manager) clientResult(vote_id uuid.UUID) (result uint16, final bool, exists bool) {
+	manager.c_referendums_lock.Lock()
+	defer manager.c_referendums_lock.Unlock()
+
+	c_ref, exists := manager.c_referendums[vote_id]
+	if !exists {
+		return 0, false, false
+	}
 
-	fmt.Print("-----------------------------------------------------------------------------------\n") //83
+	c_ref.referendum_lock.Lock()
+	defer c_ref.referendum_lock.Unlock()
 
+	return c_ref.result, c_ref.complete, true
 }